@@ -2,12 +2,16 @@ package main
 
 import (
 	"flag"
+	"os"
 	"runtime"
 	"wistia-s3/pkg"
 )
 
 func main() {
 	conf_path := flag.String("c", "conf.json", "config json file")
+	sandbox := flag.Bool("sandbox", false, "serve Wistia API from fixture files instead of api.wistia.com")
+	sandbox_listen := flag.String("sandbox-listen", "127.0.0.1:3032", "listen address of the sandbox Wistia API")
+	sandbox_fixtures := flag.String("sandbox-fixtures", "tests/fixtures/wistia", "fixture directory of the sandbox Wistia API")
 	flag.Parse()
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -20,6 +24,12 @@ func main() {
 
 	conf.MarginWithENV()
 
+	if *sandbox {
+		if err := pkg.EnableSandbox(conf, *sandbox_listen, *sandbox_fixtures); err != nil {
+			os.Exit(1)
+		}
+	}
+
 	pkg.Log.Debug("config loaded", "config", conf)
 
 	service := pkg.NewHTTP(conf)
@@ -0,0 +1,270 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const CDN_PROVIDER_NONE = "none"
+
+const CDN_PROVIDER_CLOUDFRONT = "cloudfront"
+
+const CDN_PROVIDER_CLOUDFLARE = "cloudflare"
+
+const CDN_PROVIDER_FASTLY = "fastly"
+
+// cloudflarePurgeBatch is the most files or prefixes Cloudflare accepts per purge request.
+const cloudflarePurgeBatch = 30
+
+// CDNPurger flushes cached copies of storage objects from a CDN. Paths are addressed from the
+// bucket root like CloudFront invalidation paths, e.g. "/wistia-backup/media/abc/*"; a trailing
+// * purges everything under the directory.
+type CDNPurger interface {
+	// Purge flushes paths; taskId, when set, is the task the purge is reported on.
+	Purge(taskId string, paths ...string) error
+}
+
+type CDNConfig struct {
+	// Provider is cloudfront, cloudflare, fastly or none. Empty means cloudfront when a
+	// CloudFront distribution is configured, except on the s3 target which is then not purged.
+	Provider string `json:"provider"`
+	// PublicBaseURL is where the CDN serves the bucket root, used to turn paths into URLs.
+	PublicBaseURL string `json:"public_base_url"`
+
+	CloudflareAPIBase string `json:"cloudflare_api_base"`
+	CloudflareZoneID  string `json:"cloudflare_zone_id"`
+	CloudflareToken   string `json:"cloudflare_token"`
+
+	FastlyAPIBase   string `json:"fastly_api_base"`
+	FastlyServiceID string `json:"fastly_service_id"`
+	FastlyAPIKey    string `json:"fastly_api_key"`
+}
+
+func LoadCDNConfigWithEnv() *CDNConfig {
+	return &CDNConfig{
+		Provider:          os.Getenv("CDN_PROVIDER"),
+		PublicBaseURL:     os.Getenv("CDN_PUBLIC_BASE_URL"),
+		CloudflareAPIBase: os.Getenv("CLOUDFLARE_API_BASE"),
+		CloudflareZoneID:  os.Getenv("CLOUDFLARE_ZONE_ID"),
+		CloudflareToken:   os.Getenv("CLOUDFLARE_API_TOKEN"),
+		FastlyAPIBase:     os.Getenv("FASTLY_API_BASE"),
+		FastlyServiceID:   os.Getenv("FASTLY_SERVICE_ID"),
+		FastlyAPIKey:      os.Getenv("FASTLY_API_KEY"),
+	}
+}
+
+// NewCDNPurger returns the purger selected by conf.CDN, or nil when nothing needs purging.
+func NewCDNPurger(conf *StorageConfig) CDNPurger {
+	cdn := conf.CDN
+	if cdn == nil {
+		cdn = &CDNConfig{}
+	}
+	provider := strings.ToLower(cdn.Provider)
+	if provider == "" && conf.S3 != nil && len(conf.S3.CloudFrontDistID) > 0 {
+		provider = CDN_PROVIDER_CLOUDFRONT
+	}
+	if len(cdn.PublicBaseURL) <= 0 && conf.S3 != nil {
+		// a CDN in front of the bucket usually is the public base URL already
+		fallback := *cdn
+		fallback.PublicBaseURL = conf.S3.PublicBaseURL
+		cdn = &fallback
+	}
+
+	switch provider {
+	case CDN_PROVIDER_CLOUDFRONT:
+		if manager := GetInvalidationManager(conf.S3); manager != nil {
+			return &CloudFrontPurger{manager: manager}
+		}
+	case CDN_PROVIDER_CLOUDFLARE:
+		return NewCloudflarePurger(cdn)
+	case CDN_PROVIDER_FASTLY:
+		return NewFastlyPurger(cdn)
+	case "", CDN_PROVIDER_NONE:
+	default:
+		Log.Warn("unknown CDN provider, cache purging disabled", "provider", cdn.Provider)
+	}
+	return nil
+}
+
+// CloudFrontPurger hands paths to the shared InvalidationManager, which batches them.
+type CloudFrontPurger struct {
+	manager *InvalidationManager
+}
+
+func (this *CloudFrontPurger) Purge(taskId string, paths ...string) error {
+	this.manager.Submit(taskId, paths...)
+	return nil
+}
+
+type CloudflarePurger struct {
+	Conf   *CDNConfig
+	client *http.Client
+}
+
+func NewCloudflarePurger(conf *CDNConfig) *CloudflarePurger {
+	return &CloudflarePurger{
+		Conf:   conf,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (this *CloudflarePurger) apiBase() string {
+	if len(this.Conf.CloudflareAPIBase) > 0 {
+		return strings.TrimRight(this.Conf.CloudflareAPIBase, "/")
+	}
+	return "https://api.cloudflare.com/client/v4"
+}
+
+// Purge purges files by URL and wildcards by prefix, at most 30 of each per request.
+func (this *CloudflarePurger) Purge(taskId string, paths ...string) error {
+	files := make([]string, 0)
+	prefixes := make([]string, 0)
+	for _, p := range paths {
+		if dir, ok := cdnWildcardDir(p); ok {
+			// Cloudflare prefixes are given without scheme
+			prefixes = append(prefixes, stripScheme(cdnURL(this.Conf.PublicBaseURL, dir))+"/")
+			continue
+		}
+		files = append(files, cdnURL(this.Conf.PublicBaseURL, p))
+	}
+
+	for field, list := range map[string][]string{"files": files, "prefixes": prefixes} {
+		for start := 0; start < len(list); start += cloudflarePurgeBatch {
+			end := start + cloudflarePurgeBatch
+			if end > len(list) {
+				end = len(list)
+			}
+			if err := this.send(map[string][]string{field: list[start:end]}); err != nil {
+				return err
+			}
+		}
+	}
+	Log.Info("Cloudflare cache purged", "zone", this.Conf.CloudflareZoneID, "files", len(files), "prefixes", len(prefixes), "task", taskId)
+	return nil
+}
+
+func (this *CloudflarePurger) send(body interface{}) error {
+	bin, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/zones/%s/purge_cache", this.apiBase(), this.Conf.CloudflareZoneID), bytes.NewReader(bin))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+this.Conf.CloudflareToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode != http.StatusOK || !result.Success {
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("cloudflare purge failed: %d %s", result.Errors[0].Code, result.Errors[0].Message)
+		}
+		return fmt.Errorf("cloudflare purge failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// FastlyPurger purges files by URL. Wildcards purge the surrogate key named after the directory
+// (e.g. "wistia-backup/media/abc"), so the service has to tag responses with the keys of their
+// directory and its parent, see README.
+type FastlyPurger struct {
+	Conf   *CDNConfig
+	client *http.Client
+}
+
+func NewFastlyPurger(conf *CDNConfig) *FastlyPurger {
+	return &FastlyPurger{
+		Conf:   conf,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (this *FastlyPurger) apiBase() string {
+	if len(this.Conf.FastlyAPIBase) > 0 {
+		return strings.TrimRight(this.Conf.FastlyAPIBase, "/")
+	}
+	return "https://api.fastly.com"
+}
+
+func (this *FastlyPurger) Purge(taskId string, paths ...string) error {
+	keys := make([]string, 0)
+	for _, p := range paths {
+		if dir, ok := cdnWildcardDir(p); ok {
+			keys = append(keys, strings.Trim(dir, "/"))
+			continue
+		}
+		target := stripScheme(cdnURL(this.Conf.PublicBaseURL, p))
+		if err := this.send(fmt.Sprintf("%s/purge/%s", this.apiBase(), target), nil); err != nil {
+			return err
+		}
+	}
+	if len(keys) > 0 {
+		header := http.Header{"Surrogate-Key": []string{strings.Join(keys, " ")}}
+		if err := this.send(fmt.Sprintf("%s/service/%s/purge", this.apiBase(), this.Conf.FastlyServiceID), header); err != nil {
+			return err
+		}
+	}
+	Log.Info("Fastly cache purged", "service", this.Conf.FastlyServiceID, "files", len(paths)-len(keys), "keys", len(keys), "task", taskId)
+	return nil
+}
+
+func (this *FastlyPurger) send(url string, header http.Header) error {
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Fastly-Key", this.Conf.FastlyAPIKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("fastly purge failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// cdnWildcardDir returns the directory of a "dir/*" path.
+func cdnWildcardDir(p string) (string, bool) {
+	if !strings.HasSuffix(p, "/*") {
+		return "", false
+	}
+	return strings.TrimSuffix(p, "/*"), true
+}
+
+func cdnURL(baseURL string, p string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimRight(baseURL, "/"), strings.TrimLeft(p, "/"))
+}
+
+func stripScheme(u string) string {
+	if i := strings.Index(u, "://"); i >= 0 {
+		return u[i+3:]
+	}
+	return u
+}
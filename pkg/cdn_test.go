@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestNewCDNPurger(t *testing.T) {
+	cases := []struct {
+		conf *StorageConfig
+		want string
+	}{
+		{&StorageConfig{S3: &S3Config{CloudFrontDistID: "E123"}}, "*pkg.CloudFrontPurger"},
+		{&StorageConfig{S3: &S3Config{CloudFrontDistID: "E123"}, CDN: &CDNConfig{Provider: "none"}}, "<nil>"},
+		{&StorageConfig{CDN: &CDNConfig{Provider: "Cloudflare"}}, "*pkg.CloudflarePurger"},
+		{&StorageConfig{CDN: &CDNConfig{Provider: "fastly"}}, "*pkg.FastlyPurger"},
+		{&StorageConfig{}, "<nil>"},
+	}
+	for _, c := range cases {
+		got := "<nil>"
+		if purger := NewCDNPurger(c.conf); purger != nil {
+			got = reflect.TypeOf(purger).String()
+		}
+		if got != c.want {
+			t.Errorf("provider %+v: got %s, want %s", c.conf.CDN, got, c.want)
+		}
+	}
+}
+
+func TestCDNPaths(t *testing.T) {
+	conf := &StorageConfig{S3: &S3Config{AccessKey: "key", PrefixPath: "wistia-backup", CloudFrontDomain: "cdn.example.com"}}
+	want := []string{"/wistia-backup/media/abc/*", "/wistia-backup/cloudfront/media/abc/*"}
+	got := make([]string, 0)
+	for _, target := range conf.PublicationTargets() {
+		got = append(got, target.purgePaths(conf, "media/abc/*")...)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCloudflarePurger_Purge(t *testing.T) {
+	var mu sync.Mutex
+	bodies := make([]map[string][]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/zones/zone1/purge_cache" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`))
+			return
+		}
+		body := make(map[string][]string)
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+		w.Write([]byte(`{"success":true,"errors":[]}`))
+	}))
+	defer server.Close()
+
+	purger := NewCloudflarePurger(&CDNConfig{
+		PublicBaseURL:     "https://media.example.com",
+		CloudflareAPIBase: server.URL,
+		CloudflareZoneID:  "zone1",
+		CloudflareToken:   "token",
+	})
+	if err := purger.Purge("", "/p/media/abc/index.json", "/p/media/abc/*"); err != nil {
+		t.Fatal(err)
+	}
+
+	files, prefixes := []string{}, []string{}
+	for _, body := range bodies {
+		files = append(files, body["files"]...)
+		prefixes = append(prefixes, body["prefixes"]...)
+	}
+	if !reflect.DeepEqual(files, []string{"https://media.example.com/p/media/abc/index.json"}) {
+		t.Errorf("unexpected files %v", files)
+	}
+	if !reflect.DeepEqual(prefixes, []string{"media.example.com/p/media/abc/"}) {
+		t.Errorf("unexpected prefixes %v", prefixes)
+	}
+
+	purger.Conf.CloudflareToken = "wrong"
+	if err := purger.Purge("", "/p/media/abc/index.json"); err == nil {
+		t.Error("expected an error for a rejected purge")
+	}
+}
+
+func TestFastlyPurger_Purge(t *testing.T) {
+	var mu sync.Mutex
+	requests := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Fastly-Key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("Surrogate-Key"))
+		mu.Unlock()
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	purger := NewFastlyPurger(&CDNConfig{
+		PublicBaseURL:   "https://media.example.com",
+		FastlyAPIBase:   server.URL,
+		FastlyServiceID: "svc1",
+		FastlyAPIKey:    "key",
+	})
+	if err := purger.Purge("", "/p/media/wistia-s3.min.js", "/p/media/abc/*", "/p/media/abd/*"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"POST /purge/media.example.com/p/media/wistia-s3.min.js ",
+		"POST /service/svc1/purge p/media/abc p/media/abd",
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("got %v, want %v", requests, want)
+	}
+}
@@ -2,26 +2,22 @@ package pkg
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/cloudfront/cloudfrontiface"
 	"strconv"
 	"time"
 )
 
 type CloudFrontHelper struct {
 	distID string
-	svc    *cloudfront.CloudFront
+	svc    cloudfrontiface.CloudFrontAPI
 }
 
 func NewCloudFrontHelper(conf *S3Config) *CloudFrontHelper {
 	if conf.CloudFrontDistID == "" {
 		return nil
 	}
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(conf.Region),
-		Credentials: credentials.NewStaticCredentials(conf.AccessKey, conf.SecretKey, ""),
-	})
+	sess, err := conf.NewSession(false)
 	if err != nil {
 		Log.Error("failed to create CloudFront session", "dist_id", conf.CloudFrontDistID, "error", err)
 		return nil
@@ -32,10 +28,21 @@ func NewCloudFrontHelper(conf *S3Config) *CloudFrontHelper {
 	}
 }
 
+// InvalidatePaths creates one invalidation right away; most callers should go through
+// NewCDNPurger so paths are batched.
 func (this *CloudFrontHelper) InvalidatePaths(paths []string) error {
 	if this == nil {
 		return nil
 	}
+	invalidation, err := this.createInvalidation(paths)
+	if err != nil {
+		return err
+	}
+	Log.Info("CloudFront invalidation created", "dist_id", this.distID, "invalidation_id", *invalidation.Id)
+	return nil
+}
+
+func (this *CloudFrontHelper) createInvalidation(paths []string) (*cloudfront.Invalidation, error) {
 	items := make([]*string, len(paths))
 	for i, p := range paths {
 		items[i] = aws.String(p)
@@ -52,8 +59,18 @@ func (this *CloudFrontHelper) InvalidatePaths(paths []string) error {
 	}
 	output, err := this.svc.CreateInvalidation(input)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	Log.Info("CloudFront invalidation created", "dist_id", this.distID, "invalidation_id", *output.Invalidation.Id)
-	return nil
+	return output.Invalidation, nil
+}
+
+func (this *CloudFrontHelper) invalidationStatus(id string) (string, error) {
+	output, err := this.svc.GetInvalidation(&cloudfront.GetInvalidationInput{
+		DistributionId: aws.String(this.distID),
+		Id:             aws.String(id),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(output.Invalidation.Status), nil
 }
@@ -0,0 +1,399 @@
+package pkg
+
+import (
+	"math/rand"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+)
+
+// Invalidation states; InProgress and Completed are reported by CloudFront itself.
+const INVALIDATION_STATUS_PENDING = "pending"
+
+const INVALIDATION_STATUS_IN_PROGRESS = "InProgress"
+
+const INVALIDATION_STATUS_COMPLETED = "Completed"
+
+const INVALIDATION_STATUS_ERROR = "error"
+
+// maxInvalidationWildcards keeps a batch under CloudFront's limit of 15 wildcard paths in progress.
+const maxInvalidationWildcards = 15
+
+// maxInvalidationPaths flushes a batch early, CloudFront accepts at most 3000 paths in progress.
+const maxInvalidationPaths = 3000
+
+// minFilesPerWildcard is how many files of one directory are cheaper to invalidate as dir/*.
+const minFilesPerWildcard = 5
+
+// maxInvalidationPoll bounds how long an invalidation is followed with GetInvalidation.
+const maxInvalidationPoll = time.Hour
+
+// Invalidation is one batch of paths sent to CloudFront, as shown on /tasks/{id}.
+type Invalidation struct {
+	Id             string   `json:"id,omitempty"`
+	DistributionId string   `json:"distributionId"`
+	Status         string   `json:"status"`
+	Paths          []string `json:"paths,omitempty"`
+	// Requested is the number of distinct paths submitted before they were collapsed.
+	Requested int    `json:"requested"`
+	CreatedAt string `json:"createdAt"`
+	Error     string `json:"error,omitempty"`
+	// done is when the batch stopped changing: completed, failed or no longer polled.
+	done time.Time
+}
+
+// InvalidationManager coalesces the invalidations of one distribution: paths submitted within
+// Window go out as a single CreateInvalidation, deduped and collapsed into wildcards, retried
+// while CloudFront throttles, then followed with GetInvalidation until completed.
+type InvalidationManager struct {
+	helper *CloudFrontHelper
+	// Window is how long paths are collected before the batch is sent.
+	Window       time.Duration
+	PollInterval time.Duration
+	MaxRetries   int
+	// backoff base and cap, overridable in tests
+	minDelay time.Duration
+	maxDelay time.Duration
+	// taskTTL is how long a task lists its batches once they are all done.
+	taskTTL time.Duration
+
+	mu      sync.Mutex
+	batch   *Invalidation
+	pending map[string]bool
+	byTask  map[string][]*Invalidation
+}
+
+var (
+	invalidationManagers   = make(map[string]*InvalidationManager)
+	invalidationManagersMu sync.Mutex
+)
+
+// InvalidationWindow returns InvalidationWindowSeconds as a duration, 10 seconds when unset and
+// no window when negative.
+func (c *S3Config) InvalidationWindow() time.Duration {
+	if c.InvalidationWindowSeconds < 0 {
+		return 0
+	}
+	if c.InvalidationWindowSeconds == 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.InvalidationWindowSeconds) * time.Second
+}
+
+// GetInvalidationManager returns the manager shared by everything invalidating the distribution
+// of conf, or nil when no distribution is configured.
+func GetInvalidationManager(conf *S3Config) *InvalidationManager {
+	if conf == nil || conf.CloudFrontDistID == "" {
+		return nil
+	}
+	invalidationManagersMu.Lock()
+	defer invalidationManagersMu.Unlock()
+
+	if manager, ok := invalidationManagers[conf.CloudFrontDistID]; ok {
+		return manager
+	}
+	helper := NewCloudFrontHelper(conf)
+	if helper == nil {
+		return nil
+	}
+	manager := NewInvalidationManager(helper, conf.InvalidationWindow())
+	invalidationManagers[conf.CloudFrontDistID] = manager
+	return manager
+}
+
+func NewInvalidationManager(helper *CloudFrontHelper, window time.Duration) *InvalidationManager {
+	return &InvalidationManager{
+		helper:       helper,
+		Window:       window,
+		PollInterval: 30 * time.Second,
+		MaxRetries:   5,
+		minDelay:     time.Second,
+		maxDelay:     time.Minute,
+		taskTTL:      taskDetailsTTL,
+		byTask:       make(map[string][]*Invalidation),
+	}
+}
+
+// Submit queues paths for the next batch. When taskId is set the batch is listed on /tasks/{id}.
+func (this *InvalidationManager) Submit(taskId string, paths ...string) {
+	if this == nil || len(paths) <= 0 {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.pruneTasks(time.Now())
+	batch := this.batch
+	if batch == nil {
+		batch = &Invalidation{
+			DistributionId: this.helper.distID,
+			Status:         INVALIDATION_STATUS_PENDING,
+			CreatedAt:      time.Now().Format(time.RFC3339),
+		}
+		this.batch = batch
+		this.pending = make(map[string]bool)
+		time.AfterFunc(this.Window, func() {
+			this.flush(batch)
+		})
+	}
+	for _, p := range paths {
+		this.pending[p] = true
+	}
+	if len(taskId) > 0 {
+		listed := false
+		for _, item := range this.byTask[taskId] {
+			listed = listed || item == batch
+		}
+		if !listed {
+			this.byTask[taskId] = append(this.byTask[taskId], batch)
+		}
+	}
+	if len(this.pending) >= maxInvalidationPaths {
+		go this.flush(batch)
+	}
+}
+
+// Invalidations returns a copy of the batches holding paths submitted by taskId.
+func (this *InvalidationManager) Invalidations(taskId string) []*Invalidation {
+	if this == nil {
+		return nil
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	list := make([]*Invalidation, 0, len(this.byTask[taskId]))
+	for _, batch := range this.byTask[taskId] {
+		view := *batch
+		view.Paths = append([]string(nil), batch.Paths...)
+		list = append(list, &view)
+	}
+	return list
+}
+
+// pruneTasks forgets the tasks whose batches have all been done for longer than taskTTL. Called
+// with mu held.
+func (this *InvalidationManager) pruneTasks(now time.Time) {
+	for taskId, batches := range this.byTask {
+		expired := true
+		for _, batch := range batches {
+			expired = expired && !batch.done.IsZero() && now.Sub(batch.done) >= this.taskTTL
+		}
+		if expired {
+			delete(this.byTask, taskId)
+		}
+	}
+}
+
+// TaskInvalidations returns the invalidations of taskId across every distribution.
+func TaskInvalidations(taskId string) []*Invalidation {
+	invalidationManagersMu.Lock()
+	managers := make([]*InvalidationManager, 0, len(invalidationManagers))
+	for _, manager := range invalidationManagers {
+		managers = append(managers, manager)
+	}
+	invalidationManagersMu.Unlock()
+
+	list := make([]*Invalidation, 0)
+	for _, manager := range managers {
+		list = append(list, manager.Invalidations(taskId)...)
+	}
+	return list
+}
+
+func (this *InvalidationManager) flush(batch *Invalidation) {
+	this.mu.Lock()
+	if this.batch != batch {
+		// already sent because it filled up
+		this.mu.Unlock()
+		return
+	}
+	paths := make([]string, 0, len(this.pending))
+	for p := range this.pending {
+		paths = append(paths, p)
+	}
+	this.batch = nil
+	this.pending = nil
+	batch.Requested = len(paths)
+	batch.Paths = collapseInvalidationPaths(paths)
+	items := batch.Paths
+	this.mu.Unlock()
+
+	invalidation, err := this.create(items)
+
+	this.mu.Lock()
+	if err != nil {
+		batch.Status = INVALIDATION_STATUS_ERROR
+		batch.Error = err.Error()
+		batch.done = time.Now()
+	} else {
+		batch.Id = *invalidation.Id
+		batch.Status = *invalidation.Status
+	}
+	this.mu.Unlock()
+
+	if err != nil {
+		Log.Error("CloudFront invalidation failed", "error", err, "dist_id", batch.DistributionId, "paths", len(items))
+		return
+	}
+	Log.Info("CloudFront invalidation created", "dist_id", batch.DistributionId, "invalidation_id", batch.Id, "requested", batch.Requested, "paths", len(items))
+	this.poll(batch)
+}
+
+func (this *InvalidationManager) create(paths []string) (*cloudfront.Invalidation, error) {
+	for attempt := 0; ; attempt++ {
+		invalidation, err := this.helper.createInvalidation(paths)
+		if err == nil || attempt >= this.MaxRetries || !isRetryableCloudFrontError(err) {
+			return invalidation, err
+		}
+		delay := this.backoff(attempt)
+		Log.Warn("CloudFront invalidation throttled, retrying", "error", err, "attempt", attempt+1, "delay", delay)
+		time.Sleep(delay)
+	}
+}
+
+// poll follows the invalidation until CloudFront reports it completed.
+func (this *InvalidationManager) poll(batch *Invalidation) {
+	defer func() {
+		this.mu.Lock()
+		batch.done = time.Now()
+		this.mu.Unlock()
+	}()
+	deadline := time.Now().Add(maxInvalidationPoll)
+	failures := 0
+	for time.Now().Before(deadline) {
+		time.Sleep(this.PollInterval)
+
+		status, err := this.helper.invalidationStatus(batch.Id)
+		if err != nil {
+			failures++
+			Log.Warn("failed to get CloudFront invalidation status", "error", err, "invalidation_id", batch.Id, "attempt", failures)
+			if failures > this.MaxRetries {
+				this.mu.Lock()
+				batch.Error = err.Error()
+				this.mu.Unlock()
+				return
+			}
+			continue
+		}
+		failures = 0
+
+		this.mu.Lock()
+		batch.Status = status
+		this.mu.Unlock()
+		if status == INVALIDATION_STATUS_COMPLETED {
+			Log.Info("CloudFront invalidation completed", "dist_id", batch.DistributionId, "invalidation_id", batch.Id)
+			return
+		}
+	}
+	Log.Warn("stopped polling CloudFront invalidation", "invalidation_id", batch.Id, "status", batch.Status)
+}
+
+func (this *InvalidationManager) backoff(attempt int) time.Duration {
+	delay := this.minDelay << uint(attempt)
+	if delay <= 0 || delay > this.maxDelay {
+		delay = this.maxDelay
+	}
+	if half := int64(delay / 2); half > 0 {
+		delay += time.Duration(rand.Int63n(half))
+	}
+	return delay
+}
+
+func isRetryableCloudFrontError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cloudfront.ErrCodeTooManyInvalidationsInProgress {
+		return true
+	}
+	return request.IsErrorThrottle(err) || request.IsErrorRetryable(err)
+}
+
+// collapseInvalidationPaths dedupes paths, drops those already covered by a wildcard, turns
+// directories with many files into dir/* and, while a batch holds more wildcards than CloudFront
+// allows in progress, merges the wildcards sharing the most common parent into parent/*.
+func collapseInvalidationPaths(paths []string) []string {
+	set := make(map[string]bool)
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		set[p] = true
+	}
+
+	files := make(map[string][]string)
+	for p := range set {
+		if !strings.Contains(p, "*") {
+			files[path.Dir(p)] = append(files[path.Dir(p)], p)
+		}
+	}
+	for dir, list := range files {
+		if len(list) >= minFilesPerWildcard {
+			for _, p := range list {
+				delete(set, p)
+			}
+			set[wildcardPath(dir)] = true
+		}
+	}
+
+	for {
+		removeCoveredPaths(set)
+
+		groups := make(map[string][]string)
+		wildcards := 0
+		for p := range set {
+			if !strings.Contains(p, "*") {
+				continue
+			}
+			wildcards++
+			if p != "/*" {
+				parent := path.Dir(strings.TrimSuffix(p, "/*"))
+				groups[parent] = append(groups[parent], p)
+			}
+		}
+		if wildcards <= maxInvalidationWildcards || len(groups) <= 0 {
+			break
+		}
+
+		best := ""
+		for parent, members := range groups {
+			if best == "" || len(members) > len(groups[best]) ||
+				(len(members) == len(groups[best]) && (len(parent) > len(best) || (len(parent) == len(best) && parent < best))) {
+				best = parent
+			}
+		}
+		for _, p := range groups[best] {
+			delete(set, p)
+		}
+		set[wildcardPath(best)] = true
+	}
+
+	list := make([]string, 0, len(set))
+	for p := range set {
+		list = append(list, p)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func wildcardPath(dir string) string {
+	return strings.TrimSuffix(dir, "/") + "/*"
+}
+
+// removeCoveredPaths drops every path matched by another wildcard of the set.
+func removeCoveredPaths(set map[string]bool) {
+	for w := range set {
+		if !strings.HasSuffix(w, "*") {
+			continue
+		}
+		prefix := strings.TrimSuffix(w, "*")
+		for p := range set {
+			if p != w && strings.HasPrefix(p, prefix) {
+				delete(set, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/cloudfront/cloudfrontiface"
+)
+
+type fakeCloudFront struct {
+	cloudfrontiface.CloudFrontAPI
+
+	mu       sync.Mutex
+	throttle int
+	created  [][]string
+	polls    int
+}
+
+func (this *fakeCloudFront) CreateInvalidation(input *cloudfront.CreateInvalidationInput) (*cloudfront.CreateInvalidationOutput, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.throttle > 0 {
+		this.throttle--
+		return nil, awserr.New(cloudfront.ErrCodeTooManyInvalidationsInProgress, "too many invalidations", nil)
+	}
+	this.created = append(this.created, aws.StringValueSlice(input.InvalidationBatch.Paths.Items))
+	return &cloudfront.CreateInvalidationOutput{
+		Invalidation: &cloudfront.Invalidation{
+			Id:     aws.String(fmt.Sprintf("I%d", len(this.created))),
+			Status: aws.String(INVALIDATION_STATUS_IN_PROGRESS),
+		},
+	}, nil
+}
+
+func (this *fakeCloudFront) GetInvalidation(input *cloudfront.GetInvalidationInput) (*cloudfront.GetInvalidationOutput, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.polls++
+	status := INVALIDATION_STATUS_IN_PROGRESS
+	if this.polls >= 2 {
+		status = INVALIDATION_STATUS_COMPLETED
+	}
+	return &cloudfront.GetInvalidationOutput{
+		Invalidation: &cloudfront.Invalidation{Id: input.Id, Status: aws.String(status)},
+	}, nil
+}
+
+func TestCollapseInvalidationPaths(t *testing.T) {
+	bulk := []string{"/p/cloudfront/media/wistia-s3.min.js"}
+	for i := 0; i < 500; i++ {
+		bulk = append(bulk, fmt.Sprintf("/p/cloudfront/media/hash%03d/*", i))
+	}
+
+	cases := []struct {
+		name  string
+		paths []string
+		want  []string
+	}{
+		{"dedupe", []string{"/p/a.json", "p/a.json", "/p/b.json"}, []string{"/p/a.json", "/p/b.json"}},
+		{"covered", []string{"/p/media/abc/*", "/p/media/abc/index.json", "/p/media/abd/index.json"}, []string{"/p/media/abc/*", "/p/media/abd/index.json"}},
+		{"many files", []string{"/p/x/1", "/p/x/2", "/p/x/3", "/p/x/4", "/p/x/5", "/p/y"}, []string{"/p/x/*", "/p/y"}},
+		{"bulk move", bulk, []string{"/p/cloudfront/media/*"}},
+	}
+	for _, c := range cases {
+		if got := collapseInvalidationPaths(c.paths); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	few := []string{"/p/media/a/*", "/p/media/b/*", "/p/cloudfront/media/a/*"}
+	if got := collapseInvalidationPaths(few); len(got) != 3 {
+		t.Errorf("wildcards under the limit should be kept, got %v", got)
+	}
+}
+
+func TestInvalidationManager_Batches(t *testing.T) {
+	svc := &fakeCloudFront{throttle: 2}
+	manager := NewInvalidationManager(&CloudFrontHelper{distID: "E123", svc: svc}, 50*time.Millisecond)
+	manager.PollInterval = 5 * time.Millisecond
+	manager.minDelay = time.Millisecond
+	manager.maxDelay = 5 * time.Millisecond
+
+	manager.Submit("t1", "/p/cloudfront/media/abc/*")
+	manager.Submit("t2", "/p/cloudfront/media/abc/*", "/p/cloudfront/media/wistia-s3.min.js")
+
+	pending := manager.Invalidations("t1")
+	if len(pending) != 1 || pending[0].Status != INVALIDATION_STATUS_PENDING {
+		t.Fatalf("expected one pending invalidation, got %+v", pending)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list := manager.Invalidations("t2")
+		if len(list) == 1 && list[0].Status == INVALIDATION_STATUS_COMPLETED {
+			if list[0].Id != "I1" || list[0].Requested != 2 {
+				t.Errorf("unexpected invalidation %+v", list[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("invalidation not completed: %+v", list)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if len(svc.created) != 1 || len(svc.created[0]) != 2 {
+		t.Errorf("expected a single invalidation with 2 paths, got %v", svc.created)
+	}
+	if svc.throttle != 0 {
+		t.Errorf("throttled requests were not retried")
+	}
+}
+
+func TestInvalidationManager_PruneTasks(t *testing.T) {
+	manager := NewInvalidationManager(&CloudFrontHelper{distID: "E123", svc: &fakeCloudFront{}}, time.Hour)
+	now := time.Now()
+	manager.byTask["old"] = []*Invalidation{{Status: INVALIDATION_STATUS_COMPLETED, done: now.Add(-2 * taskDetailsTTL)}}
+	manager.byTask["recent"] = []*Invalidation{{Status: INVALIDATION_STATUS_COMPLETED, done: now.Add(-time.Minute)}}
+	manager.byTask["polling"] = []*Invalidation{
+		{Status: INVALIDATION_STATUS_COMPLETED, done: now.Add(-2 * taskDetailsTTL)},
+		{Status: INVALIDATION_STATUS_IN_PROGRESS},
+	}
+
+	manager.Submit("new", "/p/media/abc/index.json")
+	for taskId, want := range map[string]bool{"old": false, "recent": true, "polling": true, "new": true} {
+		if got := len(manager.Invalidations(taskId)) > 0; got != want {
+			t.Errorf("task %s listed: got %v, want %v", taskId, got, want)
+		}
+	}
+}
+
+func TestS3Config_InvalidationWindow(t *testing.T) {
+	for seconds, want := range map[int]time.Duration{0: 10 * time.Second, 30: 30 * time.Second, -1: 0} {
+		if got := (&S3Config{InvalidationWindowSeconds: seconds}).InvalidationWindow(); got != want {
+			t.Errorf("window for %d: got %s, want %s", seconds, got, want)
+		}
+	}
+}
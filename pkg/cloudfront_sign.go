@@ -0,0 +1,139 @@
+package pkg
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+const SIGN_MODE_URL = "url"
+
+const SIGN_MODE_COOKIE = "cookie"
+
+// maxSignedURLExpiry bounds the expiry a /playback caller may ask for.
+const maxSignedURLExpiry = 7 * 24 * time.Hour
+
+// CloudFrontSigner signs playback URLs of a private bucket with a CloudFront key pair, either
+// per URL or as cookies covering every object of a media.
+type CloudFrontSigner struct {
+	conf    *S3Config
+	privKey *rsa.PrivateKey
+}
+
+// NewCloudFrontSigner loads the key pair of conf, from CloudFrontPrivateKey (PEM) or
+// CloudFrontPrivateKeyPath.
+func NewCloudFrontSigner(conf *S3Config) (*CloudFrontSigner, error) {
+	if !conf.UseCloudFront() {
+		return nil, fmt.Errorf("signed URLs need S3_CLOUDFRONT_DOMAIN")
+	}
+	if len(conf.CloudFrontKeyPairId) <= 0 {
+		return nil, fmt.Errorf("signed URLs need S3_CLOUDFRONT_KEY_PAIR_ID")
+	}
+	switch conf.SignMode() {
+	case SIGN_MODE_URL, SIGN_MODE_COOKIE:
+	default:
+		return nil, fmt.Errorf("unknown CloudFront sign mode %q", conf.CloudFrontSignMode)
+	}
+
+	var privKey *rsa.PrivateKey
+	var err error
+	switch {
+	case len(conf.CloudFrontPrivateKey) > 0:
+		privKey, err = sign.LoadPEMPrivKey(strings.NewReader(conf.CloudFrontPrivateKey))
+	case len(conf.CloudFrontPrivateKeyPath) > 0:
+		privKey, err = sign.LoadPEMPrivKeyFile(conf.CloudFrontPrivateKeyPath)
+	default:
+		return nil, fmt.Errorf("signed URLs need S3_CLOUDFRONT_PRIVATE_KEY or S3_CLOUDFRONT_PRIVATE_KEY_PATH")
+	}
+	if err != nil {
+		Log.Error("failed to load CloudFront private key", "error", err, "path", conf.CloudFrontPrivateKeyPath)
+		return nil, err
+	}
+
+	return &CloudFrontSigner{
+		conf:    conf,
+		privKey: privKey,
+	}, nil
+}
+
+// SignMode returns CloudFrontSignMode, SIGN_MODE_URL when unset.
+func (c *S3Config) SignMode() string {
+	if len(c.CloudFrontSignMode) <= 0 {
+		return SIGN_MODE_URL
+	}
+	return strings.ToLower(c.CloudFrontSignMode)
+}
+
+// SignedURLExpiry is the default lifetime of signed URLs and cookies.
+func (c *S3Config) SignedURLExpiry() time.Duration {
+	if c.SignedURLExpiryMinutes <= 0 {
+		return time.Hour
+	}
+	return time.Duration(c.SignedURLExpiryMinutes) * time.Minute
+}
+
+func (this *CloudFrontSigner) Mode() string {
+	return this.conf.SignMode()
+}
+
+// SignURL returns rawURL with a canned policy signature valid until expires.
+func (this *CloudFrontSigner) SignURL(rawURL string, expires time.Time) (string, error) {
+	return sign.NewURLSigner(this.conf.CloudFrontKeyPairId, this.privKey).Sign(rawURL, expires)
+}
+
+// SignCookies returns the CloudFront-Policy, CloudFront-Signature and CloudFront-Key-Pair-Id
+// cookies granting access to resource, which may end with a * wildcard.
+func (this *CloudFrontSigner) SignCookies(resource string, expires time.Time) ([]*http.Cookie, error) {
+	policy := &sign.Policy{
+		Statements: []sign.Statement{{
+			Resource: resource,
+			Condition: sign.Condition{
+				DateLessThan: sign.NewAWSEpochTime(expires),
+			},
+		}},
+	}
+	signer := sign.NewCookieSigner(this.conf.CloudFrontKeyPairId, this.privKey, func(o *sign.CookieOptions) {
+		o.Path = "/"
+		o.Domain = this.conf.CloudFrontCookieDomain
+		o.Secure = true
+	})
+	return signer.SignWithPolicy(policy)
+}
+
+// SignVideo points the assets and captions of video at CloudFront and, in url mode, signs each
+// of them. Every URL lives under media/{hash}/ so one signed cookie covers them all.
+func (this *CloudFrontSigner) SignVideo(video *WistiaRespVideo, storageConf *StorageConfig, expires time.Time) error {
+	return this.signVideoVia(video, storageConf.CloudFrontURL, expires)
+}
+
+// signVideoVia is SignVideo with link turning keys relative to the storage prefix into URLs.
+func (this *CloudFrontSigner) signVideoVia(video *WistiaRespVideo, link func(key string) string, expires time.Time) error {
+	if video.Assets != nil {
+		for _, asset := range *video.Assets {
+			url, err := this.signedURL(link(assetRemoteKey(video.HashId, asset)), expires)
+			if err != nil {
+				return err
+			}
+			asset.Url = url
+		}
+	}
+	for _, caption := range video.Captions {
+		url, err := this.signedURL(link(captionRemoteKey(video.HashId, caption.Language)), expires)
+		if err != nil {
+			return err
+		}
+		caption.Url = url
+	}
+	return nil
+}
+
+func (this *CloudFrontSigner) signedURL(rawURL string, expires time.Time) (string, error) {
+	if this.Mode() == SIGN_MODE_COOKIE {
+		return rawURL, nil
+	}
+	return this.SignURL(rawURL, expires)
+}
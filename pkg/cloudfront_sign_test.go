@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSigningConf(t *testing.T, mode string) *StorageConfig {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	return &StorageConfig{
+		S3: &S3Config{
+			AccessKey:            "key",
+			Bucket:               "videos",
+			Region:               "ap-southeast-1",
+			PrefixPath:           "wistia-backup",
+			CloudFrontDomain:     "cdn.example.com",
+			Private:              true,
+			CloudFrontKeyPairId:  "K2JCJMDEHXQW5F",
+			CloudFrontPrivateKey: string(block),
+			CloudFrontSignMode:   mode,
+		},
+	}
+}
+
+func TestCloudFrontSigner_SignVideo(t *testing.T) {
+	storageConf := testSigningConf(t, SIGN_MODE_URL)
+	signer, err := NewCloudFrontSigner(storageConf.S3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	video := &WistiaRespVideo{
+		HashId: "abc",
+		Assets: &AssetList{
+			{Type: "Mp4VideoFile", Height: 720, ContentType: "video/mp4", Url: "https://s3.ap-southeast-1.amazonaws.com/videos/wistia-backup/media/abc/720.mp4"},
+		},
+		Captions: []*VideoCaption{{Language: "eng", Url: "https://s3.ap-southeast-1.amazonaws.com/videos/wistia-backup/media/abc/captions/eng.vtt"}},
+	}
+	expires := time.Now().Add(time.Hour)
+	if err := signer.SignVideo(video, storageConf, expires); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, raw := range []string{(*video.Assets)[0].Url, video.Captions[0].Url} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Host != "cdn.example.com" || !strings.HasPrefix(u.Path, "/wistia-backup/media/abc/") {
+			t.Errorf("signed URL not on CloudFront media path: %s", raw)
+		}
+		query := u.Query()
+		if query.Get("Key-Pair-Id") != "K2JCJMDEHXQW5F" || len(query.Get("Signature")) <= 0 {
+			t.Errorf("URL not signed: %s", raw)
+		}
+		if query.Get("Expires") != strconv.FormatInt(expires.Unix(), 10) {
+			t.Errorf("URL without expiry: %s", raw)
+		}
+	}
+}
+
+func TestCloudFrontSigner_Cookies(t *testing.T) {
+	storageConf := testSigningConf(t, SIGN_MODE_COOKIE)
+	signer, err := NewCloudFrontSigner(storageConf.S3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	video := &WistiaRespVideo{
+		HashId: "abc",
+		Assets: &AssetList{{Type: "StillImageFile", ContentType: "image/jpg"}},
+	}
+	if err := signer.SignVideo(video, storageConf, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://cdn.example.com/wistia-backup/media/abc/cover.jpg"; (*video.Assets)[0].Url != want {
+		t.Errorf("cookie mode URL = %s, want %s", (*video.Assets)[0].Url, want)
+	}
+
+	cookies, err := signer.SignCookies(storageConf.CloudFrontURL("media/abc/*"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, cookie := range cookies {
+		names[cookie.Name] = true
+	}
+	for _, name := range []string{"CloudFront-Policy", "CloudFront-Signature", "CloudFront-Key-Pair-Id"} {
+		if !names[name] {
+			t.Errorf("missing cookie %s", name)
+		}
+	}
+}
+
+func TestS3Config_PrivateUploads(t *testing.T) {
+	storageConf := testSigningConf(t, "")
+	opt := storageConf.S3.uploadOptions(&UploadOptions{PublicRead: true})
+	if opt.PublicRead {
+		t.Error("private bucket must not upload with public-read")
+	}
+
+	storageConf.S3.CloudFrontKeyPairId = ""
+	if _, err := NewCloudFrontSigner(storageConf.S3); err == nil {
+		t.Error("signer without key pair id should fail")
+	}
+}
@@ -3,7 +3,9 @@ package pkg
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"os"
+	"strings"
 )
 
 type Config struct {
@@ -26,10 +28,20 @@ func NewConfigFromLocal(filename string) (*Config, error) {
 }
 
 func (this *Config) MarginWithENV() {
-	if this.Storage == nil || this.Storage.S3 == nil {
-		this.Storage = &StorageConfig{
-			S3: LoadS3ConfigWithEnv(),
-		}
+	if this.Storage == nil {
+		this.Storage = &StorageConfig{}
+	}
+	if this.Storage.S3 == nil {
+		this.Storage.S3 = LoadS3ConfigWithEnv()
+	}
+	if this.Storage.Local == nil {
+		this.Storage.Local = LoadLocalConfigWithEnv()
+	}
+	if this.Storage.CDN == nil {
+		this.Storage.CDN = LoadCDNConfigWithEnv()
+	}
+	if this.Storage.Targets == nil {
+		this.Storage.Targets = LoadPublicationTargetsWithEnv()
 	}
 
 	if len(this.TempDir) <= 0 {
@@ -60,6 +72,11 @@ func (this *Config) MarginWithENV() {
 	if len(this.Webroot) <= 0 {
 		this.Webroot = os.Getenv("WEBROOT")
 	}
+
+	if len(this.Storage.Local.BaseURL) <= 0 {
+		host := strings.Replace(this.Listen, "0.0.0.0", "127.0.0.1", 1)
+		this.Storage.Local.BaseURL = fmt.Sprintf("http://%s/files", host)
+	}
 }
 
 func (c *Config) load(filename string) error {
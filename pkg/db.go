@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/boltdb/bolt"
 	"io"
+	"time"
 )
 
 
@@ -123,10 +124,47 @@ func (this *DBHelper) FindVideoInfo(hashId string) (*WistiaRespVideo, error) {
 	return &info, nil
 }
 
+func (this *DBHelper) DeleteVideoInfo(hashId string) error {
+	return this.deleteKey("media", hashId)
+}
+
+func (this *DBHelper) DeleteVideoIndex(hashId string) error {
+	return this.deleteKey("index", hashId)
+}
+
+func (this *DBHelper) DeleteWistiaCatalogVideo(hashId string) error {
+	return this.deleteKey("wistia_catalog", hashId)
+}
+
+func (this *DBHelper) deleteKey(bucketName string, key string) error {
+	db, err := bolt.Open(this.Conf.FilePath, 0600, nil)
+	if err != nil {
+		Log.Error("failed to open BoltDB for delete", "error", err, "path", this.Conf.FilePath, "bucket", bucketName, "key", key)
+		return err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if err != nil {
+			Log.Error("failed to create bucket for delete", "error", err, "bucket", bucketName, "key", key)
+			return err
+		}
+		return bucket.Delete([]byte(key))
+	})
+	if err != nil {
+		Log.Error("delete transaction failed", "error", err, "bucket", bucketName, "key", key)
+		return err
+	}
+
+	return nil
+}
+
 type WistiaSyncMeta struct {
-	LastSyncAt string `json:"lastSyncAt"`
-	TotalCount int    `json:"totalCount"`
-	PageCount  int    `json:"pageCount"`
+	LastSyncAt     string `json:"lastSyncAt"`
+	LastFullSyncAt string `json:"lastFullSyncAt,omitempty"`
+	TotalCount     int    `json:"totalCount"`
+	PageCount      int    `json:"pageCount"`
 }
 
 func (this *DBHelper) SaveWistiaCatalogVideo(hashId string, video *WistiaRespVideo) error {
@@ -363,4 +401,300 @@ func (this *DBHelper) FindVideoIndex(hashId string) (*DashScopeIndexResult, erro
 	}
 
 	return &info, nil
-}
\ No newline at end of file
+}
+// ArchiveAudit records one /archive run that archived media on Wistia.
+type ArchiveAudit struct {
+	Id         string            `json:"id"`
+	ArchivedAt string            `json:"archivedAt"`
+	Archived   []string          `json:"archived"`
+	Checks     []*MigrationCheck `json:"checks"`
+	Error      string            `json:"error,omitempty"`
+}
+
+func (this *DBHelper) SaveArchiveAudit(audit *ArchiveAudit) error {
+	db, err := bolt.Open(this.Conf.FilePath, 0600, nil)
+	if err != nil {
+		Log.Error("failed to open BoltDB for SaveArchiveAudit", "error", err, "path", this.Conf.FilePath, "id", audit.Id)
+		return err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("archive_audit"))
+		if err != nil {
+			Log.Error("failed to create archive_audit bucket", "error", err, "id", audit.Id)
+			return err
+		}
+		bin, err := json.Marshal(audit)
+		if err != nil {
+			Log.Error("failed to marshal archive audit", "error", err, "id", audit.Id)
+			return err
+		}
+		return bucket.Put([]byte(audit.Id), bin)
+	})
+	if err != nil {
+		Log.Error("SaveArchiveAudit transaction failed", "error", err, "id", audit.Id)
+		return err
+	}
+
+	return nil
+}
+
+func (this *DBHelper) GetAllArchiveAudits() ([]*ArchiveAudit, error) {
+	list := make([]*ArchiveAudit, 0)
+
+	db, err := bolt.Open(this.Conf.FilePath, 0600, nil)
+	if err != nil {
+		Log.Error("failed to open BoltDB for GetAllArchiveAudits", "error", err, "path", this.Conf.FilePath)
+		return list, err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("archive_audit"))
+		if err != nil {
+			Log.Error("failed to create archive_audit bucket for GetAllArchiveAudits", "error", err)
+			return err
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var audit ArchiveAudit
+			if err := json.Unmarshal(v, &audit); err != nil {
+				Log.Error("failed to unmarshal archive audit, skipping entry", "error", err, "key", string(k))
+				continue
+			}
+			list = append(list, &audit)
+		}
+		return nil
+	})
+	if err != nil {
+		Log.Error("GetAllArchiveAudits transaction failed", "error", err)
+		return list, err
+	}
+
+	return list, nil
+}
+
+// DeferredMedia is a media whose migration waits for Wistia to finish encoding.
+type DeferredMedia struct {
+	HashId        string  `json:"hash"`
+	Status        string  `json:"status"`
+	Progress      float32 `json:"progress"`
+	DeferredAt    string  `json:"deferredAt"`
+	LastCheckedAt string  `json:"lastCheckedAt"`
+	Attempts      int     `json:"attempts"`
+}
+
+// SaveDeferredMedia records a deferral, keeping the first DeferredAt and counting attempts.
+func (this *DBHelper) SaveDeferredMedia(media *DeferredMedia) error {
+	db, err := bolt.Open(this.Conf.FilePath, 0600, nil)
+	if err != nil {
+		Log.Error("failed to open BoltDB for SaveDeferredMedia", "error", err, "path", this.Conf.FilePath, "hash", media.HashId)
+		return err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("deferred"))
+		if err != nil {
+			Log.Error("failed to create deferred bucket", "error", err, "hash", media.HashId)
+			return err
+		}
+
+		now := time.Now().Format(time.RFC3339)
+		media.DeferredAt = now
+		media.LastCheckedAt = now
+		media.Attempts = 1
+		if bin := bucket.Get([]byte(media.HashId)); bin != nil {
+			var existing DeferredMedia
+			if err := json.Unmarshal(bin, &existing); err == nil {
+				media.DeferredAt = existing.DeferredAt
+				media.Attempts = existing.Attempts + 1
+			}
+		}
+
+		bin, err := json.Marshal(media)
+		if err != nil {
+			Log.Error("failed to marshal deferred media", "error", err, "hash", media.HashId)
+			return err
+		}
+		return bucket.Put([]byte(media.HashId), bin)
+	})
+	if err != nil {
+		Log.Error("SaveDeferredMedia transaction failed", "error", err, "hash", media.HashId)
+		return err
+	}
+
+	return nil
+}
+
+func (this *DBHelper) FindDeferredMedia(hashId string) (*DeferredMedia, error) {
+	db, err := bolt.Open(this.Conf.FilePath, 0600, nil)
+	if err != nil {
+		Log.Error("failed to open BoltDB for FindDeferredMedia", "error", err, "path", this.Conf.FilePath, "hash", hashId)
+		return nil, err
+	}
+	defer db.Close()
+
+	var media DeferredMedia
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("deferred"))
+		if err != nil {
+			Log.Error("failed to create deferred bucket for FindDeferredMedia", "error", err, "hash", hashId)
+			return err
+		}
+
+		bin := bucket.Get([]byte(hashId))
+		if bin == nil {
+			return fmt.Errorf("deferred media not found for %s", hashId)
+		}
+		return json.Unmarshal(bin, &media)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &media, nil
+}
+
+func (this *DBHelper) GetAllDeferredMedia() ([]*DeferredMedia, error) {
+	list := make([]*DeferredMedia, 0)
+
+	db, err := bolt.Open(this.Conf.FilePath, 0600, nil)
+	if err != nil {
+		Log.Error("failed to open BoltDB for GetAllDeferredMedia", "error", err, "path", this.Conf.FilePath)
+		return list, err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("deferred"))
+		if err != nil {
+			Log.Error("failed to create deferred bucket for GetAllDeferredMedia", "error", err)
+			return err
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var media DeferredMedia
+			if err := json.Unmarshal(v, &media); err != nil {
+				Log.Error("failed to unmarshal deferred media, skipping entry", "error", err, "key", string(k))
+				continue
+			}
+			list = append(list, &media)
+		}
+		return nil
+	})
+	if err != nil {
+		Log.Error("GetAllDeferredMedia transaction failed", "error", err)
+		return list, err
+	}
+
+	return list, nil
+}
+
+func (this *DBHelper) DeleteDeferredMedia(hashId string) error {
+	return this.deleteKey("deferred", hashId)
+}
+
+func (this *DBHelper) SaveMultipartUpload(upload *MultipartUpload) error {
+	db, err := bolt.Open(this.Conf.FilePath, 0600, nil)
+	if err != nil {
+		Log.Error("failed to open BoltDB for SaveMultipartUpload", "error", err, "path", this.Conf.FilePath, "key", upload.Key)
+		return err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("multipart"))
+		if err != nil {
+			Log.Error("failed to create multipart bucket", "error", err, "key", upload.Key)
+			return err
+		}
+
+		bin, err := json.Marshal(upload)
+		if err != nil {
+			Log.Error("failed to marshal multipart upload", "error", err, "key", upload.Key)
+			return err
+		}
+		return bucket.Put([]byte(upload.Key), bin)
+	})
+	if err != nil {
+		Log.Error("SaveMultipartUpload transaction failed", "error", err, "key", upload.Key)
+		return err
+	}
+
+	return nil
+}
+
+func (this *DBHelper) FindMultipartUpload(key string) (*MultipartUpload, error) {
+	db, err := bolt.Open(this.Conf.FilePath, 0600, nil)
+	if err != nil {
+		Log.Error("failed to open BoltDB for FindMultipartUpload", "error", err, "path", this.Conf.FilePath, "key", key)
+		return nil, err
+	}
+	defer db.Close()
+
+	var upload MultipartUpload
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("multipart"))
+		if err != nil {
+			Log.Error("failed to create multipart bucket for FindMultipartUpload", "error", err, "key", key)
+			return err
+		}
+
+		bin := bucket.Get([]byte(key))
+		if bin == nil {
+			return fmt.Errorf("multipart upload not found for %s", key)
+		}
+		return json.Unmarshal(bin, &upload)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &upload, nil
+}
+
+func (this *DBHelper) GetAllMultipartUploads() ([]*MultipartUpload, error) {
+	list := make([]*MultipartUpload, 0)
+
+	db, err := bolt.Open(this.Conf.FilePath, 0600, nil)
+	if err != nil {
+		Log.Error("failed to open BoltDB for GetAllMultipartUploads", "error", err, "path", this.Conf.FilePath)
+		return list, err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("multipart"))
+		if err != nil {
+			Log.Error("failed to create multipart bucket for GetAllMultipartUploads", "error", err)
+			return err
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var upload MultipartUpload
+			if err := json.Unmarshal(v, &upload); err != nil {
+				Log.Error("failed to unmarshal multipart upload, skipping entry", "error", err, "key", string(k))
+				continue
+			}
+			list = append(list, &upload)
+		}
+		return nil
+	})
+	if err != nil {
+		Log.Error("GetAllMultipartUploads transaction failed", "error", err)
+		return list, err
+	}
+
+	return list, nil
+}
+
+func (this *DBHelper) DeleteMultipartUpload(key string) error {
+	return this.deleteKey("multipart", key)
+}
@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type ArchiveResult struct {
+	DryRun   bool              `json:"dryRun"`
+	Archived []string          `json:"archived"`
+	Checks   []*MigrationCheck `json:"checks"`
+	AuditId  string            `json:"auditId,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// ArchiveVideo archives the given media on Wistia once their storage copy is verified.
+// With dryRun=true it only reports which media would be archived; allowSkipped=true accepts copies
+// missing the assets the asset policy leaves out.
+func (s *HTTPService) ArchiveVideo(w http.ResponseWriter, r *http.Request) {
+	list := &MultipleMediaBody{}
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      err.Error(),
+			HttpStatus: http.StatusBadRequest,
+		}, w)
+		return
+	}
+	if len(list.HashList) <= 0 {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      "media list cannot be empty",
+			HttpStatus: http.StatusBadRequest,
+		}, w)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	allowSkipped := r.URL.Query().Get("allowSkipped") == "true"
+
+	taskID := generateID()
+	task := &Task{
+		ID:     taskID,
+		Status: TASK_STATUS_RUNNING,
+	}
+
+	tasksMu.Lock()
+	tasks[taskID] = task
+	tasksMu.Unlock()
+
+	go func(taskId string) {
+		result := s.archiveVerifiedVideos(list.HashList, dryRun, allowSkipped, taskId)
+
+		tasksMu.Lock()
+		tasks[taskId] = &Task{
+			Status: TASK_STATUS_FINISHED,
+			Result: result,
+			ID:     taskId,
+		}
+		tasksMu.Unlock()
+	}(taskID)
+
+	s.ResponseJSON(task, w)
+}
+
+func (s *HTTPService) archiveVerifiedVideos(hashList []string, dryRun bool, allowSkipped bool, taskId string) *ArchiveResult {
+	result := &ArchiveResult{
+		DryRun:   dryRun,
+		Archived: make([]string, 0),
+		Checks:   make([]*MigrationCheck, len(hashList)),
+	}
+
+	storage, err := GetStorage(s.config.Storage)
+	if err != nil {
+		Log.Error("archive: failed to create storage", "error", err, "task_id", taskId)
+		result.Error = err.Error()
+		return result
+	}
+
+	helper := NewWistiaHelper(s.config.WistiaConf)
+	s.eachMedia(hashList, func(hashId string, index int) {
+		result.Checks[index] = helper.VerifyMigration(hashId, storage, allowSkipped)
+	})
+
+	verified := make([]string, 0, len(hashList))
+	for _, check := range result.Checks {
+		if check.Verified {
+			verified = append(verified, check.HashId)
+		} else {
+			Log.Warn("archive: media not verified, skipping", "hash", check.HashId, "problems", check.Problems, "task_id", taskId)
+		}
+	}
+
+	if dryRun || len(verified) <= 0 {
+		return result
+	}
+
+	const batchSize = 100
+	for start := 0; start < len(verified); start += batchSize {
+		end := start + batchSize
+		if end > len(verified) {
+			end = len(verified)
+		}
+		if err := helper.ArchiveVideos(verified[start:end]); err != nil {
+			Log.Error("archive: Wistia archive request failed", "error", err, "count", end-start, "task_id", taskId)
+			result.Error = err.Error()
+			break
+		}
+		result.Archived = append(result.Archived, verified[start:end]...)
+	}
+	Log.Info("archive: archived verified media on Wistia", "archived", len(result.Archived), "requested", len(hashList), "task_id", taskId)
+
+	audit := &ArchiveAudit{
+		Id:         taskId,
+		ArchivedAt: time.Now().Format(time.RFC3339),
+		Archived:   result.Archived,
+		Checks:     result.Checks,
+		Error:      result.Error,
+	}
+	if err := NewDBHelper(s.config.DBConf).SaveArchiveAudit(audit); err != nil {
+		Log.Error("archive: failed to save audit record", "error", err, "task_id", taskId)
+		if len(result.Error) <= 0 {
+			result.Error = err.Error()
+		}
+		return result
+	}
+	result.AuditId = audit.Id
+
+	return result
+}
+
+func (s *HTTPService) GetArchiveAudits(w http.ResponseWriter, r *http.Request) {
+	audits, err := NewDBHelper(s.config.DBConf).GetAllArchiveAudits()
+	if err != nil {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      err.Error(),
+			HttpStatus: http.StatusInternalServerError,
+		}, w)
+		return
+	}
+
+	s.ResponseJSON(audits, w)
+}
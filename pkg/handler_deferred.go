@@ -0,0 +1,157 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// deferredRetryTaskId is the task of the last retry pass, guarded by tasksMu.
+var deferredRetryTaskId string
+
+type DeferredRetryResult struct {
+	Checked       int               `json:"checked"`
+	Migrated      int               `json:"migrated"`
+	StillDeferred int               `json:"stillDeferred"`
+	Failed        int               `json:"failed"`
+	Media         []*MoveToS3Result `json:"media"`
+}
+
+func (s *HTTPService) deferVideo(hashId string, reason error) {
+	media := &DeferredMedia{
+		HashId: hashId,
+	}
+	var notReady *MediaNotReadyError
+	if errors.As(reason, &notReady) {
+		media.Status = notReady.Status
+		media.Progress = notReady.Progress
+	}
+	if err := NewDBHelper(s.config.DBConf).SaveDeferredMedia(media); err != nil {
+		Log.Error("failed to record deferred media", "error", err, "hash", hashId)
+	}
+}
+
+func (s *HTTPService) clearDeferredVideo(hashId string) {
+	if err := NewDBHelper(s.config.DBConf).DeleteDeferredMedia(hashId); err != nil {
+		Log.Error("failed to clear deferred media", "error", err, "hash", hashId)
+	}
+}
+
+// retryDeferredVideos runs the migration again for every deferred media. Media that are ready
+// now are migrated and cleared, the rest stay deferred until the next pass.
+func (s *HTTPService) retryDeferredVideos(taskId string) (*DeferredRetryResult, error) {
+	deferred, err := NewDBHelper(s.config.DBConf).GetAllDeferredMedia()
+	if err != nil {
+		return nil, err
+	}
+
+	hashList := make([]string, 0, len(deferred))
+	for _, media := range deferred {
+		hashList = append(hashList, media.HashId)
+	}
+
+	result := &DeferredRetryResult{
+		Checked: len(hashList),
+		Media:   s.moveVideos(hashList, taskId, nil),
+	}
+	for _, row := range result.Media {
+		switch {
+		case row.Status:
+			result.Migrated++
+		case row.Deferred:
+			result.StillDeferred++
+		default:
+			result.Failed++
+		}
+	}
+
+	Log.Info("deferred media retry pass finished", "checked", result.Checked, "migrated", result.Migrated,
+		"still_deferred", result.StillDeferred, "failed", result.Failed, "task_id", taskId)
+	return result, nil
+}
+
+// runDeferredRetryLoop retries deferred media every DeferredRetryMinutes, each pass is visible
+// as a regular task. Ticks with nothing deferred or with the previous pass still running start
+// no task.
+func (s *HTTPService) runDeferredRetryLoop() {
+	interval := time.Duration(s.config.WistiaConf.DeferredRetryMinutes) * time.Minute
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.startDeferredRetryTask(true)
+	}
+}
+
+// startDeferredRetryTask starts a retry pass, or returns the pass still running so two never
+// work on the same media. With skipEmpty it returns nil instead of starting a pass over no media.
+func (s *HTTPService) startDeferredRetryTask(skipEmpty bool) *Task {
+	if skipEmpty {
+		if deferred, err := NewDBHelper(s.config.DBConf).GetAllDeferredMedia(); err == nil && len(deferred) <= 0 {
+			Log.Debug("no deferred media, skipping retry pass")
+			return nil
+		}
+	}
+
+	tasksMu.Lock()
+	if running, ok := tasks[deferredRetryTaskId]; ok && running.Status == TASK_STATUS_RUNNING {
+		tasksMu.Unlock()
+		Log.Info("deferred media retry pass still running, not starting another", "task_id", running.ID)
+		return running
+	}
+	taskID := generateID()
+	task := &Task{
+		ID:     taskID,
+		Status: TASK_STATUS_RUNNING,
+	}
+	tasks[taskID] = task
+	deferredRetryTaskId = taskID
+	tasksMu.Unlock()
+
+	go func(taskId string) {
+		result, err := s.retryDeferredVideos(taskId)
+		if err != nil {
+			Log.Error("deferred media retry pass failed", "error", err, "task_id", taskId)
+			tasksMu.Lock()
+			tasks[taskId] = &Task{
+				Status: TASK_STATUS_ERROR,
+				Result: err.Error(),
+				ID:     taskId,
+			}
+			tasksMu.Unlock()
+			return
+		}
+
+		tasksMu.Lock()
+		tasks[taskId] = &Task{
+			Status: TASK_STATUS_FINISHED,
+			Result: result,
+			ID:     taskId,
+		}
+		tasksMu.Unlock()
+	}(taskID)
+
+	return task
+}
+
+func (s *HTTPService) GetDeferredVideo(w http.ResponseWriter, r *http.Request) {
+	list, err := NewDBHelper(s.config.DBConf).GetAllDeferredMedia()
+	if err != nil {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      fmt.Sprintf("failed to list deferred media: %v", err),
+			HttpStatus: http.StatusInternalServerError,
+		}, w)
+		return
+	}
+
+	s.ResponseJSON(list, w)
+}
+
+func (s *HTTPService) RetryDeferredVideo(w http.ResponseWriter, r *http.Request) {
+	s.ResponseJSON(s.startDeferredRetryTask(false), w)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -131,11 +132,9 @@ func (s *HTTPService) GetIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *HTTPService) indexVideoToS3(hashId string, taskId string) error {
-	s3Conf := s.config.Storage.S3
-
-	storage, err := NewS3Storage(s3Conf)
+	storage, err := GetStorage(s.config.Storage)
 	if err != nil {
-		Log.Error("failed to create S3 storage", "error", err, "hash", hashId, "task", taskId)
+		Log.Error("failed to create storage", "error", err, "hash", hashId, "task", taskId)
 		if taskId != "" {
 			tasksMu.Lock()
 			tasks[taskId] = &Task{ID: taskId, Status: TASK_STATUS_ERROR, Result: err.Error()}
@@ -148,8 +147,7 @@ func (s *HTTPService) indexVideoToS3(hashId string, taskId string) error {
 	video, err := dbHelper.FindVideoInfo(hashId)
 	if err != nil {
 		Log.Info("video not in BoltDB, trying S3 index.json", "hash", hashId, "task", taskId)
-		s3IndexUrl := fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s/media/%s/index.json",
-			s3Conf.Region, s3Conf.Bucket, s3Conf.PrefixPath, hashId)
+		s3IndexUrl := s.storageFetchURL(filepath.ToSlash(filepath.Join(s.config.Storage.PrefixPath(), "media", hashId, "index.json")))
 		resp, httpErr := http.Get(s3IndexUrl)
 		if httpErr != nil || resp.StatusCode != http.StatusOK {
 			errMsg := fmt.Sprintf("video not found, run /move/%s first", hashId)
@@ -307,11 +305,14 @@ func (s *HTTPService) indexVideoToS3(hashId string, taskId string) error {
 
 	jsonBin, _ := json.Marshal(result)
 
-	_, s3JsonUrl, err := storage.PutContent(string(jsonBin),
-		fmt.Sprintf("media/%s/index-ai.json", hashId),
-		&UploadOptions{ContentType: "application/json", PublicRead: true})
-	if err != nil {
-		Log.Error("failed to upload index-ai.json to S3", "error", err, "hash", hashId, "task", taskId)
+	aiKey := fmt.Sprintf("media/%s/index-ai.json", hashId)
+	vttKey := fmt.Sprintf("media/%s/subtitles.vtt", hashId)
+	targets := publishContent(storage, s.config.Storage, aiKey, string(jsonBin),
+		&UploadOptions{ContentType: "application/json", PublicRead: true, Kind: UPLOAD_KIND_INDEX})
+	targets = append(targets, publishContent(storage, s.config.Storage, vttKey, vttContent,
+		&UploadOptions{ContentType: "text/vtt", PublicRead: true, Kind: UPLOAD_KIND_CAPTION})...)
+	if err := targetsError(targets); err != nil {
+		Log.Error("failed to publish index-ai.json and subtitles.vtt", "error", err, "hash", hashId, "task", taskId)
 		if taskId != "" {
 			tasksMu.Lock()
 			tasks[taskId] = &Task{ID: taskId, Status: TASK_STATUS_ERROR, Result: err.Error()}
@@ -319,45 +320,15 @@ func (s *HTTPService) indexVideoToS3(hashId string, taskId string) error {
 		}
 		return err
 	}
-	Log.Info("uploaded index-ai.json to S3", "hash", hashId, "url", s3JsonUrl, "task", taskId)
+	Log.Info("published index-ai.json and subtitles.vtt", "hash", hashId, "url", targetURL(targets, PUBLICATION_TARGET_S3), "task", taskId)
 
-	_, s3VttUrl, err := storage.PutContent(vttContent,
-		fmt.Sprintf("media/%s/subtitles.vtt", hashId),
-		&UploadOptions{ContentType: "text/vtt", PublicRead: true})
-	if err != nil {
-		Log.Error("failed to upload subtitles.vtt to S3", "error", err, "hash", hashId, "task", taskId)
-		if taskId != "" {
-			tasksMu.Lock()
-			tasks[taskId] = &Task{ID: taskId, Status: TASK_STATUS_ERROR, Result: err.Error()}
-			tasksMu.Unlock()
-		}
-		return err
-	}
-	Log.Info("uploaded subtitles.vtt to S3", "hash", hashId, "url", s3VttUrl, "task", taskId)
-
-	if s3Conf.UseCloudFront() {
-		storage.PutContent(string(jsonBin),
-			fmt.Sprintf("cloudfront/media/%s/index-ai.json", hashId),
-			&UploadOptions{ContentType: "application/json", PublicRead: true})
-		storage.PutContent(vttContent,
-			fmt.Sprintf("cloudfront/media/%s/subtitles.vtt", hashId),
-			&UploadOptions{ContentType: "text/vtt", PublicRead: true})
-
-		cfHelper := NewCloudFrontHelper(s3Conf)
-		if cfHelper != nil {
-			flushPaths := []string{
-				fmt.Sprintf("/%s/cloudfront/media/%s/index-ai.json", s3Conf.PrefixPath, hashId),
-				fmt.Sprintf("/%s/cloudfront/media/%s/subtitles.vtt", s3Conf.PrefixPath, hashId),
-			}
-			if err := cfHelper.InvalidatePaths(flushPaths); err != nil {
-				Log.Warn("CloudFront cache invalidation failed", "hash", hashId, "error", err, "paths", flushPaths, "task", taskId)
-			}
-		}
-	}
+	purgeTargets(s.config.Storage, taskId, aiKey, vttKey)
 
 	err = dbHelper.SaveVideoIndex(hashId, result)
 	if err != nil {
 		Log.Error("failed to save video index to BoltDB", "error", err, "hash", hashId, "task", taskId)
+	} else {
+		s.refreshPages(hashId, taskId)
 	}
 
 	if taskId != "" {
@@ -413,8 +384,7 @@ func (s *HTTPService) UpdateSubtitles(w http.ResponseWriter, r *http.Request) {
 
 	index.Subtitles = req.Subtitles
 
-	s3Conf := s.config.Storage.S3
-	storage, err := NewS3Storage(s3Conf)
+	storage, err := GetStorage(s.config.Storage)
 	if err != nil {
 		s.ResponseJSONError(&APIStandardError{
 			Status:     false,
@@ -427,53 +397,28 @@ func (s *HTTPService) UpdateSubtitles(w http.ResponseWriter, r *http.Request) {
 	vttContent := index.ToVTT()
 	jsonBin, _ := json.Marshal(index)
 
-	_, _, err = storage.PutContent(string(jsonBin),
-		fmt.Sprintf("media/%s/index-ai.json", hashId),
-		&UploadOptions{ContentType: "application/json", PublicRead: true})
-	if err != nil {
+	aiKey := fmt.Sprintf("media/%s/index-ai.json", hashId)
+	vttKey := fmt.Sprintf("media/%s/subtitles.vtt", hashId)
+	targets := publishContent(storage, s.config.Storage, aiKey, string(jsonBin),
+		&UploadOptions{ContentType: "application/json", PublicRead: true, Kind: UPLOAD_KIND_INDEX})
+	targets = append(targets, publishContent(storage, s.config.Storage, vttKey, vttContent,
+		&UploadOptions{ContentType: "text/vtt", PublicRead: true, Kind: UPLOAD_KIND_CAPTION})...)
+	if err := targetsError(targets); err != nil {
 		s.ResponseJSONError(&APIStandardError{
 			Status:     false,
-			Error:      fmt.Sprintf("failed to upload index-ai.json: %v", err),
+			Error:      fmt.Sprintf("failed to publish subtitles: %v", err),
 			HttpStatus: http.StatusInternalServerError,
 		}, w)
 		return
 	}
 
-	_, _, err = storage.PutContent(vttContent,
-		fmt.Sprintf("media/%s/subtitles.vtt", hashId),
-		&UploadOptions{ContentType: "text/vtt", PublicRead: true})
-	if err != nil {
-		s.ResponseJSONError(&APIStandardError{
-			Status:     false,
-			Error:      fmt.Sprintf("failed to upload subtitles.vtt: %v", err),
-			HttpStatus: http.StatusInternalServerError,
-		}, w)
-		return
-	}
-
-	if s3Conf.UseCloudFront() {
-		storage.PutContent(string(jsonBin),
-			fmt.Sprintf("cloudfront/media/%s/index-ai.json", hashId),
-			&UploadOptions{ContentType: "application/json", PublicRead: true})
-		storage.PutContent(vttContent,
-			fmt.Sprintf("cloudfront/media/%s/subtitles.vtt", hashId),
-			&UploadOptions{ContentType: "text/vtt", PublicRead: true})
-
-		cfHelper := NewCloudFrontHelper(s3Conf)
-		if cfHelper != nil {
-			flushPaths := []string{
-				fmt.Sprintf("/%s/cloudfront/media/%s/index-ai.json", s3Conf.PrefixPath, hashId),
-				fmt.Sprintf("/%s/cloudfront/media/%s/subtitles.vtt", s3Conf.PrefixPath, hashId),
-			}
-			if err := cfHelper.InvalidatePaths(flushPaths); err != nil {
-				Log.Warn("CloudFront cache invalidation failed", "hash", hashId, "error", err)
-			}
-		}
-	}
+	purgeTargets(s.config.Storage, "", aiKey, vttKey)
 
 	err = dbHelper.SaveVideoIndex(hashId, index)
 	if err != nil {
 		Log.Error("failed to save updated index to BoltDB", "error", err, "hash", hashId)
+	} else {
+		go s.refreshPages(hashId, "")
 	}
 
 	Log.Info("subtitles updated", "hash", hashId, "count", len(req.Subtitles))
@@ -482,5 +427,6 @@ func (s *HTTPService) UpdateSubtitles(w http.ResponseWriter, r *http.Request) {
 		"hashId":        hashId,
 		"updatedAt":     time.Now().UTC().Format(time.RFC3339),
 		"subtitleCount": len(req.Subtitles),
+		"targets":       targets,
 	}, w)
 }
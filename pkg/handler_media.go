@@ -1,11 +1,15 @@
 package pkg
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"path/filepath"
 	"strings"
+
+	"github.com/gorilla/mux"
 )
 
 func (s *HTTPService) videoWithIndex(v *WistiaRespVideo) map[string]interface{} {
@@ -70,9 +74,9 @@ func (s *HTTPService) RefreshVideoInfo(w http.ResponseWriter, r *http.Request) {
 
 	go func(taskId string) {
 
-		s3, err := NewS3Storage(s.config.Storage.S3)
+		s3, err := GetStorage(s.config.Storage)
 		if err != nil {
-			Log.Error("failed to create S3 storage client for media refresh", "error", err, "task_id", taskId)
+			Log.Error("failed to create storage client for media refresh", "error", err, "task_id", taskId)
 			tasksMu.Lock()
 			tasks[taskID] = &Task{
 				Status: TASK_STATUS_ERROR,
@@ -83,10 +87,35 @@ func (s *HTTPService) RefreshVideoInfo(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		Log.Debug("listing all video JSON files from S3", "task_id", taskId)
-		files, err := s3.ListFiles("media")
-		if err != nil {
-			Log.Error("failed to list media files from S3", "error", err, "task_id", taskId, "prefix", "media")
+		Log.Debug("listing all video folders from storage", "task_id", taskId)
+		dbHelper := NewDBHelper(s.config.DBConf)
+
+		// one entry per media/{hash}/ folder, paginated so buckets with more than 1000 keys are fully covered
+		saved := 0
+		indexed := 0
+		failed := 0
+		it := NewObjectIterator(s3, &ListOptions{Prefix: "media/", Delimiter: "/"})
+		for it.Next() {
+			folder := it.Object()
+			if !folder.IsPrefix {
+				continue
+			}
+			hashId := filepath.Base(strings.TrimSuffix(folder.Key, "/"))
+
+			url := s.storageFetchURL(folder.Key + "index.json")
+			if err := s.fetchVideoInfo(dbHelper, url, hashId); err != nil {
+				failed++
+				continue
+			}
+			saved++
+
+			url = s.storageFetchURL(folder.Key + "index-ai.json")
+			if s.fetchVideoIndex(dbHelper, url, hashId) == nil {
+				indexed++
+			}
+		}
+		if err := it.Err(); err != nil {
+			Log.Error("failed to list media folders from storage", "error", err, "task_id", taskId, "prefix", "media/")
 			tasksMu.Lock()
 			tasks[taskID] = &Task{
 				Status: TASK_STATUS_ERROR,
@@ -97,53 +126,11 @@ func (s *HTTPService) RefreshVideoInfo(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		Log.Debug("saving video info to database", "task_id", taskId, "file_count", len(files))
-		dbHelper := NewDBHelper(s.config.DBConf)
-
-		for _, row := range files {
-			if strings.HasSuffix(row, "index.json") {
-				url := fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s", s.config.Storage.S3.Region, s.config.Storage.S3.Bucket, row)
-				resp, err := http.Get(url)
-				if err != nil {
-					Log.Error("failed to fetch index.json from S3", "error", err, "url", url)
-					continue
-				}
-				defer resp.Body.Close()
-
-				hashId := filepath.Base(strings.Replace(row, "/index.json", "", 1))
-
-				err = dbHelper.SaveVideoInfo(hashId, resp.Body)
-				if err != nil {
-					Log.Error("failed to save video info to database", "error", err, "hash", hashId)
-					continue
-				}
-			} else if strings.HasSuffix(row, "index-ai.json") {
-				url := fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s", s.config.Storage.S3.Region, s.config.Storage.S3.Bucket, row)
-				resp, err := http.Get(url)
-				if err != nil {
-					Log.Error("failed to fetch index-ai.json from S3", "error", err, "url", url)
-					continue
-				}
-				defer resp.Body.Close()
-
-				var result DashScopeIndexResult
-				if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-					Log.Error("failed to decode index-ai.json", "error", err, "url", url)
-					continue
-				}
-
-				hashId := filepath.Base(strings.Replace(row, "/index-ai.json", "", 1))
-				if err := dbHelper.SaveVideoIndex(hashId, &result); err != nil {
-					Log.Error("failed to save AI video index to database", "error", err, "hash", hashId)
-					continue
-				}
-			}
-		}
-
+		Log.Info("media refresh completed", "saved", saved, "indexed", indexed, "failed", failed, "task_id", taskId)
 		tasksMu.Lock()
 		tasks[taskID] = &Task{
 			Status: TASK_STATUS_FINISHED,
-			Result: true,
+			Result: fmt.Sprintf("refreshed %d videos (%d with AI index, %d failed)", saved, indexed, failed),
 			ID:     taskID,
 		}
 		tasksMu.Unlock()
@@ -154,15 +141,90 @@ func (s *HTTPService) RefreshVideoInfo(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (s *HTTPService) SaveVideoInfo(s3Json string, hashId string) error {
+func (s *HTTPService) fetchVideoInfo(dbHelper *DBHelper, url string, hashId string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		Log.Error("failed to fetch index.json from storage", "error", err, "url", url)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		Log.Warn("index.json not available, skipping video", "status", resp.StatusCode, "url", url, "hash", hashId)
+		return fmt.Errorf("index.json returned status %d", resp.StatusCode)
+	}
+
+	// index.json never lists cold assets, keep the ones of the record being replaced
+	var cold []*ColdAsset
+	if stored, err := dbHelper.FindVideoInfo(hashId); err == nil {
+		cold = stored.ColdAssets
+	}
+	err = saveVideoRecord(dbHelper, hashId, resp.Body, cold)
+	if err != nil {
+		Log.Error("failed to save video info to database", "error", err, "hash", hashId)
+		return err
+	}
+	return nil
+}
+
+// saveVideoRecord stores the index.json read from r as the media record of hashId, along with
+// the cold assets index.json leaves out.
+func saveVideoRecord(dbHelper *DBHelper, hashId string, r io.Reader, cold []*ColdAsset) error {
+	if len(cold) <= 0 {
+		return dbHelper.SaveVideoInfo(hashId, r)
+	}
+	video := new(WistiaRespVideo)
+	if err := json.NewDecoder(r).Decode(video); err != nil {
+		return err
+	}
+	video.ColdAssets = cold
+	bin, err := json.Marshal(video)
+	if err != nil {
+		return err
+	}
+	return dbHelper.SaveVideoInfo(hashId, bytes.NewReader(bin))
+}
+
+func (s *HTTPService) fetchVideoIndex(dbHelper *DBHelper, url string, hashId string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		Log.Error("failed to fetch index-ai.json from storage", "error", err, "url", url)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		Log.Debug("index-ai.json not available", "status", resp.StatusCode, "url", url, "hash", hashId)
+		return fmt.Errorf("index-ai.json returned status %d", resp.StatusCode)
+	}
+
+	var result DashScopeIndexResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		Log.Error("failed to decode index-ai.json", "error", err, "url", url)
+		return err
+	}
+
+	if err := dbHelper.SaveVideoIndex(hashId, &result); err != nil {
+		Log.Error("failed to save AI video index to database", "error", err, "hash", hashId)
+		return err
+	}
+	return nil
+}
+
+// SaveVideoInfo stores the index.json published at s3Json, with the cold assets of the
+// migration, as the media record of hashId.
+func (s *HTTPService) SaveVideoInfo(s3Json string, hashId string, cold []*ColdAsset) error {
 	dbHelper := NewDBHelper(s.config.DBConf)
+	if s.config.Storage.Private() {
+		s3Json = s.storageFetchURL(filepath.ToSlash(filepath.Join(s.config.Storage.PrefixPath(), "media", hashId, "index.json")))
+	}
 	resp, err := http.Get(s3Json)
 	if err != nil {
 		Log.Error("failed to fetch video JSON from S3", "error", err, "url", s3Json, "hash", hashId)
 		return err
 	}
 	defer resp.Body.Close()
-	err = dbHelper.SaveVideoInfo(hashId, resp.Body)
+	err = saveVideoRecord(dbHelper, hashId, resp.Body, cold)
 	if err != nil {
 		Log.Error("failed to save video info to database", "error", err, "hash", hashId, "url", s3Json)
 		return err
@@ -171,7 +233,135 @@ func (s *HTTPService) SaveVideoInfo(s3Json string, hashId string) error {
 	return nil
 }
 
+// storageFetchURL returns a URL this service can GET the object at fullKey (prefix included)
+// from, presigned when the bucket is private.
+func (s *HTTPService) storageFetchURL(fullKey string) string {
+	url := s.config.Storage.ObjectURL(fullKey)
+	if !s.config.Storage.Private() {
+		return url
+	}
+	storage, err := GetStorage(s.config.Storage)
+	if err != nil {
+		return url
+	}
+	signed, err := storage.GetDownloadLink(fullKey)
+	if err != nil {
+		Log.Warn("failed to presign private object", "error", err, "key", fullKey)
+		return url
+	}
+	return signed
+}
+
 func (s *HTTPService) FindVideoInfo(hashId string) (*WistiaRespVideo, error) {
 	dbHelper := NewDBHelper(s.config.DBConf)
 	return dbHelper.FindVideoInfo(hashId)
 }
+
+type DeleteMediaResult struct {
+	HashId            string `json:"hash"`
+	Deleted           int    `json:"deleted"`
+	CloudFrontDeleted int    `json:"cloudfrontDeleted"`
+	// Targets is the number of objects deleted on each publication target.
+	Targets map[string]int `json:"targets"`
+	// ColdDeleted counts the cold assets deleted, which are outside every target.
+	ColdDeleted int `json:"coldDeleted"`
+}
+
+// DeleteVideo rolls back a migration: it removes the media/{hash}/ objects of every publication
+// target and the cold assets, drops the BoltDB media and index records and purges the targets' CDNs.
+func (s *HTTPService) DeleteVideo(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	hashId := params["hash"]
+
+	storage, err := GetStorage(s.config.Storage)
+	if err != nil {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      err.Error(),
+			HttpStatus: http.StatusInternalServerError,
+		}, w)
+		return
+	}
+
+	result := &DeleteMediaResult{HashId: hashId, Targets: make(map[string]int)}
+	dbHelper := NewDBHelper(s.config.DBConf)
+	var cold []*ColdAsset
+	if video, err := dbHelper.FindVideoInfo(hashId); err == nil {
+		cold = video.ColdAssets
+	}
+
+	for _, target := range s.config.Storage.PublicationTargets() {
+		deleted, err := storage.DeletePrefix(target.Key(fmt.Sprintf("media/%s", hashId)) + "/")
+		result.Targets[target.Name] = deleted
+		if err != nil {
+			Log.Error("failed to delete media objects", "error", err, "target", target.Name, "hash", hashId, "deleted", deleted)
+			s.ResponseJSONError(&APIStandardError{
+				Status:     false,
+				Error:      fmt.Sprintf("failed to delete %s media objects: %v", target.Name, err),
+				HttpStatus: http.StatusInternalServerError,
+			}, w)
+			return
+		}
+	}
+	result.Deleted = result.Targets[PUBLICATION_TARGET_S3]
+	result.CloudFrontDeleted = result.Targets[PUBLICATION_TARGET_CLOUDFRONT]
+
+	if err := s.deleteColdAssets(storage, hashId, cold, result); err != nil {
+		Log.Error("failed to delete cold assets", "error", err, "hash", hashId, "deleted", result.ColdDeleted)
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      fmt.Sprintf("failed to delete cold assets: %v", err),
+			HttpStatus: http.StatusInternalServerError,
+		}, w)
+		return
+	}
+
+	if err := dbHelper.DeleteVideoInfo(hashId); err != nil {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      err.Error(),
+			HttpStatus: http.StatusInternalServerError,
+		}, w)
+		return
+	}
+	if err := dbHelper.DeleteVideoIndex(hashId); err != nil {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      err.Error(),
+			HttpStatus: http.StatusInternalServerError,
+		}, w)
+		return
+	}
+
+	purgeTargets(s.config.Storage, "", fmt.Sprintf("media/%s/*", hashId))
+
+	Log.Info("video migration rolled back", "hash", hashId, "deleted", result.Deleted, "cloudfront_deleted", result.CloudFrontDeleted, "cold_deleted", result.ColdDeleted)
+
+	s.ResponseJSON(result, w)
+}
+
+// deleteColdAssets removes media/{hash}/ under the configured cold prefix, then the cold assets
+// the media record lists elsewhere, e.g. under a cold prefix given to /move.
+func (s *HTTPService) deleteColdAssets(storage IStorage, hashId string, cold []*ColdAsset, result *DeleteMediaResult) error {
+	if policy := s.config.WistiaConf.AssetPolicy; policy != nil && len(strings.Trim(policy.ColdPrefix, "/")) > 0 {
+		deleted, err := storage.DeletePrefix(fmt.Sprintf("%s/media/%s/", strings.Trim(policy.ColdPrefix, "/"), hashId))
+		result.ColdDeleted += deleted
+		if err != nil {
+			return err
+		}
+	}
+	for _, asset := range cold {
+		exists, err := storage.Exists(asset.Key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if err := storage.Delete(asset.Key); err != nil {
+			return err
+		}
+		result.ColdDeleted++
+	}
+	return nil
+}
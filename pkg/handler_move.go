@@ -2,7 +2,12 @@ package pkg
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"net/http"
+	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/gorilla/mux"
@@ -23,7 +28,16 @@ func (s *HTTPService) VideoToS3(w http.ResponseWriter, r *http.Request) {
 	if refresh == "true" {
 		opt.OverRider = true
 	}
-
+	policy, err := s.config.WistiaConf.AssetPolicy.Override(queryParams)
+	if err != nil {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      err.Error(),
+			HttpStatus: http.StatusBadRequest,
+		}, w)
+		return
+	}
+	opt.AssetPolicy = policy
 
 	if len(videoHash) > 0 {
 		list.HashList = append(list.HashList, videoHash)
@@ -54,73 +68,187 @@ func (s *HTTPService) VideoToS3(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *HTTPService) MoveVideoToS3(source *MultipleMediaBody, TaskId string, options *MoveToS3Options) {
+	resultList := s.moveVideos(source.HashList, TaskId, options)
+
+	tasksMu.Lock()
+	tasks[TaskId] = &Task{
+		Status: TASK_STATUS_FINISHED,
+		Result: resultList,
+		ID:     TaskId,
+	}
+	tasksMu.Unlock()
+}
+
+// eachMedia calls fn for every hash in hashList from WISTIA_WORKER_LIMIT workers, so a large
+// batch does not start all its API calls, DB writes and page publishes at once.
+func (s *HTTPService) eachMedia(hashList []string, fn func(hashId string, index int)) {
+	workers := s.config.WistiaConf.WorkerLimit
+	if workers <= 0 || workers > len(hashList) {
+		workers = len(hashList)
+	}
+	indexes := make(chan int)
 	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				fn(hashList[index], index)
+			}
+		}()
+	}
+	for index := range hashList {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// moveVideos migrates the hashes in hashList through eachMedia and returns the results in the
+// same order. Asset bodies are further bounded by the transfer scheduler's in-flight bytes.
+func (s *HTTPService) moveVideos(hashList []string, TaskId string, options *MoveToS3Options) []*MoveToS3Result {
 	overRider := false
 	if options != nil && options.OverRider {
 		overRider = true
 	}
+	var policy *AssetPolicy
+	if options != nil {
+		policy = options.AssetPolicy
+	}
 
-	resultList := make([]*MoveToS3Result, len(source.HashList))
-
-	for i, hashId := range source.HashList {
-		wg.Add(1)
-		go func(hashId string, taskId string, index int, wg *sync.WaitGroup) {
-			defer wg.Done()
-			defer func() {
-				<- s.uploadQueue
-			}()
-			s.uploadQueue <- true
-
-
-			helper := NewWistiaHelper(s.config.WistiaConf)
-			if !overRider {
-				dbHelper := NewDBHelper(s.config.DBConf)
-				_, err := dbHelper.FindVideoInfo(hashId)
-				if err == nil {
-					cloudfrontJson, s3Json := helper.GenerateVideoInfoURL(hashId, s.config.Storage.S3)
-
-					resultList[index] = &MoveToS3Result{
-						HashId:     hashId,
-						Status:     true,
-						S3:         s3Json,
-						CloudFront: cloudfrontJson,
-					}
-					return
-				}
-			}
+	resultList := make([]*MoveToS3Result, len(hashList))
 
-			cloudFrontJson, s3Json, err := helper.MoveToS3(hashId, s.config.Storage.S3)
-			if err != nil {
-				Log.Error("failed to migrate video to S3", "hash", hashId, "task_id", taskId, "error", err)
-				resultList[index] = &MoveToS3Result{
-					HashId: hashId,
-					Status: false,
-					Error:  err.Error(),
-				}
-				return
-			}
+	s.eachMedia(hashList, func(hashId string, index int) {
+		helper := NewWistiaHelper(s.config.WistiaConf).TrackTransfers(transferStats(TaskId)).ForTask(TaskId)
+		dbHelper := NewDBHelper(s.config.DBConf)
+		helper.WithIndexes(dbHelper)
+		if s.config.WistiaConf.SpoolTransfers {
+			helper.SpoolTo(s.config.TempDir, dbHelper)
+		}
+		// the stored record also lets a forced refresh skip assets that did not change
+		previous, err := dbHelper.FindVideoInfo(hashId)
+		if !overRider && err == nil {
+			cloudfrontJson, s3Json := helper.GenerateVideoInfoURL(hashId, s.config.Storage)
 
 			resultList[index] = &MoveToS3Result{
 				HashId:     hashId,
 				Status:     true,
 				S3:         s3Json,
-				CloudFront: cloudFrontJson,
+				CloudFront: cloudfrontJson,
+			}
+			return
+		}
+
+		report, err := helper.MoveToS3(hashId, s.config.Storage, policy, previous)
+		if errors.Is(err, ErrMediaNotReady) {
+			resultList[index] = &MoveToS3Result{
+				HashId:   hashId,
+				Status:   false,
+				Deferred: true,
+				Error:    err.Error(),
 			}
+			s.deferVideo(hashId, err)
+			return
+		}
+		if errors.Is(err, ErrMediaFailed) {
+			// retrying would never succeed, so stop the deferred retries as well
+			s.clearDeferredVideo(hashId)
+		}
+		if err != nil {
+			Log.Error("failed to migrate video to S3", "hash", hashId, "task_id", TaskId, "error", err)
+			resultList[index] = &MoveToS3Result{
+				HashId: hashId,
+				Status: false,
+				Error:  err.Error(),
+			}
+			if report != nil {
+				resultList[index].Published = report.Published
+				resultList[index].Assets = report.Assets
+				resultList[index].Captions = report.Captions
+				resultList[index].Targets = report.Targets
+				resultList[index].Pages = report.Pages
+			}
+			return
+		}
 
-			defer func() {
-				go s.SaveVideoInfo(s3Json, hashId)
-			}()
+		s3Json := report.S3
+		resultList[index] = &MoveToS3Result{
+			HashId:     hashId,
+			Status:     true,
+			S3:         s3Json,
+			CloudFront: report.CloudFront,
+			Published:  report.Published,
+			Assets:     report.Assets,
+			Captions:   report.Captions,
+			Targets:    report.Targets,
+			Pages:      report.Pages,
+		}
 
-		}(hashId, TaskId, i, &wg)
+		if failed := report.FailedAssets(); failed > 0 {
+			// keep the DB record absent so a plain /move retries this video
+			Log.Error("video migrated with failed assets", "hash", hashId, "task_id", TaskId, "failed", failed, "published", report.Published)
+			resultList[index].Status = false
+			resultList[index].Error = fmt.Sprintf("%d of %d asset(s) failed to transfer or verify", failed, len(report.Assets))
+			return
+		}
+
+		defer func() {
+			go s.SaveVideoInfo(s3Json, hashId, report.ColdAssets)
+		}()
+		s.clearDeferredVideo(hashId)
+	})
+
+	return resultList
+}
+
+// interruptedTransfers lists the media with a spool file or a multipart upload left behind by
+// a previous run. Both are keyed like storage, so the hash is the parent directory name.
+func (s *HTTPService) interruptedTransfers() []string {
+	seen := make(map[string]bool)
+	hashList := make([]string, 0)
+	add := func(key string) {
+		hashId := filepath.Base(filepath.Dir(filepath.FromSlash(key)))
+		if len(hashId) > 0 && hashId != "." && !seen[hashId] {
+			seen[hashId] = true
+			hashList = append(hashList, hashId)
+		}
 	}
 
-	wg.Wait()
+	uploads, err := NewDBHelper(s.config.DBConf).GetAllMultipartUploads()
+	if err != nil {
+		Log.Error("failed to list interrupted multipart uploads", "error", err)
+	}
+	for _, upload := range uploads {
+		add(upload.Key)
+	}
+
+	root := filepath.Join(s.config.TempDir, spoolDirName)
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && strings.HasSuffix(path, ".part") {
+			add(path)
+		}
+		return nil
+	})
+
+	return hashList
+}
+
+// resumeInterruptedTransfers queues a forced migration of every media whose transfer was cut
+// off by a restart; unchanged assets are skipped, so only the interrupted ones continue.
+func (s *HTTPService) resumeInterruptedTransfers() {
+	hashList := s.interruptedTransfers()
+	if len(hashList) <= 0 {
+		return
+	}
 
+	taskID := generateID()
 	tasksMu.Lock()
-	tasks[TaskId] = &Task{
-		Status: TASK_STATUS_FINISHED,
-		Result: resultList,
-		ID:     TaskId,
+	tasks[taskID] = &Task{
+		ID:     taskID,
+		Status: TASK_STATUS_RUNNING,
 	}
 	tasksMu.Unlock()
+
+	Log.Info("resuming interrupted transfers", "media", hashList, "task_id", taskID)
+	s.MoveVideoToS3(&MultipleMediaBody{HashList: hashList}, taskID, &MoveToS3Options{OverRider: true})
 }
@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PlaybackManifest is index.json with freshly signed CloudFront URLs, as served by /playback/{hash}.
+type PlaybackManifest struct {
+	HashId    string           `json:"hash"`
+	Mode      string           `json:"mode"`
+	ExpiresAt string           `json:"expiresAt"`
+	Media     *WistiaRespVideo `json:"media"`
+}
+
+// 签发带有效期的播放清单（signed URL 或 signed cookie）
+func (s *HTTPService) GetPlayback(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	hashId := params["hash"]
+
+	if !s.config.Storage.UseCloudFront() {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      "signed playback needs S3 with CloudFront",
+			HttpStatus: http.StatusNotImplemented,
+		}, w)
+		return
+	}
+	signer, err := NewCloudFrontSigner(s.config.Storage.S3)
+	if err != nil {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      err.Error(),
+			HttpStatus: http.StatusNotImplemented,
+		}, w)
+		return
+	}
+
+	expiry := s.config.Storage.S3.SignedURLExpiry()
+	if value := r.URL.Query().Get("expires"); len(value) > 0 {
+		minutes, err := strconv.Atoi(value)
+		if err != nil || minutes <= 0 || time.Duration(minutes)*time.Minute > maxSignedURLExpiry {
+			s.ResponseJSONError(&APIStandardError{
+				Status:     false,
+				Error:      fmt.Sprintf("expires must be between 1 and %d minutes", int(maxSignedURLExpiry.Minutes())),
+				HttpStatus: http.StatusBadRequest,
+			}, w)
+			return
+		}
+		expiry = time.Duration(minutes) * time.Minute
+	}
+
+	video, err := s.FindVideoInfo(hashId)
+	if err != nil {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      fmt.Sprintf("video not found, run /move/%s first", hashId),
+			HttpStatus: http.StatusNotFound,
+		}, w)
+		return
+	}
+
+	expires := time.Now().Add(expiry)
+	if err := signer.SignVideo(video, s.config.Storage, expires); err != nil {
+		Log.Error("failed to sign playback manifest", "error", err, "hash", hashId)
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      err.Error(),
+			HttpStatus: http.StatusInternalServerError,
+		}, w)
+		return
+	}
+
+	if signer.Mode() == SIGN_MODE_COOKIE {
+		cookies, err := signer.SignCookies(s.config.Storage.CloudFrontURL(fmt.Sprintf("media/%s/*", hashId)), expires)
+		if err != nil {
+			Log.Error("failed to sign playback cookies", "error", err, "hash", hashId)
+			s.ResponseJSONError(&APIStandardError{
+				Status:     false,
+				Error:      err.Error(),
+				HttpStatus: http.StatusInternalServerError,
+			}, w)
+			return
+		}
+		for _, cookie := range cookies {
+			http.SetCookie(w, cookie)
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	s.ResponseJSON(&PlaybackManifest{
+		HashId:    hashId,
+		Mode:      signer.Mode(),
+		ExpiresAt: expires.UTC().Format(time.RFC3339),
+		Media:     video,
+	}, w)
+}
@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type MoveProjectResult struct {
+	HashId     string            `json:"hash"`
+	Name       string            `json:"name"`
+	CloudFront string            `json:"cloudfront"`
+	S3         string            `json:"s3"`
+	Status     bool              `json:"status"`
+	Error      string            `json:"error"`
+	Medias     []*MoveToS3Result `json:"medias"`
+	// Targets reports the project manifest on each publication target.
+	Targets []*TargetReport `json:"targets,omitempty"`
+}
+
+func (s *HTTPService) ProjectToS3(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	projectHash := params["projectHash"]
+
+	opt := &MoveToS3Options{
+		OverRider: r.URL.Query().Get("forceRefresh") == "true",
+	}
+	policy, err := s.config.WistiaConf.AssetPolicy.Override(r.URL.Query())
+	if err != nil {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      err.Error(),
+			HttpStatus: http.StatusBadRequest,
+		}, w)
+		return
+	}
+	opt.AssetPolicy = policy
+
+	taskID := generateID()
+	task := &Task{
+		ID:     taskID,
+		Status: TASK_STATUS_RUNNING,
+	}
+
+	tasksMu.Lock()
+	tasks[taskID] = task
+	tasksMu.Unlock()
+
+	go s.MoveProjectToS3(projectHash, taskID, opt)
+
+	s.ResponseJSON(task, w)
+}
+
+// MoveProjectToS3 migrates every media of a Wistia project, then publishes the project manifest
+// listing the medias whose index.json made it to storage.
+func (s *HTTPService) MoveProjectToS3(projectHash string, TaskId string, options *MoveToS3Options) {
+	helper := NewWistiaHelper(s.config.WistiaConf).ForTask(TaskId)
+
+	project, err := helper.GetProject(projectHash)
+	if err != nil {
+		Log.Error("failed to get Wistia project", "project", projectHash, "task_id", TaskId, "error", err)
+		tasksMu.Lock()
+		tasks[TaskId] = &Task{
+			ID:     TaskId,
+			Status: TASK_STATUS_ERROR,
+			Result: err.Error(),
+		}
+		tasksMu.Unlock()
+		return
+	}
+
+	hashList := make([]string, 0, len(project.Medias))
+	for _, media := range project.Medias {
+		hashList = append(hashList, media.HashId)
+	}
+	Log.Info("migrating Wistia project", "project", projectHash, "name", project.Name, "medias", len(hashList), "task_id", TaskId)
+
+	result := &MoveProjectResult{
+		HashId: project.HashId,
+		Name:   project.Name,
+		Medias: s.moveVideos(hashList, TaskId, options),
+	}
+
+	published := make(map[string]bool)
+	for _, row := range result.Medias {
+		if row.Status || row.Published {
+			published[row.HashId] = true
+		}
+	}
+
+	result.Targets, err = helper.PublishProjectManifestTargets(project, published, s.config.Storage)
+	result.CloudFront = targetURL(result.Targets, PUBLICATION_TARGET_CLOUDFRONT)
+	result.S3 = targetURL(result.Targets, PUBLICATION_TARGET_S3)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Status = true
+	}
+
+	tasksMu.Lock()
+	tasks[TaskId] = &Task{
+		Status: TASK_STATUS_FINISHED,
+		Result: result,
+		ID:     TaskId,
+	}
+	tasksMu.Unlock()
+}
@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type RenderMediaResult struct {
+	HashId string          `json:"hash"`
+	Status bool            `json:"status"`
+	Error  string          `json:"error,omitempty"`
+	Pages  []*TargetReport `json:"pages,omitempty"`
+}
+
+type RenderResult struct {
+	// Script reports wistia-s3.min.js on each publication target.
+	Script []*TargetReport      `json:"script"`
+	Error  string               `json:"error,omitempty"`
+	Media  []*RenderMediaResult `json:"media"`
+}
+
+// RenderPages re-renders the page templates of migrated media from their BoltDB records, and
+// wistia-s3.min.js, without touching assets. /render/{hash} renders one media, /render the media
+// listed in the body or, without a body, every migrated media.
+func (s *HTTPService) RenderPages(w http.ResponseWriter, r *http.Request) {
+	list := &MultipleMediaBody{
+		HashList: []string{},
+	}
+	params := mux.Vars(r)
+	videoHash := params["hash"]
+
+	if len(videoHash) > 0 {
+		if _, err := NewDBHelper(s.config.DBConf).FindVideoInfo(videoHash); err != nil {
+			s.ResponseJSONError(&APIStandardError{
+				Status:     false,
+				Error:      fmt.Sprintf("media %s is not migrated", videoHash),
+				HttpStatus: http.StatusNotFound,
+			}, w)
+			return
+		}
+		list.HashList = append(list.HashList, videoHash)
+	} else if err := json.NewDecoder(r.Body).Decode(&list); err != nil && !errors.Is(err, io.EOF) {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      err.Error(),
+			HttpStatus: http.StatusBadRequest,
+		}, w)
+		return
+	}
+
+	taskID := generateID()
+	task := &Task{
+		ID:     taskID,
+		Status: TASK_STATUS_RUNNING,
+	}
+
+	tasksMu.Lock()
+	tasks[taskID] = task
+	tasksMu.Unlock()
+
+	go func(taskId string) {
+		result, err := s.renderVideos(list.HashList, taskId)
+		if err != nil {
+			Log.Error("page render failed", "error", err, "task_id", taskId)
+			tasksMu.Lock()
+			tasks[taskId] = &Task{
+				Status: TASK_STATUS_ERROR,
+				Result: err.Error(),
+				ID:     taskId,
+			}
+			tasksMu.Unlock()
+			return
+		}
+
+		tasksMu.Lock()
+		tasks[taskId] = &Task{
+			Status: TASK_STATUS_FINISHED,
+			Result: result,
+			ID:     taskId,
+		}
+		tasksMu.Unlock()
+	}(taskID)
+
+	s.ResponseJSON(task, w)
+}
+
+// renderVideos publishes wistia-s3.min.js then the pages of every media in hashList, or of every
+// migrated media when hashList is empty.
+func (s *HTTPService) renderVideos(hashList []string, taskId string) (*RenderResult, error) {
+	dbHelper := NewDBHelper(s.config.DBConf)
+	if len(hashList) <= 0 {
+		videos, err := dbHelper.GetAllVideoInfo()
+		if err != nil {
+			return nil, err
+		}
+		for _, video := range videos {
+			hashList = append(hashList, video.HashId)
+		}
+	}
+
+	helper := NewWistiaHelper(s.config.WistiaConf).ForTask(taskId).WithIndexes(dbHelper)
+	result := &RenderResult{
+		Media: make([]*RenderMediaResult, 0, len(hashList)),
+	}
+
+	script, err := helper.PublishWistiaS3JS(s.config.Storage)
+	result.Script = script
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	for _, hashId := range hashList {
+		row := &RenderMediaResult{HashId: hashId}
+		result.Media = append(result.Media, row)
+
+		video, err := dbHelper.FindVideoInfo(hashId)
+		if err != nil {
+			Log.Error("media record not found for render", "error", err, "hash", hashId, "task_id", taskId)
+			row.Error = fmt.Sprintf("media %s is not migrated", hashId)
+			continue
+		}
+		row.Pages, err = helper.PublishPages(video, s.config.Storage)
+		if err != nil {
+			row.Error = err.Error()
+			continue
+		}
+		row.Status = true
+	}
+
+	Log.Info("page render finished", "media", len(result.Media), "task_id", taskId)
+	return result, nil
+}
+
+// refreshPages re-renders the pages of a migrated media after its AI index changed, so they
+// show the new summary, chapters and subtitles.
+func (s *HTTPService) refreshPages(hashId string, taskId string) {
+	dbHelper := NewDBHelper(s.config.DBConf)
+	video, err := dbHelper.FindVideoInfo(hashId)
+	if err != nil {
+		Log.Debug("media not migrated, pages not refreshed", "hash", hashId, "task_id", taskId)
+		return
+	}
+	helper := NewWistiaHelper(s.config.WistiaConf).ForTask(taskId).WithIndexes(dbHelper)
+	if _, err := helper.PublishPages(video, s.config.Storage); err != nil {
+		Log.Warn("failed to refresh pages after index update", "error", err, "hash", hashId, "task_id", taskId)
+	}
+}
@@ -5,11 +5,39 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 )
 
+const WISTIA_SYNC_MODE_FULL = "full"
+
+const WISTIA_SYNC_MODE_INCREMENTAL = "incremental"
+
+// wistiaSyncOverlap widens the incremental window to absorb clock skew with Wistia,
+// media seen twice are reported as unchanged.
+const wistiaSyncOverlap = 5 * time.Minute
+
+// wistiaFullSyncInterval is how often an incremental sync turns into a full one, which also
+// catches changes the updated-since listing missed.
+const wistiaFullSyncInterval = 24 * time.Hour
+
+type WistiaSyncResult struct {
+	Mode      string `json:"mode"`
+	Since     string `json:"since,omitempty"`
+	Fetched   int    `json:"fetched"`
+	Added     int    `json:"added"`
+	Updated   int    `json:"updated"`
+	Removed   int    `json:"removed"`
+	Unchanged int    `json:"unchanged"`
+	Failed    int    `json:"failed"`
+	Total     int    `json:"total"`
+	Error     string `json:"error,omitempty"`
+}
+
 func (s *HTTPService) SyncWistiaVideos(w http.ResponseWriter, r *http.Request) {
+	incremental := r.URL.Query().Get("incremental") == "true"
+
 	taskID := generateID()
 	task := &Task{
 		ID:     taskID,
@@ -21,43 +49,8 @@ func (s *HTTPService) SyncWistiaVideos(w http.ResponseWriter, r *http.Request) {
 	tasksMu.Unlock()
 
 	go func(taskId string) {
-		helper := NewWistiaHelper(s.config.WistiaConf)
-		dbHelper := NewDBHelper(s.config.DBConf)
-
-		videos, err := helper.ListAllVideos()
+		result, err := s.syncWistiaCatalog(incremental, taskId)
 		if err != nil {
-			Log.Error("sync: failed to list Wistia videos", "error", err, "task_id", taskId)
-			if len(videos) == 0 {
-				tasksMu.Lock()
-				tasks[taskId] = &Task{
-					Status: TASK_STATUS_ERROR,
-					Result: err.Error(),
-					ID:     taskId,
-				}
-				tasksMu.Unlock()
-				return
-			}
-			Log.Warn("sync: partial results from ListAllVideos, saving what we got", "count", len(videos), "task_id", taskId)
-		}
-
-		saved := 0
-		failed := 0
-		for _, video := range videos {
-			if err := dbHelper.SaveWistiaCatalogVideo(video.HashId, video); err != nil {
-				Log.Error("sync: failed to save catalog video", "error", err, "hash", video.HashId, "task_id", taskId)
-				failed++
-				continue
-			}
-			saved++
-		}
-
-		meta := &WistiaSyncMeta{
-			LastSyncAt: time.Now().Format(time.RFC3339),
-			TotalCount: len(videos),
-			PageCount:  (len(videos) + 49) / 50,
-		}
-		if err := dbHelper.SaveWistiaSyncMeta(meta); err != nil {
-			Log.Error("sync: failed to save sync meta", "error", err, "task_id", taskId)
 			tasksMu.Lock()
 			tasks[taskId] = &Task{
 				Status: TASK_STATUS_ERROR,
@@ -68,15 +61,10 @@ func (s *HTTPService) SyncWistiaVideos(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		resultMsg := fmt.Sprintf("synced %d videos (%d failed) out of %d total", saved, failed, len(videos))
-		if err != nil {
-			resultMsg = fmt.Sprintf("partial sync: %d videos saved (%d failed), error: %v", saved, failed, err)
-		}
-		Log.Info("sync: completed", "saved", saved, "failed", failed, "total", len(videos), "task_id", taskId)
 		tasksMu.Lock()
 		tasks[taskId] = &Task{
 			Status: TASK_STATUS_FINISHED,
-			Result: resultMsg,
+			Result: result,
 			ID:     taskId,
 		}
 		tasksMu.Unlock()
@@ -85,6 +73,150 @@ func (s *HTTPService) SyncWistiaVideos(w http.ResponseWriter, r *http.Request) {
 	s.ResponseJSON(task, w)
 }
 
+// syncWistiaCatalog refreshes the wistia_catalog bucket and removes entries gone from Wistia. A full
+// sync lists every media; an incremental one only lists media updated since the last sync and looks
+// the other catalog entries up by hash, falling back to a full sync once the last one is older than
+// wistiaFullSyncInterval.
+func (s *HTTPService) syncWistiaCatalog(incremental bool, taskId string) (*WistiaSyncResult, error) {
+	startedAt := time.Now()
+	helper := NewWistiaHelper(s.config.WistiaConf)
+	dbHelper := NewDBHelper(s.config.DBConf)
+
+	catalogList, err := dbHelper.GetAllWistiaCatalogVideos()
+	if err != nil {
+		Log.Error("sync: failed to load catalog", "error", err, "task_id", taskId)
+		return nil, err
+	}
+	catalog := make(map[string]*WistiaRespVideo, len(catalogList))
+	for _, video := range catalogList {
+		catalog[video.HashId] = video
+	}
+
+	result := &WistiaSyncResult{
+		Mode: WISTIA_SYNC_MODE_FULL,
+	}
+
+	var videos []*WistiaRespVideo
+	var listErr error
+	lastFullSyncAt := ""
+	meta, metaErr := dbHelper.GetWistiaSyncMeta()
+	if metaErr == nil {
+		lastFullSyncAt = meta.LastFullSyncAt
+	}
+	if incremental {
+		var since time.Time
+		err := metaErr
+		if err == nil {
+			since, err = time.Parse(time.RFC3339, meta.LastSyncAt)
+		}
+		if err != nil {
+			Log.Warn("sync: no usable last sync time, falling back to a full sync", "error", err, "task_id", taskId)
+			incremental = false
+		} else if fullAt, err := time.Parse(time.RFC3339, meta.LastFullSyncAt); err != nil || startedAt.Sub(fullAt) >= wistiaFullSyncInterval {
+			Log.Info("sync: last full sync too old, reconciling with a full sync", "last_full_sync", meta.LastFullSyncAt, "task_id", taskId)
+			incremental = false
+		} else {
+			result.Mode = WISTIA_SYNC_MODE_INCREMENTAL
+			result.Since = meta.LastSyncAt
+			videos, listErr = helper.ListVideosUpdatedSince(since.Add(-wistiaSyncOverlap))
+		}
+	}
+	if !incremental {
+		videos, listErr = helper.ListAllVideos()
+	}
+
+	if listErr != nil {
+		Log.Error("sync: failed to list Wistia videos", "error", listErr, "mode", result.Mode, "task_id", taskId)
+		if len(videos) == 0 {
+			return nil, listErr
+		}
+		Log.Warn("sync: partial results from Wistia, saving what we got", "count", len(videos), "task_id", taskId)
+		result.Error = fmt.Sprintf("partial sync: %v", listErr)
+	}
+	result.Fetched = len(videos)
+
+	fetched := make(map[string]bool, len(videos))
+	for _, video := range videos {
+		fetched[video.HashId] = true
+
+		existing, ok := catalog[video.HashId]
+		if ok && len(video.Updated) > 0 && existing.Updated == video.Updated {
+			result.Unchanged++
+			continue
+		}
+
+		if err := dbHelper.SaveWistiaCatalogVideo(video.HashId, video); err != nil {
+			Log.Error("sync: failed to save catalog video", "error", err, "hash", video.HashId, "task_id", taskId)
+			result.Failed++
+			continue
+		}
+		if ok {
+			result.Updated++
+		} else {
+			result.Added++
+		}
+	}
+
+	gone := make([]string, 0)
+	for hashId := range catalog {
+		if !fetched[hashId] {
+			gone = append(gone, hashId)
+		}
+	}
+	sort.Strings(gone)
+	if listErr == nil && incremental && len(gone) > 0 {
+		// media not updated since the last sync are not listed, check they still exist
+		existing, err := helper.ExistingVideos(gone)
+		if err != nil {
+			Log.Error("sync: failed to look up unlisted videos", "error", err, "count", len(gone), "task_id", taskId)
+			result.Error = fmt.Sprintf("deletion check failed: %v", err)
+			gone = gone[:0]
+		}
+		deleted := gone[:0]
+		for _, hashId := range gone {
+			if !existing[hashId] {
+				deleted = append(deleted, hashId)
+			}
+		}
+		gone = deleted
+	}
+
+	// only a complete listing tells deleted media from ones not listed
+	if listErr == nil {
+		for _, hashId := range gone {
+			if err := dbHelper.DeleteWistiaCatalogVideo(hashId); err != nil {
+				Log.Error("sync: failed to remove deleted video from catalog", "error", err, "hash", hashId, "task_id", taskId)
+				result.Failed++
+				continue
+			}
+			Log.Info("sync: removed video deleted on Wistia", "hash", hashId, "task_id", taskId)
+			result.Removed++
+		}
+	}
+
+	result.Total = len(catalog) + result.Added - result.Removed
+
+	if listErr == nil {
+		if !incremental {
+			lastFullSyncAt = startedAt.Format(time.RFC3339)
+		}
+		meta := &WistiaSyncMeta{
+			LastSyncAt:     startedAt.Format(time.RFC3339),
+			LastFullSyncAt: lastFullSyncAt,
+			TotalCount:     result.Total,
+			PageCount:      (result.Total + 49) / 50,
+		}
+		if err := dbHelper.SaveWistiaSyncMeta(meta); err != nil {
+			Log.Error("sync: failed to save sync meta", "error", err, "task_id", taskId)
+			return nil, err
+		}
+	}
+
+	Log.Info("sync: completed", "mode", result.Mode, "fetched", result.Fetched, "added", result.Added, "updated", result.Updated,
+		"removed", result.Removed, "unchanged", result.Unchanged, "failed", result.Failed, "total", result.Total, "task_id", taskId)
+	return result, nil
+}
+
 type wistiaMediaListResponse struct {
 	Status     bool              `json:"status"`
 	Data       []*WistiaRespVideo `json:"data"`
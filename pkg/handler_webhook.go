@@ -0,0 +1,279 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const WISTIA_EVENT_MEDIA_CREATED = "media.created"
+
+const WISTIA_EVENT_MEDIA_UPDATED = "media.updated"
+
+const WISTIA_EVENT_MEDIA_DELETED = "media.deleted"
+
+// webhookEventTTL is how long accepted event uuids are remembered to drop redeliveries.
+const webhookEventTTL = 24 * time.Hour
+
+var (
+	// webhookEvents maps the uuid of each event accepted within webhookEventTTL to when it was.
+	webhookEvents   = make(map[string]time.Time)
+	webhookEventsMu sync.Mutex
+)
+
+// WistiaWebhookMedia is the media of a webhook event; unlike the Data API, its id is the hashed id.
+type WistiaWebhookMedia struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type WistiaWebhookEvent struct {
+	Uuid        string `json:"uuid"`
+	Type        string `json:"type"`
+	GeneratedAt string `json:"generated_at"`
+	Payload     struct {
+		Media *WistiaWebhookMedia `json:"media"`
+	} `json:"payload"`
+}
+
+type WistiaWebhookBody struct {
+	Events []*WistiaWebhookEvent `json:"events"`
+}
+
+type WebhookEventResult struct {
+	Uuid        string `json:"uuid"`
+	Type        string `json:"type"`
+	HashId      string `json:"hash"`
+	MoveTaskId  string `json:"moveTaskId,omitempty"`
+	IndexTaskId string `json:"indexTaskId,omitempty"`
+	// Duplicate marks a redelivered event, ignored since it was already handled.
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// firstDelivery remembers the event uuid and reports whether it was not seen before. Events
+// without uuid are always handled.
+func firstDelivery(uuid string, now time.Time) bool {
+	if len(uuid) <= 0 {
+		return true
+	}
+	webhookEventsMu.Lock()
+	defer webhookEventsMu.Unlock()
+
+	for id, at := range webhookEvents {
+		if now.Sub(at) >= webhookEventTTL {
+			delete(webhookEvents, id)
+		}
+	}
+	if _, seen := webhookEvents[uuid]; seen {
+		return false
+	}
+	webhookEvents[uuid] = now
+	return true
+}
+
+// verifyWistiaSignature checks X-Wistia-Signature, the hex HMAC-SHA256 of the raw body keyed
+// with the webhook secret.
+func verifyWistiaSignature(secret string, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(strings.TrimSpace(signature))
+	if err != nil || len(expected) <= 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// WistiaWebhook receives Wistia media events: created/updated media are refreshed in the
+// wistia_catalog bucket, deleted ones removed from it, and new media queued for migration
+// (plus AI indexing when WebhookAutoIndex is set). Events are acknowledged once the signature
+// is verified and handled in a task, so slow Wistia API calls never make Wistia redeliver;
+// events redelivered anyway are recognised by uuid and skipped.
+func (s *HTTPService) WistiaWebhook(w http.ResponseWriter, r *http.Request) {
+	secret := s.config.WistiaConf.WebhookSecret
+	if len(secret) <= 0 {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      "webhook secret not configured",
+			HttpStatus: http.StatusForbidden,
+		}, w)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      err.Error(),
+			HttpStatus: http.StatusBadRequest,
+		}, w)
+		return
+	}
+
+	if !verifyWistiaSignature(secret, body, r.Header.Get("X-Wistia-Signature")) {
+		Log.Warn("rejected Wistia webhook with invalid signature", "remote", r.RemoteAddr)
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      "invalid webhook signature",
+			HttpStatus: http.StatusUnauthorized,
+		}, w)
+		return
+	}
+
+	webhook := new(WistiaWebhookBody)
+	if err := json.Unmarshal(body, webhook); err != nil {
+		s.ResponseJSONError(&APIStandardError{
+			Status:     false,
+			Error:      err.Error(),
+			HttpStatus: http.StatusBadRequest,
+		}, w)
+		return
+	}
+
+	now := time.Now()
+	fresh := make([]bool, len(webhook.Events))
+	for i, event := range webhook.Events {
+		fresh[i] = firstDelivery(event.Uuid, now)
+	}
+
+	taskID := generateID()
+	task := &Task{
+		ID:     taskID,
+		Status: TASK_STATUS_RUNNING,
+	}
+
+	tasksMu.Lock()
+	tasks[taskID] = task
+	tasksMu.Unlock()
+
+	go func(taskId string) {
+		results := make([]*WebhookEventResult, 0, len(webhook.Events))
+		for i, event := range webhook.Events {
+			if !fresh[i] {
+				Log.Info("ignoring redelivered Wistia webhook event", "event", event.Uuid, "type", event.Type, "task_id", taskId)
+				results = append(results, &WebhookEventResult{Uuid: event.Uuid, Type: event.Type, Duplicate: true})
+				continue
+			}
+			results = append(results, s.handleWistiaEvent(event))
+		}
+
+		tasksMu.Lock()
+		tasks[taskId] = &Task{
+			Status: TASK_STATUS_FINISHED,
+			Result: results,
+			ID:     taskId,
+		}
+		tasksMu.Unlock()
+	}(taskID)
+
+	s.ResponseJSON(task, w)
+}
+
+func (s *HTTPService) handleWistiaEvent(event *WistiaWebhookEvent) *WebhookEventResult {
+	result := &WebhookEventResult{
+		Uuid: event.Uuid,
+		Type: event.Type,
+	}
+	if media := event.Payload.Media; media != nil {
+		result.HashId = media.Id
+	}
+	if len(result.HashId) <= 0 {
+		Log.Debug("ignoring Wistia webhook event without media", "event", event.Uuid, "type", event.Type)
+		return result
+	}
+
+	dbHelper := NewDBHelper(s.config.DBConf)
+
+	switch event.Type {
+	case WISTIA_EVENT_MEDIA_DELETED:
+		if err := dbHelper.DeleteWistiaCatalogVideo(result.HashId); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		Log.Info("webhook: removed deleted media from catalog", "hash", result.HashId, "event", event.Uuid)
+
+	case WISTIA_EVENT_MEDIA_CREATED, WISTIA_EVENT_MEDIA_UPDATED:
+		helper := NewWistiaHelper(s.config.WistiaConf)
+		video, err := helper.GetVideoDetail(result.HashId)
+		if err != nil {
+			result.Error = fmt.Sprintf("failed to fetch media: %v", err)
+			return result
+		}
+		if err := dbHelper.SaveWistiaCatalogVideo(result.HashId, video); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		Log.Info("webhook: refreshed media in catalog", "hash", result.HashId, "type", event.Type, "event", event.Uuid)
+
+		if event.Type == WISTIA_EVENT_MEDIA_CREATED {
+			result.MoveTaskId, result.IndexTaskId = s.queueWebhookMigration(result.HashId)
+		} else if _, err := dbHelper.FindDeferredMedia(result.HashId); err == nil && video.IsReady() {
+			// a deferred media finished encoding, no need to wait for the next retry pass
+			result.MoveTaskId, result.IndexTaskId = s.queueWebhookMigration(result.HashId)
+		} else if err == nil && video.IsFailed() {
+			Log.Warn("webhook: deferred media failed to encode, no longer retrying", "hash", result.HashId, "event", event.Uuid)
+			s.clearDeferredVideo(result.HashId)
+		}
+
+	default:
+		Log.Debug("ignoring unhandled Wistia webhook event", "event", event.Uuid, "type", event.Type, "hash", result.HashId)
+	}
+
+	return result
+}
+
+// queueWebhookMigration starts a MoveVideoToS3 task for hashId and, when enabled, an indexing
+// task that runs once the migration succeeded.
+func (s *HTTPService) queueWebhookMigration(hashId string) (string, string) {
+	moveTaskId := generateID()
+	indexTaskId := ""
+	if s.config.WistiaConf.WebhookAutoIndex {
+		indexTaskId = fmt.Sprintf("%s-index", moveTaskId)
+	}
+
+	tasksMu.Lock()
+	tasks[moveTaskId] = &Task{ID: moveTaskId, Status: TASK_STATUS_RUNNING}
+	if len(indexTaskId) > 0 {
+		tasks[indexTaskId] = &Task{ID: indexTaskId, Status: TASK_STATUS_INIT}
+	}
+	tasksMu.Unlock()
+
+	go func() {
+		s.MoveVideoToS3(&MultipleMediaBody{HashList: []string{hashId}}, moveTaskId, nil)
+		if len(indexTaskId) <= 0 {
+			return
+		}
+
+		tasksMu.Lock()
+		moveTask := tasks[moveTaskId]
+		tasksMu.Unlock()
+		results, _ := moveTask.Result.([]*MoveToS3Result)
+		if len(results) <= 0 || results[0] == nil || !results[0].Status {
+			tasksMu.Lock()
+			tasks[indexTaskId] = &Task{ID: indexTaskId, Status: TASK_STATUS_ERROR, Result: "migration failed, indexing skipped"}
+			tasksMu.Unlock()
+			return
+		}
+
+		tasksMu.Lock()
+		tasks[indexTaskId] = &Task{ID: indexTaskId, Status: TASK_STATUS_RUNNING}
+		tasksMu.Unlock()
+
+		defer func() {
+			<-s.uploadQueue
+		}()
+		s.uploadQueue <- true
+
+		s.indexVideoToS3(hashId, indexTaskId)
+	}()
+
+	Log.Info("webhook: queued migration for new media", "hash", hashId, "task_id", moveTaskId, "index_task_id", indexTaskId)
+	return moveTaskId, indexTaskId
+}
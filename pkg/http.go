@@ -21,6 +21,8 @@ const TASK_STATUS_ERROR = "error"
 
 type HTTPService struct {
 	config *Config
+	// uploadQueue caps concurrent DashScope indexing at WISTIA_WORKER_LIMIT; migrations and
+	// archive checks go through eachMedia instead.
 	uploadQueue chan bool
 }
 
@@ -39,6 +41,10 @@ type Task struct {
 	ID     string      `json:"id"`
 	Status string      `json:"status"`
 	Result interface{} `json:"result,omitempty"`
+	// Transfer is the live asset throughput of the task, filled in by GetTask.
+	Transfer *TransferProgress `json:"transfer,omitempty"`
+	// Invalidations are the CDN invalidation batches holding paths of the task, filled in by GetTask.
+	Invalidations []*Invalidation `json:"invalidations,omitempty"`
 }
 
 type MultipleMediaBody struct {
@@ -47,21 +53,37 @@ type MultipleMediaBody struct {
 
 type MoveToS3Options struct {
 	OverRider bool
+	// AssetPolicy overrides WistiaConf.AssetPolicy for this request when set.
+	AssetPolicy *AssetPolicy
 }
 
 type MoveToS3Result struct {
-	HashId     string `json:"hash"`
-	CloudFront string `json:"cloudfront"`
-	S3         string `json:"s3"`
-	Status     bool   `json:"status"`
-	Error      string `json:"error"`
+	HashId     string         `json:"hash"`
+	CloudFront string         `json:"cloudfront"`
+	S3         string         `json:"s3"`
+	Status     bool           `json:"status"`
+	Error      string         `json:"error"`
+	Published  bool           `json:"published,omitempty"`
+	Deferred   bool           `json:"deferred,omitempty"`
+	Assets     []*AssetReport `json:"assets,omitempty"`
+	Captions   []*AssetReport `json:"captions,omitempty"`
+	// Targets reports index.json on each publication target, Pages the WistiaConf.PageTemplates copies.
+	Targets []*TargetReport `json:"targets,omitempty"`
+	Pages   []*TargetReport `json:"pages,omitempty"`
 }
 
 var (
 	tasks   = make(map[string]*Task)
 	tasksMu sync.Mutex
+	// taskTransfers holds the live transfer stats of tasks moving assets, guarded by tasksMu.
+	taskTransfers = make(map[string]*TransferStats)
+	// taskTransfersDone is when the task of a taskTransfers entry was first seen finished.
+	taskTransfersDone = make(map[string]time.Time)
 )
 
+// taskDetailsTTL is how long the transfer stats and invalidations of a finished task are kept.
+const taskDetailsTTL = 24 * time.Hour
+
 func generateID() string {
 	return fmt.Sprintf("%d", time.Now().UnixNano())
 }
@@ -101,15 +123,29 @@ func (s *HTTPService) Start() {
 	r.HandleFunc("/", s.RedirectSwagger)
 	r.HandleFunc("/refresh/media", s.RefreshVideoInfo).Methods("POST")
 	r.HandleFunc("/media", s.GetAllVideo).Methods("GET")
+	r.HandleFunc("/media/{hash}", s.DeleteVideo).Methods("DELETE")
 	r.HandleFunc("/move/{hash}", s.VideoToS3).Methods("POST")
 	r.HandleFunc("/move", s.VideoToS3).Methods("POST")
+	r.HandleFunc("/move/project/{projectHash}", s.ProjectToS3).Methods("POST")
 	r.HandleFunc("/index/{hash}", s.IndexVideo).Methods("POST")
 	r.HandleFunc("/index", s.IndexAllVideo).Methods("POST")
 	r.HandleFunc("/index/{hash}", s.GetIndex).Methods("GET")
 	r.HandleFunc("/index/{hash}/subtitles", s.UpdateSubtitles).Methods("PUT")
+	r.HandleFunc("/playback/{hash}", s.GetPlayback).Methods("GET")
+	r.HandleFunc("/render/{hash}", s.RenderPages).Methods("POST")
+	r.HandleFunc("/render", s.RenderPages).Methods("POST")
 	r.HandleFunc("/sync/wistia", s.SyncWistiaVideos).Methods("POST")
 	r.HandleFunc("/wistia/media", s.GetWistiaMedia).Methods("GET")
+	r.HandleFunc("/webhooks/wistia", s.WistiaWebhook).Methods("POST")
+	r.HandleFunc("/archive", s.ArchiveVideo).Methods("POST")
+	r.HandleFunc("/archive", s.GetArchiveAudits).Methods("GET")
+	r.HandleFunc("/deferred", s.GetDeferredVideo).Methods("GET")
+	r.HandleFunc("/deferred/retry", s.RetryDeferredVideo).Methods("POST")
 	r.HandleFunc("/tasks/{id}", s.GetTask).Methods("GET")
+	if s.config.Storage.UseLocal() {
+		r.PathPrefix("/files/").Handler(http.StripPrefix("/files/",
+			http.FileServer(http.Dir(s.config.Storage.Local.Root))))
+	}
 	r.PathPrefix("/swagger/").Handler(http.StripPrefix("/swagger/",
 		http.FileServer(http.Dir(fmt.Sprintf("%s/swagger", s.config.Webroot)))))
 	r.HandleFunc("/ui", func(w http.ResponseWriter, r *http.Request) {
@@ -119,6 +155,11 @@ func (s *HTTPService) Start() {
 		http.FileServer(http.Dir(fmt.Sprintf("%s/webui", s.config.Webroot)))))
 	r.NotFoundHandler = http.HandlerFunc(s.NotFoundHandle)
 
+	go s.runDeferredRetryLoop()
+	if s.config.WistiaConf.SpoolTransfers {
+		go s.resumeInterruptedTransfers()
+	}
+
 	Log.Info("http service starting", "listen", s.config.Listen)
 	err := http.ListenAndServe(s.config.Listen, r)
 	if err != nil {
@@ -166,6 +207,43 @@ func (s *HTTPService) RedirectSwagger(writer http.ResponseWriter, request *http.
 	http.Redirect(writer, request, "/swagger/index.html", 301)
 }
 
+// transferStats returns the transfer stats of taskId, created on first use.
+func transferStats(taskId string) *TransferStats {
+	if len(taskId) <= 0 {
+		return nil
+	}
+	tasksMu.Lock()
+	defer tasksMu.Unlock()
+
+	pruneTaskTransfers(time.Now())
+	stats, ok := taskTransfers[taskId]
+	if !ok {
+		stats = NewTransferStats()
+		taskTransfers[taskId] = stats
+	}
+	return stats
+}
+
+// pruneTaskTransfers drops the transfer stats of tasks no longer listed, or finished for longer
+// than taskDetailsTTL. Called with tasksMu held.
+func pruneTaskTransfers(now time.Time) {
+	for taskId := range taskTransfers {
+		task, ok := tasks[taskId]
+		if ok && (task.Status == TASK_STATUS_RUNNING || task.Status == TASK_STATUS_INIT) {
+			continue
+		}
+		done, seen := taskTransfersDone[taskId]
+		if ok && !seen {
+			taskTransfersDone[taskId] = now
+			continue
+		}
+		if !ok || now.Sub(done) >= taskDetailsTTL {
+			delete(taskTransfers, taskId)
+			delete(taskTransfersDone, taskId)
+		}
+	}
+}
+
 // 查询任务状态和结果
 func (s *HTTPService) GetTask(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
@@ -173,8 +251,19 @@ func (s *HTTPService) GetTask(w http.ResponseWriter, r *http.Request) {
 
 	tasksMu.Lock()
 	task, exists := tasks[taskID]
+	stats := taskTransfers[taskID]
 	tasksMu.Unlock()
 
+	if exists {
+		invalidations := TaskInvalidations(taskID)
+		if stats != nil || len(invalidations) > 0 {
+			view := *task
+			view.Transfer = stats.Snapshot()
+			view.Invalidations = invalidations
+			task = &view
+		}
+	}
+
 	if !exists {
 		s.ResponseJSONError(&APIStandardError{
 			Status:     false,
@@ -0,0 +1,209 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const PUBLICATION_TARGET_S3 = "s3"
+
+const PUBLICATION_TARGET_CLOUDFRONT = "cloudfront"
+
+// PublicationTarget is one published copy of the pages and indexes of a media. Objects are
+// written under Prefix (relative to the storage prefix) and linked through BaseURL; assets are
+// stored once and linked from every target.
+type PublicationTarget struct {
+	Name string `json:"name"`
+	// Prefix is where the target's copy is written, e.g. "cloudfront" for cloudfront/media/...
+	Prefix string `json:"prefix"`
+	// BaseURL serves the bucket root, e.g. https://media.example.com. Empty links the storage's
+	// own public URLs.
+	BaseURL string `json:"base_url"`
+	// CDN purges the target's objects once rewritten; nil leaves its cache alone.
+	CDN *CDNConfig `json:"cdn"`
+	// Signed links assets through CloudFront signed URLs, for private buckets.
+	Signed bool `json:"signed"`
+}
+
+// LoadPublicationTargetsWithEnv reads extra targets from PUBLICATION_TARGETS, a JSON array.
+func LoadPublicationTargetsWithEnv() []*PublicationTarget {
+	targets := make([]*PublicationTarget, 0)
+	raw := os.Getenv("PUBLICATION_TARGETS")
+	if len(raw) <= 0 {
+		return targets
+	}
+	if err := json.Unmarshal([]byte(raw), &targets); err != nil {
+		Log.Error("invalid PUBLICATION_TARGETS, ignoring", "error", err)
+		return []*PublicationTarget{}
+	}
+	return targets
+}
+
+// PublicationTargets returns the storage's own target, the cloudfront/ copy when CloudFront is
+// in use, then the configured Targets. A configured target named like a default replaces it.
+// The storage's own target is only purged when CDN_PROVIDER names a provider, since the CloudFront
+// distribution serves the cloudfront/ copy.
+func (c *StorageConfig) PublicationTargets() []*PublicationTarget {
+	storageTarget := &PublicationTarget{Name: PUBLICATION_TARGET_S3}
+	if c.CDN != nil && len(c.CDN.Provider) > 0 {
+		storageTarget.CDN = c.CDN
+	}
+	defaults := []*PublicationTarget{storageTarget}
+	if c.UseCloudFront() {
+		defaults = append(defaults, &PublicationTarget{
+			Name:    PUBLICATION_TARGET_CLOUDFRONT,
+			Prefix:  "cloudfront",
+			BaseURL: "https://" + c.S3.CloudFrontDomain,
+			CDN:     &CDNConfig{Provider: CDN_PROVIDER_CLOUDFRONT},
+			Signed:  c.Private(),
+		})
+	}
+
+	configured := make(map[string]*PublicationTarget)
+	for _, target := range c.Targets {
+		configured[target.Name] = target
+	}
+	targets := make([]*PublicationTarget, 0, len(defaults)+len(c.Targets))
+	for _, target := range defaults {
+		if override, ok := configured[target.Name]; ok {
+			target = override
+		}
+		targets = append(targets, target)
+	}
+	for _, target := range c.Targets {
+		if target.Name != PUBLICATION_TARGET_S3 && target.Name != PUBLICATION_TARGET_CLOUDFRONT {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// PublicationTarget returns the target called name, or nil.
+func (c *StorageConfig) PublicationTarget(name string) *PublicationTarget {
+	for _, target := range c.PublicationTargets() {
+		if target.Name == name {
+			return target
+		}
+	}
+	return nil
+}
+
+// Key returns where the target keeps its copy of key.
+func (this *PublicationTarget) Key(key string) string {
+	return filepath.ToSlash(filepath.Join(this.Prefix, key))
+}
+
+// URL links key, relative to the storage prefix, through the target.
+func (this *PublicationTarget) URL(conf *StorageConfig, key string) string {
+	return this.ObjectURL(conf, filepath.ToSlash(filepath.Join(conf.PrefixPath(), key)))
+}
+
+// ObjectURL links an object addressed by its full key through the target.
+func (this *PublicationTarget) ObjectURL(conf *StorageConfig, fullKey string) string {
+	if len(this.BaseURL) <= 0 {
+		return conf.ObjectURL(fullKey)
+	}
+	return cdnURL(this.BaseURL, fullKey)
+}
+
+// Purger returns the purger of the target's CDN, or nil.
+func (this *PublicationTarget) Purger(conf *StorageConfig) CDNPurger {
+	if this.CDN == nil {
+		return nil
+	}
+	cdn := *this.CDN
+	if len(cdn.PublicBaseURL) <= 0 {
+		cdn.PublicBaseURL = this.BaseURL
+	}
+	return NewCDNPurger(&StorageConfig{S3: conf.S3, Local: conf.Local, CDN: &cdn})
+}
+
+// purgePaths returns the purge paths of the target's copies of keys.
+func (this *PublicationTarget) purgePaths(conf *StorageConfig, keys ...string) []string {
+	paths := make([]string, 0, len(keys))
+	for _, key := range keys {
+		paths = append(paths, "/"+filepath.ToSlash(filepath.Join(conf.PrefixPath(), this.Key(key))))
+	}
+	return paths
+}
+
+// TargetReport is the outcome of publishing one object to one target.
+type TargetReport struct {
+	Target string `json:"target"`
+	Key    string `json:"key"`
+	Url    string `json:"url,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// publishToTargets writes key to every target, rendering the content of each with render. A
+// failing target is reported and does not stop the others.
+func publishToTargets(storage IStorage, storageConf *StorageConfig, key string, opt *UploadOptions,
+	render func(target *PublicationTarget) (io.Reader, error)) []*TargetReport {
+	targets := storageConf.PublicationTargets()
+	reports := make([]*TargetReport, 0, len(targets))
+	for _, target := range targets {
+		report := &TargetReport{Target: target.Name, Key: target.Key(key)}
+		reports = append(reports, report)
+
+		reader, err := render(target)
+		if err == nil {
+			_, _, err = storage.PutStream(reader, report.Key, opt)
+		}
+		if err != nil {
+			Log.Error("failed to publish to target", "error", err, "target", target.Name, "key", report.Key)
+			report.Error = err.Error()
+			continue
+		}
+		report.Url = target.URL(storageConf, report.Key)
+		Log.Info("published to target", "target", target.Name, "key", report.Key, "url", report.Url)
+	}
+	return reports
+}
+
+// publishContent is publishToTargets with the same content on every target.
+func publishContent(storage IStorage, storageConf *StorageConfig, key string, content string, opt *UploadOptions) []*TargetReport {
+	return publishToTargets(storage, storageConf, key, opt, func(*PublicationTarget) (io.Reader, error) {
+		return strings.NewReader(content), nil
+	})
+}
+
+// purgeTargets purges the copies of keys from the CDN of every target, logging instead of
+// failing since the objects themselves are already published.
+func purgeTargets(storageConf *StorageConfig, taskId string, keys ...string) {
+	for _, target := range storageConf.PublicationTargets() {
+		purger := target.Purger(storageConf)
+		if purger == nil {
+			continue
+		}
+		paths := target.purgePaths(storageConf, keys...)
+		if err := purger.Purge(taskId, paths...); err != nil {
+			Log.Warn("CDN purge failed", "error", err, "target", target.Name, "paths", paths, "task", taskId)
+		}
+	}
+}
+
+// targetsError joins the failures of reports, nil when every target was written.
+func targetsError(reports []*TargetReport) error {
+	errs := make([]error, 0)
+	for _, report := range reports {
+		if len(report.Error) > 0 {
+			errs = append(errs, fmt.Errorf("target %s: %s", report.Target, report.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// targetURL returns the URL published on the target called name, or "".
+func targetURL(reports []*TargetReport, name string) string {
+	for _, report := range reports {
+		if report.Target == name {
+			return report.Url
+		}
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStorageConfig_PublicationTargets(t *testing.T) {
+	conf := &StorageConfig{
+		S3: &S3Config{AccessKey: "key", PrefixPath: "wistia-backup", CloudFrontDomain: "cdn.example.com"},
+		Targets: []*PublicationTarget{
+			{Name: "custom", Prefix: "custom", BaseURL: "https://media.example.com"},
+			{Name: PUBLICATION_TARGET_CLOUDFRONT, Prefix: "edge", BaseURL: "https://edge.example.com"},
+		},
+	}
+	names := make([]string, 0)
+	for _, target := range conf.PublicationTargets() {
+		names = append(names, target.Name+":"+target.Prefix)
+	}
+	if want := []string{"s3:", "cloudfront:edge", "custom:custom"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+
+	if purger := conf.PublicationTarget(PUBLICATION_TARGET_S3).Purger(conf); purger != nil {
+		t.Errorf("the s3 target must not be purged without CDN_PROVIDER, got %T", purger)
+	}
+	conf.CDN = &CDNConfig{Provider: CDN_PROVIDER_CLOUDFLARE}
+	if purger := conf.PublicationTarget(PUBLICATION_TARGET_S3).Purger(conf); purger == nil {
+		t.Error("the s3 target must be purged through the CDN_PROVIDER")
+	}
+
+	custom := conf.PublicationTarget("custom")
+	if got := custom.URL(conf, custom.Key("media/abc/index.json")); got != "https://media.example.com/wistia-backup/custom/media/abc/index.json" {
+		t.Errorf("unexpected custom URL %s", got)
+	}
+}
+
+func TestPublishToTargets(t *testing.T) {
+	disk := getLocalStorage(t).(*LocalStorage)
+	storageConf := &StorageConfig{
+		Local:   disk.Conf,
+		Targets: []*PublicationTarget{{Name: "custom", Prefix: "custom", BaseURL: "https://media.example.com"}},
+	}
+
+	reports := publishContent(disk, storageConf, "media/abc/index-ai.json", `{}`, &UploadOptions{ContentType: "application/json"})
+	if err := targetsError(reports); err != nil {
+		t.Fatal(err)
+	}
+	if got := targetURL(reports, PUBLICATION_TARGET_S3); got != "http://127.0.0.1:3031/files/wistia-backup/media/abc/index-ai.json" {
+		t.Errorf("unexpected s3 URL %s", got)
+	}
+	if got := targetURL(reports, "custom"); got != "https://media.example.com/wistia-backup/custom/media/abc/index-ai.json" {
+		t.Errorf("unexpected custom URL %s", got)
+	}
+	for _, key := range []string{"media/abc/index-ai.json", "custom/media/abc/index-ai.json"} {
+		if _, err := os.Stat(filepath.Join(disk.Conf.Root, "wistia-backup", key)); err != nil {
+			t.Errorf("missing %s: %v", key, err)
+		}
+	}
+
+	video := &WistiaRespVideo{
+		HashId:   "abc",
+		Assets:   &AssetList{{Type: "Mp4VideoFile", Height: 720, Url: "http://127.0.0.1:3031/files/wistia-backup/media/abc/720.mp4", S3Key: "wistia-backup/media/abc/720.mp4"}},
+		Captions: []*VideoCaption{{Language: "eng", Url: "s3", Urls: map[string]string{"custom": "https://media.example.com/eng.vtt"}}},
+	}
+	linked, err := targetVideo(video, storageConf.PublicationTarget("custom"), storageConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*linked.Assets)[0].Url != "https://media.example.com/wistia-backup/media/abc/720.mp4" || linked.Captions[0].Url != "https://media.example.com/eng.vtt" {
+		t.Errorf("target copy not linked through the target: %s %s", (*linked.Assets)[0].Url, linked.Captions[0].Url)
+	}
+	if (*video.Assets)[0].Url != "http://127.0.0.1:3031/files/wistia-backup/media/abc/720.mp4" || video.Captions[0].Url != "s3" {
+		t.Error("linking a target copy must leave the video alone")
+	}
+
+	if _, err := targetVideo(video, &PublicationTarget{Name: "signed", Signed: true}, storageConf, nil); err == nil {
+		t.Error("expected an error for a signed target without signer")
+	}
+}
@@ -2,7 +2,12 @@ package pkg
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type S3Config struct {
@@ -11,33 +16,356 @@ type S3Config struct {
 	Bucket           string `json:"bucket"`
 	Region           string `json:"region"`
 	PrefixPath       string `json:"prefix"`
+	Endpoint         string `json:"endpoint"`
+	ForcePathStyle   bool   `json:"force_path_style"`
+	PublicBaseURL    string `json:"public_base_url"`
 	CloudFrontDomain string `json:"cloudfront_domain"`
 	CloudFrontDistID string `json:"cloudfront_dist_id"`
+	// UploadDefaults fill UploadOptions per kind (original, video, image, caption, index, page);
+	// the "default" entry applies to every kind.
+	UploadDefaults map[string]*UploadDefaults `json:"upload_defaults"`
+	// Private uploads every object without the public-read ACL; playback then goes through
+	// CloudFront signed URLs or signed cookies made with the key pair below.
+	Private                  bool   `json:"private"`
+	CloudFrontKeyPairId      string `json:"cloudfront_key_pair_id"`
+	CloudFrontPrivateKey     string `json:"cloudfront_private_key"`
+	CloudFrontPrivateKeyPath string `json:"cloudfront_private_key_path"`
+	// CloudFrontSignMode is SIGN_MODE_URL (default) or SIGN_MODE_COOKIE.
+	CloudFrontSignMode string `json:"cloudfront_sign_mode"`
+	// SignedURLExpiryMinutes is the default lifetime of signed URLs and cookies.
+	SignedURLExpiryMinutes int `json:"signed_url_expiry_minutes"`
+	// CloudFrontCookieDomain is the Domain of signed cookies, e.g. ".example.com" when the API
+	// and the CloudFront alias share a parent domain.
+	CloudFrontCookieDomain string `json:"cloudfront_cookie_domain"`
+	// InvalidationWindowSeconds is how long CloudFront invalidation paths are collected into one
+	// batch, 10 when 0; negative sends every submission on its own.
+	InvalidationWindowSeconds int `json:"cloudfront_invalidation_window_seconds"`
 }
 
 func (c *S3Config) UseCloudFront() bool {
 	return len(c.CloudFrontDomain) > 0
 }
 
+// ObjectURL is the single place public object URLs are built from. PublicBaseURL wins when set
+// (e.g. a reverse proxy in front of MinIO), then the custom endpoint, then the AWS regional endpoint.
+func (c *S3Config) ObjectURL(path string) string {
+	path = strings.TrimLeft(path, "/")
+	if len(c.PublicBaseURL) > 0 {
+		return fmt.Sprintf("%s/%s", strings.TrimRight(c.PublicBaseURL, "/"), path)
+	}
+	if len(c.Endpoint) > 0 {
+		endpoint := strings.TrimRight(c.Endpoint, "/")
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "https://" + endpoint
+		}
+		if c.ForcePathStyle {
+			return fmt.Sprintf("%s/%s/%s", endpoint, c.Bucket, path)
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Sprintf("%s/%s/%s", endpoint, c.Bucket, path)
+		}
+		return fmt.Sprintf("%s://%s.%s/%s", u.Scheme, c.Bucket, u.Host, path)
+	}
+	return fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s", c.Region, c.Bucket, path)
+}
+
+// uploadOptions returns a copy of opt with its empty fields filled from the defaults of
+// opt.Kind, then from the "default" entry. A nil opt is treated as empty options.
+func (c *S3Config) uploadOptions(opt *UploadOptions) *UploadOptions {
+	if opt == nil {
+		opt = &UploadOptions{}
+	}
+	merged := *opt
+	for _, kind := range []string{opt.Kind, "default"} {
+		defaults, ok := c.UploadDefaults[kind]
+		if !ok || defaults == nil {
+			continue
+		}
+		if merged.StorageClass == "" {
+			merged.StorageClass = defaults.StorageClass
+		}
+		if merged.ServerSideEncryption == "" {
+			merged.ServerSideEncryption = defaults.ServerSideEncryption
+		}
+		if merged.KMSKeyId == "" {
+			merged.KMSKeyId = defaults.KMSKeyId
+		}
+		if merged.CacheControl == "" {
+			merged.CacheControl = defaults.CacheControl
+		}
+		if merged.ContentDisposition == "" {
+			merged.ContentDisposition = defaults.ContentDisposition
+		}
+	}
+	if merged.KMSKeyId != "" && merged.ServerSideEncryption == "" {
+		merged.ServerSideEncryption = "aws:kms"
+	}
+	if c.Private {
+		merged.PublicRead = false
+	}
+	return &merged
+}
+
+func (c *S3Config) CloudFrontURL(path string) string {
+	return fmt.Sprintf("https://%s/%s", c.CloudFrontDomain, strings.TrimLeft(path, "/"))
+}
+
 type StorageConfig struct {
-	S3  *S3Config `json:"s3"`
+	S3    *S3Config    `json:"s3"`
+	Local *LocalConfig `json:"local"`
+	// CDN selects how published objects are purged from cache, see NewCDNPurger.
+	CDN *CDNConfig `json:"cdn"`
+	// Targets are publication targets besides the default s3 and cloudfront ones, see PublicationTargets.
+	Targets []*PublicationTarget `json:"targets"`
+}
+
+func (c *StorageConfig) UseS3() bool {
+	return c.S3 != nil && len(c.S3.AccessKey) > 0
+}
+
+func (c *StorageConfig) UseLocal() bool {
+	return !c.UseS3() && c.Local != nil && len(c.Local.Root) > 0
+}
+
+func (c *StorageConfig) UseCloudFront() bool {
+	return c.UseS3() && c.S3.UseCloudFront()
+}
+
+// Private reports whether objects are kept private and served through signed CloudFront URLs.
+func (c *StorageConfig) Private() bool {
+	return c.UseS3() && c.S3.Private
+}
+
+func (c *StorageConfig) PrefixPath() string {
+	if c.UseLocal() {
+		return c.Local.PrefixPath
+	}
+	if c.S3 != nil {
+		return c.S3.PrefixPath
+	}
+	return ""
+}
+
+// ObjectURL returns the public URL of an object addressed by its full key (prefix included).
+func (c *StorageConfig) ObjectURL(path string) string {
+	if c.UseLocal() {
+		return c.Local.ObjectURL(path)
+	}
+	return c.S3.ObjectURL(path)
+}
+
+// PublicURL returns the public URL of an object addressed relative to the configured prefix.
+func (c *StorageConfig) PublicURL(Key string) string {
+	return c.ObjectURL(filepath.ToSlash(filepath.Join(c.PrefixPath(), Key)))
+}
+
+// CloudFrontURL returns the CloudFront URL of an object addressed relative to the configured prefix.
+func (c *StorageConfig) CloudFrontURL(Key string) string {
+	return c.S3.CloudFrontURL(filepath.ToSlash(filepath.Join(c.PrefixPath(), Key)))
 }
 
 type UploadOptions struct {
 	ContentType string
 	PublicRead bool
+	// Kind selects the S3Config.UploadDefaults entry filling the fields below when left empty.
+	Kind string
+	// StorageClass is an S3 storage class such as STANDARD_IA or GLACIER_IR.
+	StorageClass string
+	// ServerSideEncryption is "AES256" (SSE-S3) or "aws:kms" (SSE-KMS, with KMSKeyId).
+	ServerSideEncryption string
+	KMSKeyId             string
+	CacheControl         string
+	ContentDisposition   string
+	// Metadata is stored as x-amz-meta-* headers on S3.
+	Metadata map[string]string
 }
 
+const UPLOAD_KIND_ORIGINAL = "original"
+
+const UPLOAD_KIND_VIDEO = "video"
+
+const UPLOAD_KIND_IMAGE = "image"
+
+const UPLOAD_KIND_CAPTION = "caption"
+
+const UPLOAD_KIND_INDEX = "index"
+
+const UPLOAD_KIND_PAGE = "page"
+
+// uploadKinds are the kinds with their own S3_*_<KIND> environment defaults.
+var uploadKinds = []string{UPLOAD_KIND_ORIGINAL, UPLOAD_KIND_VIDEO, UPLOAD_KIND_IMAGE, UPLOAD_KIND_CAPTION, UPLOAD_KIND_INDEX, UPLOAD_KIND_PAGE}
+
+// UploadDefaults are the per-kind defaults of the optional UploadOptions fields.
+type UploadDefaults struct {
+	StorageClass         string `json:"storage_class"`
+	ServerSideEncryption string `json:"server_side_encryption"`
+	KMSKeyId             string `json:"kms_key_id"`
+	CacheControl         string `json:"cache_control"`
+	ContentDisposition   string `json:"content_disposition"`
+}
+
+// assetUploadKind maps a Wistia asset type to its upload kind.
+func assetUploadKind(asset *WistiaRespVideoAsset) string {
+	switch {
+	case asset.Type == "OriginalFile":
+		return UPLOAD_KIND_ORIGINAL
+	case strings.Contains(asset.Type, "VideoFile"):
+		return UPLOAD_KIND_VIDEO
+	case strings.HasPrefix(asset.ContentType, "image/"):
+		return UPLOAD_KIND_IMAGE
+	}
+	return ""
+}
+
+type ListOptions struct {
+	// Prefix is relative to the storage prefix, e.g. "media/".
+	Prefix string
+	// Delimiter groups keys sharing the next path segment into a single prefix entry,
+	// e.g. "/" with Prefix "media/" yields one entry per video hash.
+	Delimiter         string
+	ContinuationToken string
+	MaxKeys           int
+}
+
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	IsPrefix     bool      `json:"isPrefix,omitempty"`
+}
+
+type ListPage struct {
+	Objects               []*ObjectInfo
+	NextContinuationToken string
+	IsTruncated           bool
+}
+
+var ErrObjectNotFound = errors.New("object not found")
+
+// IStorage keys passed in are relative to the storage prefix; keys handed back
+// (upload paths, listings, ObjectInfo.Key) are full keys with the prefix included.
 type IStorage interface {
 	Upload(localPath string, Key string, opt *UploadOptions) (string, string, error)
 	PutContent(content string, Key string, opt *UploadOptions) (string, string, error)
 	PutStream(reader io.Reader, Key string, opt *UploadOptions) (string, string, error)
 	ListFiles(prefix string) ([]string, error)
+	ListPage(opt *ListOptions) (*ListPage, error)
 	GetDownloadLink(Key string) (string, error)
+	Delete(Key string) error
+	// DeletePrefix removes every object under the prefix and returns how many were deleted.
+	DeletePrefix(prefix string) (int, error)
+	Exists(Key string) (bool, error)
+	// Stat returns ErrObjectNotFound when the key does not exist.
+	Stat(Key string) (*ObjectInfo, error)
+	Copy(srcKey string, dstKey string, opt *UploadOptions) (string, string, error)
+}
+
+// MultipartUpload is the persisted progress of a multipart upload, so it can continue after a restart.
+type MultipartUpload struct {
+	// Key is "{bucket}/{full key}@{version}", see ResumableStorage.
+	Key       string           `json:"key"`
+	UploadId  string           `json:"uploadId"`
+	Size      int64            `json:"size"`
+	PartSize  int64            `json:"partSize"`
+	Parts     []*MultipartPart `json:"parts"`
+	CreatedAt string           `json:"createdAt"`
+	UpdatedAt string           `json:"updatedAt"`
+}
+
+type MultipartPart struct {
+	Number int64  `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+// MultipartStateStore persists MultipartUpload records; FindMultipartUpload returns an error
+// when none exists for key.
+type MultipartStateStore interface {
+	FindMultipartUpload(key string) (*MultipartUpload, error)
+	GetAllMultipartUploads() ([]*MultipartUpload, error)
+	SaveMultipartUpload(upload *MultipartUpload) error
+	DeleteMultipartUpload(key string) error
+}
+
+// ResumableStorage is implemented by storages that can continue an interrupted upload of size
+// bytes read from src, keeping their progress in state. version identifies the content of src;
+// an interrupted upload of another version of Key is discarded rather than continued.
+type ResumableStorage interface {
+	PutResumable(src io.ReaderAt, size int64, Key string, version string, opt *UploadOptions, state MultipartStateStore) (string, string, error)
+}
+
+// ObjectIterator walks every page of a listing, fetching the next page only when the
+// current one is exhausted. Usage mirrors bufio.Scanner:
+//
+//	it := NewObjectIterator(storage, &ListOptions{Prefix: "media/"})
+//	for it.Next() {
+//		obj := it.Object()
+//	}
+//	if err := it.Err(); err != nil { ... }
+type ObjectIterator struct {
+	storage IStorage
+	opt     ListOptions
+	page    *ListPage
+	index   int
+	current *ObjectInfo
+	err     error
+}
+
+func NewObjectIterator(storage IStorage, opt *ListOptions) *ObjectIterator {
+	it := &ObjectIterator{storage: storage}
+	if opt != nil {
+		it.opt = *opt
+	}
+	return it
+}
+
+func (it *ObjectIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for it.page == nil || it.index >= len(it.page.Objects) {
+		if it.page != nil && !it.page.IsTruncated {
+			return false
+		}
+		if it.page != nil {
+			it.opt.ContinuationToken = it.page.NextContinuationToken
+		}
+		page, err := it.storage.ListPage(&it.opt)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.page = page
+		it.index = 0
+	}
+	it.current = it.page.Objects[it.index]
+	it.index++
+	return true
+}
+
+func (it *ObjectIterator) Object() *ObjectInfo {
+	return it.current
+}
+
+func (it *ObjectIterator) Err() error {
+	return it.err
+}
+
+func listAllKeys(storage IStorage, prefix string) ([]string, error) {
+	list := make([]string, 0)
+	it := NewObjectIterator(storage, &ListOptions{Prefix: prefix})
+	for it.Next() {
+		list = append(list, it.Object().Key)
+	}
+	return list, it.Err()
 }
 
 func GetStorage(conf *StorageConfig) (IStorage, error) {
-	if len(conf.S3.AccessKey) > 0 {
+	if conf == nil {
+		return nil, errors.New("storages configuration not found")
+	}
+	if conf.UseS3() {
 		disk, err := NewS3Storage(conf.S3)
 		if err != nil {
 			Log.Error("failed to initialize S3 storage", "bucket", conf.S3.Bucket, "region", conf.S3.Region, "error", err)
@@ -45,5 +373,13 @@ func GetStorage(conf *StorageConfig) (IStorage, error) {
 		}
 		return disk, nil
 	}
+	if conf.UseLocal() {
+		disk, err := NewLocalStorage(conf.Local)
+		if err != nil {
+			Log.Error("failed to initialize local storage", "root", conf.Local.Root, "error", err)
+			return nil, err
+		}
+		return disk, nil
+	}
 	return nil, errors.New("storages configuration not found")
-}
\ No newline at end of file
+}
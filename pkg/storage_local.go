@@ -0,0 +1,365 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type LocalConfig struct {
+	Root       string `json:"root"`
+	BaseURL    string `json:"base_url"`
+	PrefixPath string `json:"prefix"`
+}
+
+type LocalStorage struct {
+	Conf *LocalConfig
+}
+
+func LoadLocalConfigWithEnv() *LocalConfig {
+	remotePathPrefix := "wistia-backup"
+	prefix := os.Getenv("S3_PREFIX")
+	if len(prefix) > 0 {
+		remotePathPrefix = prefix
+	}
+
+	return &LocalConfig{
+		Root:       os.Getenv("LOCAL_STORAGE_ROOT"),
+		BaseURL:    os.Getenv("LOCAL_STORAGE_BASE_URL"),
+		PrefixPath: remotePathPrefix,
+	}
+}
+
+func NewLocalStorage(conf *LocalConfig) (IStorage, error) {
+	if len(conf.Root) <= 0 {
+		return nil, fmt.Errorf("local storage root not configured")
+	}
+	if err := os.MkdirAll(conf.Root, 0755); err != nil {
+		Log.Error("failed to create local storage root", "root", conf.Root, "error", err)
+		return nil, err
+	}
+
+	return &LocalStorage{
+		Conf: conf,
+	}, nil
+}
+
+func (this *LocalStorage) keyPath(Key string) string {
+	return filepath.ToSlash(filepath.Join(this.Conf.PrefixPath, Key))
+}
+
+func (this *LocalStorage) filePath(path string) string {
+	return filepath.Join(this.Conf.Root, filepath.FromSlash(path))
+}
+
+// ErrKeyOutsideRoot is returned for keys that would resolve outside the local storage root.
+var ErrKeyOutsideRoot = errors.New("key leaves the local storage root")
+
+// rootedPath is filePath for a full key, refusing paths that climb out of Root once cleaned.
+func (this *LocalStorage) rootedPath(path string) (string, error) {
+	file := this.filePath(path)
+	rel, err := filepath.Rel(filepath.Clean(this.Conf.Root), file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %q", ErrKeyOutsideRoot, path)
+	}
+	return file, nil
+}
+
+// objectPath returns the full key of Key and the file storing it.
+func (this *LocalStorage) objectPath(Key string) (string, string, error) {
+	path := this.keyPath(Key)
+	file, err := this.rootedPath(path)
+	return path, file, err
+}
+
+func (this *LocalStorage) Upload(localPath string, Key string, opt *UploadOptions) (path string, url string, err error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	return this.PutStream(file, Key, opt)
+}
+
+func (this *LocalStorage) PutContent(content string, Key string, opt *UploadOptions) (path string, url string, err error) {
+	return this.PutStream(strings.NewReader(content), Key, opt)
+}
+
+func (this *LocalStorage) PutStream(reader io.Reader, Key string, opt *UploadOptions) (path string, url string, err error) {
+	path, dest, err := this.objectPath(Key)
+	if err != nil {
+		Log.Error("refusing to write outside local storage root", "key", Key, "error", err)
+		return "", "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		Log.Error("failed to create local storage directory", "key", path, "error", err)
+		return path, "", err
+	}
+
+	// write to a sibling temp file first so readers never see a half-written object
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		Log.Error("failed to create temp file in local storage", "key", path, "error", err)
+		return path, "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, reader); err != nil {
+		tmp.Close()
+		Log.Error("failed to write stream to local storage", "key", path, "error", err)
+		return path, "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return path, "", err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		Log.Error("failed to move upload into place in local storage", "key", path, "error", err)
+		return path, "", err
+	}
+
+	return path, this.Conf.ObjectURL(path), nil
+}
+
+func (this *LocalStorage) ListFiles(prefix string) ([]string, error) {
+	return listAllKeys(this, prefix)
+}
+
+// ListPage emulates ListObjectsV2 on top of the directory tree: keys are returned in
+// lexical order and the continuation token is the last key (or prefix) of the page.
+// The tree is walked in key order, skipping directories that sort entirely before the
+// token or fold into an already listed prefix, and stops once the page is full.
+func (this *LocalStorage) ListPage(opt *ListOptions) (*ListPage, error) {
+	fullPrefix := fmt.Sprintf("%s/%s", this.Conf.PrefixPath, opt.Prefix)
+	maxKeys := opt.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+
+	page := &ListPage{
+		Objects: make([]*ObjectInfo, 0),
+	}
+	// commonPrefix returns the prefix entry key falls under, if any.
+	commonPrefix := func(key string) string {
+		if len(opt.Delimiter) == 0 || !strings.HasPrefix(key, fullPrefix) {
+			return ""
+		}
+		if i := strings.Index(key[len(fullPrefix):], opt.Delimiter); i >= 0 {
+			return key[:len(fullPrefix)+i+len(opt.Delimiter)]
+		}
+		return ""
+	}
+	lastPrefix := ""
+	add := func(obj *ObjectInfo) error {
+		if len(page.Objects) >= maxKeys {
+			page.IsTruncated = true
+			page.NextContinuationToken = page.Objects[len(page.Objects)-1].Key
+			return errListPageFull
+		}
+		page.Objects = append(page.Objects, obj)
+		return nil
+	}
+
+	err := walkKeys(this.filePath(this.Conf.PrefixPath), this.Conf.PrefixPath+"/", func(dirKey string) bool {
+		if !strings.HasPrefix(dirKey, fullPrefix) && !strings.HasPrefix(fullPrefix, dirKey) {
+			return false
+		}
+		token := opt.ContinuationToken
+		if len(token) > 0 && dirKey < token && !strings.HasPrefix(token, dirKey) {
+			return false
+		}
+		if cp := commonPrefix(dirKey); len(cp) > 0 && (cp == lastPrefix || (len(token) > 0 && cp <= token)) {
+			return false
+		}
+		return true
+	}, func(key string, info os.FileInfo) error {
+		if strings.HasPrefix(info.Name(), ".upload-") || !strings.HasPrefix(key, fullPrefix) {
+			return nil
+		}
+		if cp := commonPrefix(key); len(cp) > 0 {
+			if cp == lastPrefix || (len(opt.ContinuationToken) > 0 && cp <= opt.ContinuationToken) {
+				return nil
+			}
+			if err := add(&ObjectInfo{Key: cp, IsPrefix: true}); err != nil {
+				return err
+			}
+			lastPrefix = cp
+			return nil
+		}
+		if len(opt.ContinuationToken) > 0 && key <= opt.ContinuationToken {
+			return nil
+		}
+		return add(&ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+	})
+	if err != nil && !errors.Is(err, errListPageFull) {
+		Log.Error("failed to list local storage files", "root", this.Conf.Root, "prefix", opt.Prefix, "error", err)
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// errListPageFull stops walkKeys once a page has one object more than it can hold.
+var errListPageFull = errors.New("list page full")
+
+// walkKeys visits the files under dir in the lexical order of their keys, which differs
+// from filepath.Walk's name order when a name sorts before "/" (e.g. "a-b" and "a/c").
+// enter reports whether a directory, given as its key with a trailing slash, is worth
+// descending into.
+func walkKeys(dir string, dirKey string, enter func(dirKey string) bool, fn func(key string, info os.FileInfo) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	sortKey := func(entry os.DirEntry) string {
+		if entry.IsDir() {
+			return entry.Name() + "/"
+		}
+		return entry.Name()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortKey(entries[i]) < sortKey(entries[j])
+	})
+
+	for _, entry := range entries {
+		key := dirKey + entry.Name()
+		if entry.IsDir() {
+			if !enter(key + "/") {
+				continue
+			}
+			if err := walkKeys(filepath.Join(dir, entry.Name()), key+"/", enter, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if err := fn(key, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *LocalStorage) GetDownloadLink(Key string) (string, error) {
+	file, err := this.rootedPath(Key)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(file); err != nil {
+		return "", err
+	}
+	return this.Conf.ObjectURL(Key), nil
+}
+
+func (this *LocalStorage) Delete(Key string) error {
+	_, file, err := this.objectPath(Key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(file)
+	if err != nil && !os.IsNotExist(err) {
+		Log.Error("failed to delete local storage file", "key", Key, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (this *LocalStorage) DeletePrefix(prefix string) (int, error) {
+	if _, _, err := this.objectPath(prefix); err != nil {
+		return 0, err
+	}
+	keys, err := listAllKeys(this, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		file, err := this.rootedPath(key)
+		if err != nil {
+			return deleted, err
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			Log.Error("failed to delete local storage file", "key", key, "error", err)
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (this *LocalStorage) Exists(Key string) (bool, error) {
+	_, err := this.Stat(Key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (this *LocalStorage) Stat(Key string) (*ObjectInfo, error) {
+	path, file, err := this.objectPath(Key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+
+	return &ObjectInfo{
+		Key:          path,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+func (this *LocalStorage) Copy(srcKey string, dstKey string, opt *UploadOptions) (path string, url string, err error) {
+	_, srcFile, err := this.objectPath(srcKey)
+	if err != nil {
+		return "", "", err
+	}
+	if _, _, err := this.objectPath(dstKey); err != nil {
+		return "", "", err
+	}
+	src, err := os.Open(srcFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", ErrObjectNotFound
+		}
+		return "", "", err
+	}
+	defer src.Close()
+
+	return this.PutStream(src, dstKey, opt)
+}
+
+func (c *LocalConfig) ObjectURL(path string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimRight(c.BaseURL, "/"), strings.TrimLeft(path, "/"))
+}
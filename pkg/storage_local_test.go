@@ -0,0 +1,298 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func getLocalStorage(t *testing.T) IStorage {
+	disk, err := NewLocalStorage(&LocalConfig{
+		Root:       t.TempDir(),
+		BaseURL:    "http://127.0.0.1:3031/files/",
+		PrefixPath: "wistia-backup",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return disk
+}
+
+func TestLocalStorage_PutContent(t *testing.T) {
+	disk := getLocalStorage(t)
+
+	path, url, err := disk.PutContent(`{"hashed_id":"abc123"}`, "media/abc123/index.json", &UploadOptions{
+		ContentType: "application/json",
+		PublicRead:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "wistia-backup/media/abc123/index.json" {
+		t.Errorf("unexpected path %s", path)
+	}
+	if url != "http://127.0.0.1:3031/files/wistia-backup/media/abc123/index.json" {
+		t.Errorf("unexpected url %s", url)
+	}
+
+	root := disk.(*LocalStorage).Conf.Root
+	bin, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bin) != `{"hashed_id":"abc123"}` {
+		t.Errorf("unexpected content %s", string(bin))
+	}
+
+	link, err := disk.GetDownloadLink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != url {
+		t.Errorf("download link %s should equal upload url %s", link, url)
+	}
+
+	t.Log("PASS")
+}
+
+func TestLocalStorage_ListFiles(t *testing.T) {
+	disk := getLocalStorage(t)
+
+	for _, key := range []string{"media/a/index.json", "media/a/224.mp4", "media/b/index.json", "projects/p/index.json"} {
+		if _, _, err := disk.PutContent(key, key, &UploadOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := disk.ListFiles("media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("expected 3 files under media, got %d: %v", len(files), files)
+	}
+	for _, row := range files {
+		if !strings.HasPrefix(row, "wistia-backup/media/") {
+			t.Errorf("unexpected key %s", row)
+		}
+	}
+
+	files, err = disk.ListFiles("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected no files, got %v", files)
+	}
+
+	t.Log("PASS")
+}
+
+func TestObjectIterator_LocalPagination(t *testing.T) {
+	disk := getLocalStorage(t)
+
+	for _, hash := range []string{"a1", "b2", "c3"} {
+		for _, name := range []string{"index.json", "224.mp4", "cover.jpg"} {
+			key := fmt.Sprintf("media/%s/%s", hash, name)
+			if _, _, err := disk.PutContent(key, key, &UploadOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	pages := 0
+	count := 0
+	opt := &ListOptions{Prefix: "media/", MaxKeys: 2}
+	for {
+		page, err := disk.ListPage(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		count += len(page.Objects)
+		if !page.IsTruncated {
+			break
+		}
+		opt.ContinuationToken = page.NextContinuationToken
+	}
+	if count != 9 || pages != 5 {
+		t.Errorf("expected 9 objects over 5 pages, got %d over %d", count, pages)
+	}
+
+	folders := make([]string, 0)
+	it := NewObjectIterator(disk, &ListOptions{Prefix: "media/", Delimiter: "/", MaxKeys: 1})
+	for it.Next() {
+		obj := it.Object()
+		if !obj.IsPrefix {
+			t.Errorf("expected only folder entries, got %s", obj.Key)
+		}
+		folders = append(folders, obj.Key)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "wistia-backup/media/a1/,wistia-backup/media/b2/,wistia-backup/media/c3/"
+	if strings.Join(folders, ",") != expected {
+		t.Errorf("folders = %v, want %s", folders, expected)
+	}
+
+	t.Log("PASS")
+}
+
+func TestLocalStorage_ListPageKeyOrder(t *testing.T) {
+	disk := getLocalStorage(t)
+
+	// "a-b" sorts before "a/c" as a key although the directory "a" is named first.
+	keys := []string{"media/a-b", "media/a/c", "media/a/d/e", "media/ab", "media/b/f"}
+	for _, key := range keys {
+		if _, _, err := disk.PutContent(key, key, &UploadOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listed := make([]string, 0)
+	opt := &ListOptions{Prefix: "media/", MaxKeys: 2}
+	for {
+		page, err := disk.ListPage(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range page.Objects {
+			listed = append(listed, strings.TrimPrefix(obj.Key, "wistia-backup/"))
+		}
+		if !page.IsTruncated {
+			break
+		}
+		opt.ContinuationToken = page.NextContinuationToken
+	}
+	if strings.Join(listed, ",") != strings.Join(keys, ",") {
+		t.Errorf("listed %v, want %v", listed, keys)
+	}
+
+	page, err := disk.ListPage(&ListOptions{Prefix: "media/", Delimiter: "/", ContinuationToken: "wistia-backup/media/a/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed = listed[:0]
+	for _, obj := range page.Objects {
+		listed = append(listed, strings.TrimPrefix(obj.Key, "wistia-backup/"))
+	}
+	if expected := "media/ab,media/b/"; strings.Join(listed, ",") != expected {
+		t.Errorf("listed %v after the a/ prefix, want %s", listed, expected)
+	}
+
+	t.Log("PASS")
+}
+
+func TestLocalStorage_DeleteStatCopy(t *testing.T) {
+	disk := getLocalStorage(t)
+
+	if _, _, err := disk.PutContent("0123456789", "media/a1/224.mp4", &UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := disk.Stat("media/a1/224.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 10 || info.Key != "wistia-backup/media/a1/224.mp4" {
+		t.Errorf("unexpected stat %+v", info)
+	}
+
+	if _, err := disk.Stat("media/a1/missing.mp4"); err != ErrObjectNotFound {
+		t.Errorf("expected ErrObjectNotFound, got %v", err)
+	}
+
+	path, _, err := disk.Copy("media/a1/224.mp4", "cloudfront/media/a1/224.mp4", &UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "wistia-backup/cloudfront/media/a1/224.mp4" {
+		t.Errorf("unexpected copy path %s", path)
+	}
+
+	exists, err := disk.Exists("cloudfront/media/a1/224.mp4")
+	if err != nil || !exists {
+		t.Errorf("expected copy to exist, got %v %v", exists, err)
+	}
+
+	if err := disk.Delete("cloudfront/media/a1/224.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	exists, err = disk.Exists("cloudfront/media/a1/224.mp4")
+	if err != nil || exists {
+		t.Errorf("expected copy to be deleted, got %v %v", exists, err)
+	}
+
+	if _, _, err := disk.PutContent("{}", "media/a1/index.json", &UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := disk.PutContent("{}", "media/a10/index.json", &UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := disk.DeletePrefix("media/a1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("expected 2 deleted objects, got %d", deleted)
+	}
+	exists, _ = disk.Exists("media/a10/index.json")
+	if !exists {
+		t.Errorf("DeletePrefix must not touch sibling folders")
+	}
+
+	t.Log("PASS")
+}
+
+func TestLocalStorage_KeyOutsideRoot(t *testing.T) {
+	root := t.TempDir()
+	disk, err := NewLocalStorage(&LocalConfig{Root: filepath.Join(root, "storage"), PrefixPath: "wistia-backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	escaping := "../../escaped.txt"
+	if _, _, err := disk.PutContent("x", escaping, &UploadOptions{}); !errors.Is(err, ErrKeyOutsideRoot) {
+		t.Errorf("PutContent: expected ErrKeyOutsideRoot, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("file written outside the root: %v", err)
+	}
+	if _, err := disk.Stat("../../secret.txt"); !errors.Is(err, ErrKeyOutsideRoot) {
+		t.Errorf("Stat: expected ErrKeyOutsideRoot, got %v", err)
+	}
+	if _, err := disk.Exists("../../secret.txt"); !errors.Is(err, ErrKeyOutsideRoot) {
+		t.Errorf("Exists: expected ErrKeyOutsideRoot, got %v", err)
+	}
+	if err := disk.Delete("../../secret.txt"); !errors.Is(err, ErrKeyOutsideRoot) {
+		t.Errorf("Delete: expected ErrKeyOutsideRoot, got %v", err)
+	}
+	if _, err := disk.DeletePrefix("../../"); !errors.Is(err, ErrKeyOutsideRoot) {
+		t.Errorf("DeletePrefix: expected ErrKeyOutsideRoot, got %v", err)
+	}
+	if _, _, err := disk.Copy("../../secret.txt", "media/a1/secret.txt", &UploadOptions{}); !errors.Is(err, ErrKeyOutsideRoot) {
+		t.Errorf("Copy source: expected ErrKeyOutsideRoot, got %v", err)
+	}
+	if _, _, err := disk.PutContent("x", "media/a1/224.mp4", &UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := disk.Copy("media/a1/224.mp4", escaping, &UploadOptions{}); !errors.Is(err, ErrKeyOutsideRoot) {
+		t.Errorf("Copy destination: expected ErrKeyOutsideRoot, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "secret.txt")); err != nil {
+		t.Errorf("file outside the root touched: %v", err)
+	}
+
+	// ".." inside the prefix is fine as long as it stays under the root
+	if _, _, err := disk.PutContent("x", "../other/a.txt", &UploadOptions{}); err != nil {
+		t.Errorf("key under the root refused: %v", err)
+	}
+}
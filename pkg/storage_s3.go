@@ -1,17 +1,24 @@
 package pkg
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"io"
 	"mime"
+	"net/http"
+	neturl "net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -28,22 +35,99 @@ func LoadS3ConfigWithEnv() *S3Config {
 		remotePathPrefix = prefix
 	}
 
+	forcePathStyle, _ := strconv.ParseBool(os.Getenv("S3_FORCE_PATH_STYLE"))
+	private, _ := strconv.ParseBool(os.Getenv("S3_PRIVATE"))
+	signedURLExpiry, err := strconv.Atoi(os.Getenv("S3_SIGNED_URL_EXPIRY_MINUTES"))
+	if err != nil || signedURLExpiry <= 0 {
+		signedURLExpiry = 60
+	}
+	invalidationWindow, _ := strconv.Atoi(os.Getenv("S3_CLOUDFRONT_INVALIDATION_WINDOW_SECONDS"))
+
 	return &S3Config{
 		AccessKey:        os.Getenv("S3_KEY"),
 		SecretKey:        os.Getenv("S3_SECRET"),
 		Bucket:           os.Getenv("S3_BUCKET"),
 		Region:           os.Getenv("S3_REGION"),
+		Endpoint:         os.Getenv("S3_ENDPOINT"),
+		ForcePathStyle:   forcePathStyle,
+		PublicBaseURL:    os.Getenv("S3_PUBLIC_BASE_URL"),
 		CloudFrontDomain: os.Getenv("S3_CLOUDFRONT_DOMAIN"),
 		CloudFrontDistID: os.Getenv("S3_CLOUDFRONT_DIST_ID"),
 		PrefixPath:       remotePathPrefix,
+		UploadDefaults:   loadUploadDefaultsWithEnv(),
+
+		Private:                  private,
+		CloudFrontKeyPairId:      os.Getenv("S3_CLOUDFRONT_KEY_PAIR_ID"),
+		CloudFrontPrivateKey:     os.Getenv("S3_CLOUDFRONT_PRIVATE_KEY"),
+		CloudFrontPrivateKeyPath: os.Getenv("S3_CLOUDFRONT_PRIVATE_KEY_PATH"),
+		CloudFrontSignMode:       os.Getenv("S3_CLOUDFRONT_SIGN_MODE"),
+		SignedURLExpiryMinutes:   signedURLExpiry,
+		CloudFrontCookieDomain:   os.Getenv("S3_CLOUDFRONT_COOKIE_DOMAIN"),
+
+		InvalidationWindowSeconds: invalidationWindow,
+	}
+}
+
+// loadUploadDefaultsWithEnv reads S3_STORAGE_CLASS, S3_SSE, S3_SSE_KMS_KEY_ID, S3_CACHE_CONTROL
+// and S3_CONTENT_DISPOSITION as the "default" entry, and the same names suffixed with an upload
+// kind (e.g. S3_STORAGE_CLASS_ORIGINAL=GLACIER_IR) for that kind.
+func loadUploadDefaultsWithEnv() map[string]*UploadDefaults {
+	load := func(suffix string) *UploadDefaults {
+		defaults := &UploadDefaults{
+			StorageClass:         os.Getenv("S3_STORAGE_CLASS" + suffix),
+			ServerSideEncryption: os.Getenv("S3_SSE" + suffix),
+			KMSKeyId:             os.Getenv("S3_SSE_KMS_KEY_ID" + suffix),
+			CacheControl:         os.Getenv("S3_CACHE_CONTROL" + suffix),
+			ContentDisposition:   os.Getenv("S3_CONTENT_DISPOSITION" + suffix),
+		}
+		if *defaults == (UploadDefaults{}) {
+			return nil
+		}
+		return defaults
+	}
+
+	list := make(map[string]*UploadDefaults)
+	if defaults := load(""); defaults != nil {
+		list["default"] = defaults
 	}
+	for _, kind := range uploadKinds {
+		if defaults := load("_" + strings.ToUpper(kind)); defaults != nil {
+			list[kind] = defaults
+		}
+	}
+	return list
+}
+
+func awsStringOrNil(value string) *string {
+	if len(value) <= 0 {
+		return nil
+	}
+	return aws.String(value)
+}
+
+func awsMetadata(metadata map[string]string) map[string]*string {
+	if len(metadata) <= 0 {
+		return nil
+	}
+	return aws.StringMap(metadata)
+}
+
+// NewSession builds an AWS session from the config. The custom endpoint and path-style
+// addressing only apply to S3 itself, so other services (CloudFront) pass withEndpoint=false.
+func (c *S3Config) NewSession(withEndpoint bool) (*session.Session, error) {
+	awsConf := &aws.Config{
+		Region:      aws.String(c.Region),
+		Credentials: credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, ""),
+	}
+	if withEndpoint && len(c.Endpoint) > 0 {
+		awsConf.Endpoint = aws.String(c.Endpoint)
+		awsConf.S3ForcePathStyle = aws.Bool(c.ForcePathStyle)
+	}
+	return session.NewSession(awsConf)
 }
 
 func NewS3Storage(conf *S3Config) (IStorage, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(conf.Region),
-		Credentials: credentials.NewStaticCredentials(conf.AccessKey, conf.SecretKey, ""),
-	})
+	sess, err := conf.NewSession(true)
 	if err != nil {
 		Log.Error("failed to create AWS session", "region", conf.Region, "error", err)
 		return nil, err
@@ -65,21 +149,32 @@ func (this *S3Storage) Upload(localPath string, Key string, opt *UploadOptions)
 
 	uploader := s3manager.NewUploader(this.session)
 	path = filepath.ToSlash(filepath.Join(this.Conf.PrefixPath, Key))
+	opt = this.Conf.uploadOptions(opt)
 
 	var publicflag *string
 	if opt.PublicRead {
 		publicflag = aws.String("public-read")
 	}
 
-	info, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket:      aws.String(this.Conf.Bucket),
-		Key:         aws.String(path),
-		Body:        file,
-		ACL:         publicflag,
-		ContentType: aws.String(mime.TypeByExtension(localPath)),
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket:               aws.String(this.Conf.Bucket),
+		Key:                  aws.String(path),
+		Body:                 file,
+		ACL:                  publicflag,
+		ContentType:          aws.String(mime.TypeByExtension(localPath)),
+		StorageClass:         awsStringOrNil(opt.StorageClass),
+		ServerSideEncryption: awsStringOrNil(opt.ServerSideEncryption),
+		SSEKMSKeyId:          awsStringOrNil(opt.KMSKeyId),
+		CacheControl:         awsStringOrNil(opt.CacheControl),
+		ContentDisposition:   awsStringOrNil(opt.ContentDisposition),
+		Metadata:             awsMetadata(opt.Metadata),
 	})
+	if err != nil {
+		Log.Error("failed to upload file to S3", "bucket", this.Conf.Bucket, "key", path, "error", err)
+		return path, "", err
+	}
 
-	return path, info.Location, err
+	return path, this.Conf.ObjectURL(path), nil
 }
 
 func (this *S3Storage) PutContent(content string, Key string, opt *UploadOptions) (path string, url string, err error) {
@@ -88,14 +183,14 @@ func (this *S3Storage) PutContent(content string, Key string, opt *UploadOptions
 
 func (this *S3Storage) PutStream(reader io.Reader, Key string, opt *UploadOptions) (path string, url string, err error) {
 	uploader := s3manager.NewUploader(this.session)
+	path = filepath.ToSlash(filepath.Join(this.Conf.PrefixPath, Key))
+	opt = this.Conf.uploadOptions(opt)
 
 	contentType := "application/octet-stream"
 	if len(opt.ContentType) > 0 {
 		contentType = opt.ContentType
 	}
 
-	path = filepath.ToSlash(filepath.Join(this.Conf.PrefixPath, Key))
-
 	var publicflag *string
 	if opt.PublicRead {
 		publicflag = aws.String("public-read")
@@ -105,12 +200,18 @@ func (this *S3Storage) PutStream(reader io.Reader, Key string, opt *UploadOption
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute * 30)
 	defer cancel()
 
-	info, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-		Bucket:      aws.String(this.Conf.Bucket),
-		Key:         aws.String(path),
-		Body:        reader,
-		ACL:         publicflag,
-		ContentType: aws.String(contentType),
+	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:               aws.String(this.Conf.Bucket),
+		Key:                  aws.String(path),
+		Body:                 reader,
+		ACL:                  publicflag,
+		ContentType:          aws.String(contentType),
+		StorageClass:         awsStringOrNil(opt.StorageClass),
+		ServerSideEncryption: awsStringOrNil(opt.ServerSideEncryption),
+		SSEKMSKeyId:          awsStringOrNil(opt.KMSKeyId),
+		CacheControl:         awsStringOrNil(opt.CacheControl),
+		ContentDisposition:   awsStringOrNil(opt.ContentDisposition),
+		Metadata:             awsMetadata(opt.Metadata),
 	})
 
 	if err != nil {
@@ -118,26 +219,57 @@ func (this *S3Storage) PutStream(reader io.Reader, Key string, opt *UploadOption
 		return path, "", err
 	}
 
-	return path, info.Location, err
+	return path, this.Conf.ObjectURL(path), nil
 }
 
 func (this *S3Storage) ListFiles(prefix string) ([]string, error) {
+	return listAllKeys(this, prefix)
+}
+
+func (this *S3Storage) ListPage(opt *ListOptions) (*ListPage, error) {
 	svc := s3.New(this.session)
-	result, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{
+	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(this.Conf.Bucket),
-		Prefix: aws.String(fmt.Sprintf("%s/%s", this.Conf.PrefixPath, prefix)),
-	})
+		Prefix: aws.String(fmt.Sprintf("%s/%s", this.Conf.PrefixPath, opt.Prefix)),
+	}
+	if len(opt.Delimiter) > 0 {
+		input.Delimiter = aws.String(opt.Delimiter)
+	}
+	if len(opt.ContinuationToken) > 0 {
+		input.ContinuationToken = aws.String(opt.ContinuationToken)
+	}
+	if opt.MaxKeys > 0 {
+		input.MaxKeys = aws.Int64(int64(opt.MaxKeys))
+	}
+
+	result, err := svc.ListObjectsV2(input)
 	if err != nil {
-		Log.Error("failed to list S3 objects", "bucket", this.Conf.Bucket, "prefix", prefix, "error", err)
+		Log.Error("failed to list S3 objects", "bucket", this.Conf.Bucket, "prefix", opt.Prefix, "error", err)
 		return nil, err
 	}
 
-	list := make([]string, 0)
+	page := &ListPage{
+		Objects:     make([]*ObjectInfo, 0, len(result.Contents)+len(result.CommonPrefixes)),
+		IsTruncated: aws.BoolValue(result.IsTruncated),
+	}
+	if page.IsTruncated {
+		page.NextContinuationToken = aws.StringValue(result.NextContinuationToken)
+	}
+	for _, item := range result.CommonPrefixes {
+		page.Objects = append(page.Objects, &ObjectInfo{
+			Key:      aws.StringValue(item.Prefix),
+			IsPrefix: true,
+		})
+	}
 	for _, item := range result.Contents {
-		list = append(list, *item.Key)
+		page.Objects = append(page.Objects, &ObjectInfo{
+			Key:          aws.StringValue(item.Key),
+			Size:         aws.Int64Value(item.Size),
+			LastModified: aws.TimeValue(item.LastModified),
+		})
 	}
 
-	return list, nil
+	return page, nil
 }
 
 func (this *S3Storage) GetDownloadLink(Key string) (string, error) {
@@ -149,3 +281,338 @@ func (this *S3Storage) GetDownloadLink(Key string) (string, error) {
 	})
 	return req.Presign(30 * time.Minute)
 }
+
+func (this *S3Storage) Delete(Key string) error {
+	svc := s3.New(this.session)
+	path := filepath.ToSlash(filepath.Join(this.Conf.PrefixPath, Key))
+
+	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(this.Conf.Bucket),
+		Key:    aws.String(path),
+	})
+	if err != nil {
+		Log.Error("failed to delete S3 object", "bucket", this.Conf.Bucket, "key", path, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (this *S3Storage) DeletePrefix(prefix string) (int, error) {
+	svc := s3.New(this.session)
+	deleted := 0
+
+	// DeleteObjects accepts at most 1000 keys, which matches the default page size
+	it := NewObjectIterator(this, &ListOptions{Prefix: prefix})
+	batch := make([]*s3.ObjectIdentifier, 0, 1000)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		output, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(this.Conf.Bucket),
+			Delete: &s3.Delete{
+				Objects: batch,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if len(output.Errors) > 0 {
+			first := output.Errors[0]
+			return fmt.Errorf("failed to delete %d objects, first %s: %s", len(output.Errors), aws.StringValue(first.Key), aws.StringValue(first.Message))
+		}
+		deleted += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for it.Next() {
+		batch = append(batch, &s3.ObjectIdentifier{Key: aws.String(it.Object().Key)})
+		if len(batch) >= 1000 {
+			if err := flush(); err != nil {
+				Log.Error("failed to delete S3 objects", "bucket", this.Conf.Bucket, "prefix", prefix, "error", err)
+				return deleted, err
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return deleted, err
+	}
+	if err := flush(); err != nil {
+		Log.Error("failed to delete S3 objects", "bucket", this.Conf.Bucket, "prefix", prefix, "error", err)
+		return deleted, err
+	}
+
+	return deleted, nil
+}
+
+func (this *S3Storage) Exists(Key string) (bool, error) {
+	_, err := this.Stat(Key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (this *S3Storage) Stat(Key string) (*ObjectInfo, error) {
+	svc := s3.New(this.session)
+	path := filepath.ToSlash(filepath.Join(this.Conf.PrefixPath, Key))
+
+	output, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(this.Conf.Bucket),
+		Key:    aws.String(path),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+			return nil, ErrObjectNotFound
+		}
+		Log.Error("failed to stat S3 object", "bucket", this.Conf.Bucket, "key", path, "error", err)
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		Key:          path,
+		Size:         aws.Int64Value(output.ContentLength),
+		LastModified: aws.TimeValue(output.LastModified),
+	}, nil
+}
+
+func (this *S3Storage) Copy(srcKey string, dstKey string, opt *UploadOptions) (path string, url string, err error) {
+	svc := s3.New(this.session)
+	srcPath := filepath.ToSlash(filepath.Join(this.Conf.PrefixPath, srcKey))
+	path = filepath.ToSlash(filepath.Join(this.Conf.PrefixPath, dstKey))
+	opt = this.Conf.uploadOptions(opt)
+
+	var publicflag *string
+	if opt.PublicRead {
+		publicflag = aws.String("public-read")
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:               aws.String(this.Conf.Bucket),
+		Key:                  aws.String(path),
+		CopySource:           aws.String(neturl.PathEscape(fmt.Sprintf("%s/%s", this.Conf.Bucket, srcPath))),
+		ACL:                  publicflag,
+		StorageClass:         awsStringOrNil(opt.StorageClass),
+		ServerSideEncryption: awsStringOrNil(opt.ServerSideEncryption),
+		SSEKMSKeyId:          awsStringOrNil(opt.KMSKeyId),
+	}
+	// headers and metadata are only replaced together with the content type, otherwise the
+	// copy would lose the source's content type
+	if len(opt.ContentType) > 0 {
+		input.ContentType = aws.String(opt.ContentType)
+		input.CacheControl = awsStringOrNil(opt.CacheControl)
+		input.ContentDisposition = awsStringOrNil(opt.ContentDisposition)
+		input.Metadata = awsMetadata(opt.Metadata)
+		input.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+	}
+
+	_, err = svc.CopyObject(input)
+	if err != nil {
+		Log.Error("failed to copy S3 object", "bucket", this.Conf.Bucket, "src", srcPath, "dst", path, "error", err)
+		return path, "", err
+	}
+
+	return path, this.Conf.ObjectURL(path), nil
+}
+
+// multipartPartSize keeps a 5GB asset well under S3's 10000 part limit.
+const multipartPartSize = 16 << 20
+
+func isNoSuchUpload(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchUpload
+}
+
+// PutResumable uploads src with S3 multipart, saving the upload id and every completed part in
+// state. Called again for the same key, version and size it continues from the last completed
+// part; uploads of other versions are aborted and an upload S3 no longer knows is started over.
+func (this *S3Storage) PutResumable(src io.ReaderAt, size int64, Key string, version string, opt *UploadOptions, state MultipartStateStore) (path string, url string, err error) {
+	if size <= multipartPartSize {
+		return this.PutStream(io.NewSectionReader(src, 0, size), Key, opt)
+	}
+
+	svc := s3.New(this.session)
+	path = filepath.ToSlash(filepath.Join(this.Conf.PrefixPath, Key))
+	stateKey := fmt.Sprintf("%s/%s@%s", this.Conf.Bucket, path, version)
+	this.abortStaleUploads(svc, path, stateKey, state)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		upload, err := state.FindMultipartUpload(stateKey)
+		if err == nil && (upload.Size != size || upload.PartSize != multipartPartSize) {
+			// the source changed since the upload started, its parts are useless
+			svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(this.Conf.Bucket),
+				Key:      aws.String(path),
+				UploadId: aws.String(upload.UploadId),
+			})
+			err = fmt.Errorf("multipart upload state outdated")
+		}
+		if err != nil {
+			upload, err = this.createMultipartUpload(svc, stateKey, path, size, opt, state)
+			if err != nil {
+				return path, "", err
+			}
+		} else {
+			Log.Info("resuming S3 multipart upload", "bucket", this.Conf.Bucket, "key", path, "parts", len(upload.Parts), "upload_id", upload.UploadId)
+		}
+
+		err = this.uploadParts(svc, upload, path, src, state)
+		if err == nil {
+			err = this.completeMultipartUpload(svc, upload, path)
+		}
+		if isNoSuchUpload(err) {
+			Log.Warn("S3 multipart upload expired, starting over", "bucket", this.Conf.Bucket, "key", path, "upload_id", upload.UploadId)
+			state.DeleteMultipartUpload(stateKey)
+			continue
+		}
+		if err != nil {
+			Log.Error("failed to upload S3 multipart", "bucket", this.Conf.Bucket, "key", path, "upload_id", upload.UploadId, "error", err)
+			return path, "", err
+		}
+
+		if err := state.DeleteMultipartUpload(stateKey); err != nil {
+			Log.Warn("failed to clear multipart upload state", "key", stateKey, "error", err)
+		}
+		return path, this.Conf.ObjectURL(path), nil
+	}
+
+	return path, "", fmt.Errorf("multipart upload of %s kept expiring", path)
+}
+
+// abortStaleUploads aborts the saved uploads of path other than stateKey, left behind by a
+// source that changed since.
+func (this *S3Storage) abortStaleUploads(svc *s3.S3, path string, stateKey string, state MultipartStateStore) {
+	uploads, err := state.GetAllMultipartUploads()
+	if err != nil {
+		Log.Warn("failed to list multipart upload states", "error", err)
+		return
+	}
+	prefix := fmt.Sprintf("%s/%s@", this.Conf.Bucket, path)
+	for _, upload := range uploads {
+		if upload.Key == stateKey || !strings.HasPrefix(upload.Key, prefix) {
+			continue
+		}
+		Log.Info("aborting S3 multipart upload of an outdated source", "bucket", this.Conf.Bucket, "key", path, "upload_id", upload.UploadId)
+		svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(this.Conf.Bucket),
+			Key:      aws.String(path),
+			UploadId: aws.String(upload.UploadId),
+		})
+		state.DeleteMultipartUpload(upload.Key)
+	}
+}
+
+func (this *S3Storage) createMultipartUpload(svc *s3.S3, stateKey string, path string, size int64, opt *UploadOptions, state MultipartStateStore) (*MultipartUpload, error) {
+	contentType := "application/octet-stream"
+	if len(opt.ContentType) > 0 {
+		contentType = opt.ContentType
+	}
+	opt = this.Conf.uploadOptions(opt)
+	var publicflag *string
+	if opt.PublicRead {
+		publicflag = aws.String("public-read")
+	}
+
+	output, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(this.Conf.Bucket),
+		Key:                  aws.String(path),
+		ACL:                  publicflag,
+		ContentType:          aws.String(contentType),
+		StorageClass:         awsStringOrNil(opt.StorageClass),
+		ServerSideEncryption: awsStringOrNil(opt.ServerSideEncryption),
+		SSEKMSKeyId:          awsStringOrNil(opt.KMSKeyId),
+		CacheControl:         awsStringOrNil(opt.CacheControl),
+		ContentDisposition:   awsStringOrNil(opt.ContentDisposition),
+		Metadata:             awsMetadata(opt.Metadata),
+	})
+	if err != nil {
+		Log.Error("failed to create S3 multipart upload", "bucket", this.Conf.Bucket, "key", path, "error", err)
+		return nil, err
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	upload := &MultipartUpload{
+		Key:       stateKey,
+		UploadId:  aws.StringValue(output.UploadId),
+		Size:      size,
+		PartSize:  multipartPartSize,
+		Parts:     make([]*MultipartPart, 0),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := state.SaveMultipartUpload(upload); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (this *S3Storage) uploadParts(svc *s3.S3, upload *MultipartUpload, path string, src io.ReaderAt, state MultipartStateStore) error {
+	done := make(map[int64]bool, len(upload.Parts))
+	for _, part := range upload.Parts {
+		done[part.Number] = true
+	}
+
+	buf := make([]byte, upload.PartSize)
+	for number, offset := int64(1), int64(0); offset < upload.Size; number, offset = number+1, offset+upload.PartSize {
+		if done[number] {
+			continue
+		}
+		length := upload.Size - offset
+		if length > upload.PartSize {
+			length = upload.PartSize
+		}
+		n, err := src.ReadAt(buf[:length], offset)
+		if err != nil && !(err == io.EOF && int64(n) == length) {
+			return err
+		}
+
+		output, err := svc.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String(this.Conf.Bucket),
+			Key:        aws.String(path),
+			UploadId:   aws.String(upload.UploadId),
+			PartNumber: aws.Int64(number),
+			Body:       bytes.NewReader(buf[:length]),
+		})
+		if err != nil {
+			return err
+		}
+
+		upload.Parts = append(upload.Parts, &MultipartPart{
+			Number: number,
+			ETag:   aws.StringValue(output.ETag),
+			Size:   length,
+		})
+		upload.UpdatedAt = time.Now().Format(time.RFC3339)
+		if err := state.SaveMultipartUpload(upload); err != nil {
+			return err
+		}
+		Log.Debug("uploaded S3 multipart part", "key", path, "part", number, "bytes", length)
+	}
+	return nil
+}
+
+func (this *S3Storage) completeMultipartUpload(svc *s3.S3, upload *MultipartUpload, path string) error {
+	parts := make([]*s3.CompletedPart, 0, len(upload.Parts))
+	for _, part := range upload.Parts {
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int64(part.Number),
+		})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.Int64Value(parts[i].PartNumber) < aws.Int64Value(parts[j].PartNumber)
+	})
+
+	_, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(this.Conf.Bucket),
+		Key:             aws.String(path),
+		UploadId:        aws.String(upload.UploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
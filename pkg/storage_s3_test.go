@@ -84,3 +84,55 @@ func TestS3Storage_ListFiles(t *testing.T) {
 
 	t.Log(files)
 }
+
+func TestS3Config_ObjectURL(t *testing.T) {
+	cases := []struct {
+		conf     *S3Config
+		expected string
+	}{
+		{&S3Config{Region: "ap-southeast-1", Bucket: "videos"}, "https://s3.ap-southeast-1.amazonaws.com/videos/wistia-backup/media/abc/index.json"},
+		{&S3Config{Bucket: "videos", Endpoint: "http://minio:9000", ForcePathStyle: true}, "http://minio:9000/videos/wistia-backup/media/abc/index.json"},
+		{&S3Config{Bucket: "videos", Endpoint: "https://r2.example.com/"}, "https://videos.r2.example.com/wistia-backup/media/abc/index.json"},
+		{&S3Config{Bucket: "videos", Endpoint: "minio.local:9000", ForcePathStyle: true}, "https://minio.local:9000/videos/wistia-backup/media/abc/index.json"},
+		{&S3Config{Bucket: "videos", Endpoint: "http://minio:9000", PublicBaseURL: "https://cdn.example.com/videos/"}, "https://cdn.example.com/videos/wistia-backup/media/abc/index.json"},
+	}
+
+	for _, tc := range cases {
+		result := tc.conf.ObjectURL("/wistia-backup/media/abc/index.json")
+		if result != tc.expected {
+			t.Errorf("ObjectURL() = %s, want %s", result, tc.expected)
+		}
+	}
+
+	t.Log("PASS")
+}
+
+func TestS3Config_UploadDefaults(t *testing.T) {
+	t.Setenv("S3_SSE_KMS_KEY_ID", "key-1")
+	t.Setenv("S3_STORAGE_CLASS_ORIGINAL", "GLACIER_IR")
+	t.Setenv("S3_CACHE_CONTROL_VIDEO", "public, max-age=31536000")
+	t.Setenv("S3_CONTENT_DISPOSITION_ORIGINAL", "attachment")
+
+	conf := LoadS3ConfigWithEnv()
+
+	original := conf.uploadOptions(assetUploadOptions("abc", &WistiaRespVideoAsset{Type: "OriginalFile"}, false))
+	if original.StorageClass != "GLACIER_IR" || original.ContentDisposition != "attachment" ||
+		original.ServerSideEncryption != "aws:kms" || original.KMSKeyId != "key-1" || original.CacheControl != "" {
+		t.Errorf("unexpected original options %+v", original)
+	}
+	if original.Metadata["wistia-hash"] != "abc" || original.Metadata["wistia-asset-type"] != "OriginalFile" {
+		t.Errorf("unexpected metadata %v", original.Metadata)
+	}
+
+	video := conf.uploadOptions(&UploadOptions{Kind: UPLOAD_KIND_VIDEO, StorageClass: "STANDARD"})
+	if video.StorageClass != "STANDARD" || video.CacheControl != "public, max-age=31536000" || video.KMSKeyId != "key-1" {
+		t.Errorf("unexpected video options %+v", video)
+	}
+
+	// Copy and PutStream accept a nil opt and still get the "default" entry.
+	if none := conf.uploadOptions(nil); none.KMSKeyId != "key-1" || none.ServerSideEncryption != "aws:kms" {
+		t.Errorf("unexpected options for nil %+v", none)
+	}
+
+	t.Log("PASS")
+}
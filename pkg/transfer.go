@@ -0,0 +1,249 @@
+package pkg
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// unknownTransferSize is the weight of an asset whose fileSize Wistia did not report.
+const unknownTransferSize = 64 << 20
+
+// maxTransferChunk bounds a single read so pacing stays smooth under a bandwidth limit.
+const maxTransferChunk = 64 << 10
+
+// TransferScheduler admits asset transfers by size instead of by count, so a few large
+// originals cannot hold every slot while small assets wait, and paces all transfers under one
+// bandwidth limit. One scheduler is shared per *WistiaConf, see GetTransferScheduler.
+type TransferScheduler struct {
+	// MaxInFlightBytes caps the summed size of running transfers; 0 or negative disables the cap.
+	MaxInFlightBytes int64
+	// BytesPerSecond caps the combined throughput of every transfer; 0 disables the limit.
+	BytesPerSecond int64
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inFlight int64
+
+	rateMu sync.Mutex
+	next   time.Time
+}
+
+var (
+	transferSchedulers   = make(map[*WistiaConf]*TransferScheduler)
+	transferSchedulersMu sync.Mutex
+)
+
+// GetTransferScheduler returns the scheduler shared by every WistiaHelper built from conf.
+func GetTransferScheduler(conf *WistiaConf) *TransferScheduler {
+	transferSchedulersMu.Lock()
+	defer transferSchedulersMu.Unlock()
+
+	if scheduler, ok := transferSchedulers[conf]; ok {
+		return scheduler
+	}
+	scheduler := NewTransferScheduler(int64(conf.MaxInFlightMB)<<20, int64(conf.BandwidthKBps)<<10)
+	transferSchedulers[conf] = scheduler
+	return scheduler
+}
+
+func NewTransferScheduler(maxInFlightBytes int64, bytesPerSecond int64) *TransferScheduler {
+	scheduler := &TransferScheduler{
+		MaxInFlightBytes: maxInFlightBytes,
+		BytesPerSecond:   bytesPerSecond,
+	}
+	scheduler.cond = sync.NewCond(&scheduler.mu)
+	return scheduler
+}
+
+// Acquire blocks until a transfer of size bytes fits under MaxInFlightBytes and returns the
+// func that releases it. A transfer larger than the cap runs once nothing else is in flight.
+func (this *TransferScheduler) Acquire(size int64) func() {
+	if size <= 0 {
+		size = unknownTransferSize
+	}
+	if this.MaxInFlightBytes > 0 && size > this.MaxInFlightBytes {
+		size = this.MaxInFlightBytes
+	}
+
+	this.mu.Lock()
+	for this.MaxInFlightBytes > 0 && this.inFlight > 0 && this.inFlight+size > this.MaxInFlightBytes {
+		this.cond.Wait()
+	}
+	this.inFlight += size
+	this.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			this.mu.Lock()
+			this.inFlight -= size
+			this.mu.Unlock()
+			this.cond.Broadcast()
+		})
+	}
+}
+
+// InFlight returns the bytes currently admitted.
+func (this *TransferScheduler) InFlight() int64 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.inFlight
+}
+
+// throttle waits until n more bytes fit under BytesPerSecond; every transfer draws from the
+// same schedule, so the limit holds for their sum.
+func (this *TransferScheduler) throttle(n int) {
+	if this.BytesPerSecond <= 0 || n <= 0 {
+		return
+	}
+
+	this.rateMu.Lock()
+	now := time.Now()
+	if this.next.Before(now) {
+		this.next = now
+	}
+	wait := this.next.Sub(now)
+	this.next = this.next.Add(time.Duration(int64(n) * int64(time.Second) / this.BytesPerSecond))
+	this.rateMu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Reader paces reads from r under the bandwidth limit and counts them into stats, which may be nil.
+func (this *TransferScheduler) Reader(r io.Reader, stats *TransferStats) io.Reader {
+	return &scheduledReader{
+		reader:    r,
+		scheduler: this,
+		stats:     stats,
+	}
+}
+
+type scheduledReader struct {
+	reader    io.Reader
+	scheduler *TransferScheduler
+	stats     *TransferStats
+}
+
+func (this *scheduledReader) Read(p []byte) (int, error) {
+	if len(p) > maxTransferChunk {
+		p = p[:maxTransferChunk]
+	}
+	n, err := this.reader.Read(p)
+	if n > 0 {
+		this.scheduler.throttle(n)
+		this.stats.add(int64(n))
+	}
+	return n, err
+}
+
+// ReaderAt paces reads from r under the bandwidth limit, for uploads that read by offset.
+func (this *TransferScheduler) ReaderAt(r io.ReaderAt) io.ReaderAt {
+	return &scheduledReaderAt{
+		reader:    r,
+		scheduler: this,
+	}
+}
+
+type scheduledReaderAt struct {
+	reader    io.ReaderAt
+	scheduler *TransferScheduler
+}
+
+func (this *scheduledReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := this.reader.ReadAt(p, off)
+	this.scheduler.throttle(n)
+	return n, err
+}
+
+// transferRateWindow is how often the live throughput of a task is recomputed.
+const transferRateWindow = 2 * time.Second
+
+// TransferStats accumulates the bytes moved by one task. All methods accept a nil receiver
+// so untracked transfers need no special casing.
+type TransferStats struct {
+	mu          sync.Mutex
+	startedAt   time.Time
+	bytes       int64
+	active      int
+	windowStart time.Time
+	windowBytes int64
+	rate        float64
+}
+
+// TransferProgress is the live throughput of a task as shown on /tasks/{id}.
+type TransferProgress struct {
+	Bytes                 int64  `json:"bytes"`
+	ActiveTransfers       int    `json:"activeTransfers"`
+	BytesPerSecond        int64  `json:"bytesPerSecond"`
+	AverageBytesPerSecond int64  `json:"averageBytesPerSecond"`
+	StartedAt             string `json:"startedAt"`
+}
+
+func NewTransferStats() *TransferStats {
+	now := time.Now()
+	return &TransferStats{
+		startedAt:   now,
+		windowStart: now,
+	}
+}
+
+func (this *TransferStats) begin() {
+	if this == nil {
+		return
+	}
+	this.mu.Lock()
+	this.active++
+	this.mu.Unlock()
+}
+
+func (this *TransferStats) end() {
+	if this == nil {
+		return
+	}
+	this.mu.Lock()
+	this.active--
+	this.mu.Unlock()
+}
+
+func (this *TransferStats) add(n int64) {
+	if this == nil {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.bytes += n
+	this.windowBytes += n
+	if elapsed := time.Since(this.windowStart); elapsed >= transferRateWindow {
+		this.rate = float64(this.windowBytes) / elapsed.Seconds()
+		this.windowStart = time.Now()
+		this.windowBytes = 0
+	}
+}
+
+func (this *TransferStats) Snapshot() *TransferProgress {
+	if this == nil {
+		return nil
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	rate := this.rate
+	// a stalled transfer must not keep showing its last rate
+	if elapsed := time.Since(this.windowStart); elapsed >= transferRateWindow {
+		rate = float64(this.windowBytes) / elapsed.Seconds()
+	}
+	progress := &TransferProgress{
+		Bytes:           this.bytes,
+		ActiveTransfers: this.active,
+		BytesPerSecond:  int64(rate),
+		StartedAt:       this.startedAt.Format(time.RFC3339),
+	}
+	if elapsed := time.Since(this.startedAt).Seconds(); elapsed > 0 {
+		progress.AverageBytesPerSecond = int64(float64(this.bytes) / elapsed)
+	}
+	return progress
+}
@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTransferScheduler_Acquire(t *testing.T) {
+	scheduler := NewTransferScheduler(100, 0)
+
+	releaseLarge := scheduler.Acquire(80)
+	releaseSmall := scheduler.Acquire(20)
+	if scheduler.InFlight() != 100 {
+		t.Fatalf("expected 100 bytes in flight, got %d", scheduler.InFlight())
+	}
+
+	admitted := make(chan bool)
+	go func() {
+		release := scheduler.Acquire(50)
+		admitted <- true
+		release()
+	}()
+
+	select {
+	case <-admitted:
+		t.Fatal("transfer admitted over the in-flight cap")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	releaseLarge()
+	releaseLarge()
+	select {
+	case <-admitted:
+	case <-time.After(time.Second):
+		t.Fatal("transfer not admitted after release")
+	}
+	releaseSmall()
+
+	// larger than the cap, runs alone
+	release := scheduler.Acquire(500)
+	if scheduler.InFlight() != 100 {
+		t.Errorf("oversized transfer should count as the cap, got %d", scheduler.InFlight())
+	}
+	release()
+
+	// a negative MaxInFlightMB disables the cap
+	conf := (&WistiaConf{MaxInFlightMB: -1}).MarginWithENV()
+	unlimited := NewTransferScheduler(int64(conf.MaxInFlightMB)<<20, 0)
+	releaseFirst, releaseSecond := unlimited.Acquire(1<<40), unlimited.Acquire(1<<40)
+	if unlimited.InFlight() != 2<<40 {
+		t.Errorf("expected both transfers admitted, got %d in flight", unlimited.InFlight())
+	}
+	releaseFirst()
+	releaseSecond()
+
+	t.Log("PASS")
+}
+
+func TestTransferScheduler_Reader(t *testing.T) {
+	scheduler := NewTransferScheduler(0, 64<<10)
+	stats := NewTransferStats()
+	payload := bytes.Repeat([]byte("x"), 32<<10)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		n, err := io.Copy(io.Discard, scheduler.Reader(bytes.NewReader(payload), stats))
+		if err != nil || n != int64(len(payload)) {
+			t.Fatalf("unexpected copy %d %v", n, err)
+		}
+	}
+	// the first 64KB are paced over one second
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("bandwidth limit not applied, took %s", elapsed)
+	}
+
+	progress := stats.Snapshot()
+	if progress.Bytes != int64(2*len(payload)) || progress.AverageBytesPerSecond <= 0 {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+
+	t.Log("PASS")
+}
+
+func TestTransferStats_Prune(t *testing.T) {
+	now := time.Now()
+	tasksMu.Lock()
+	tasks["prune-running"] = &Task{ID: "prune-running", Status: TASK_STATUS_RUNNING}
+	tasks["prune-finished"] = &Task{ID: "prune-finished", Status: TASK_STATUS_FINISHED}
+	for _, taskId := range []string{"prune-running", "prune-finished", "prune-dropped"} {
+		taskTransfers[taskId] = NewTransferStats()
+	}
+	tasksMu.Unlock()
+	defer func() {
+		tasksMu.Lock()
+		delete(tasks, "prune-running")
+		delete(tasks, "prune-finished")
+		tasksMu.Unlock()
+	}()
+
+	listed := func() map[string]bool {
+		seen := make(map[string]bool)
+		for _, taskId := range []string{"prune-running", "prune-finished", "prune-dropped"} {
+			_, seen[taskId] = taskTransfers[taskId]
+		}
+		return seen
+	}
+
+	tasksMu.Lock()
+	defer tasksMu.Unlock()
+	pruneTaskTransfers(now)
+	if seen := listed(); !seen["prune-running"] || !seen["prune-finished"] || seen["prune-dropped"] {
+		t.Errorf("stats of a dropped task must go at once, a finished task's are kept: %v", seen)
+	}
+	pruneTaskTransfers(now.Add(taskDetailsTTL))
+	if seen := listed(); !seen["prune-running"] || seen["prune-finished"] {
+		t.Errorf("stats of a finished task must go after taskDetailsTTL: %v", seen)
+	}
+	delete(taskTransfers, "prune-running")
+}
@@ -2,9 +2,13 @@ package pkg
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"mime"
 	"net/http"
@@ -24,8 +28,18 @@ type TemplateData struct {
 	MediaEndPoint string
 	VideoName     string
 	WistiaS3JSUrl string
-	HashId 	      string
-	TrackingID	  string
+	HashId        string
+	TrackingID    string
+	// Video is the full media record, its assets and captions linked through the page's target.
+	Video *WistiaRespVideo
+	// Index is the AI index of the media, nil until it was indexed.
+	Index *DashScopeIndexResult
+	// Cover, IndexUrl, IndexAIUrl and SubtitlesUrl are public URLs on the page's target; the AI
+	// ones are only set with Index.
+	Cover        string
+	IndexUrl     string
+	IndexAIUrl   string
+	SubtitlesUrl string
 }
 
 type WistiaRespVideoAsset struct {
@@ -35,9 +49,23 @@ type WistiaRespVideoAsset struct {
 	ContentType string `json:"contentType"`
 	Width       int    `json:"width"`
 	Height      int    `json:"height"`
+	MD5         string `json:"md5,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
 	S3Key       string `json:"-"`
 }
 
+// ColdAsset is an asset copied under the cold prefix. Cold assets are left out of index.json,
+// so the stored media record is where their key and checksums are kept.
+type ColdAsset struct {
+	Type     string `json:"type"`
+	Height   int    `json:"height"`
+	FileSize int    `json:"fileSize"`
+	// Key is relative to the storage prefix, e.g. cold/media/{hash}/original.mp4.
+	Key    string `json:"key"`
+	MD5    string `json:"md5,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
 type WistiaRespVideoProject struct {
 	Name   string `json:"name"`
 	Id     int `json:"id"`
@@ -80,6 +108,60 @@ func (a *AssetList) GetOriginal() *WistiaRespVideoAsset {
 	return nil
 }
 
+// assetTypeMatches treats "VideoFile" as every rendition type (Mp4VideoFile, HdMp4VideoFile, ...).
+func assetTypeMatches(assetType string, want string) bool {
+	if want == "VideoFile" {
+		return strings.Contains(assetType, "VideoFile")
+	}
+	return assetType == want
+}
+
+// FilterTypes keeps the assets matching any of types; no types keeps everything.
+func (a *AssetList) FilterTypes(types ...string) AssetList {
+	result := make(AssetList, 0, len(*a))
+	for _, asset := range *a {
+		if len(types) <= 0 {
+			result = append(result, asset)
+			continue
+		}
+		for _, want := range types {
+			if assetTypeMatches(asset.Type, want) {
+				result = append(result, asset)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// FilterHeights keeps the video renditions of the given heights and every non-rendition asset;
+// no heights keeps everything.
+func (a *AssetList) FilterHeights(heights ...int) AssetList {
+	result := make(AssetList, 0, len(*a))
+	for _, asset := range *a {
+		if len(heights) <= 0 || !strings.Contains(asset.Type, "VideoFile") {
+			result = append(result, asset)
+			continue
+		}
+		for _, height := range heights {
+			if asset.Height == height {
+				result = append(result, asset)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Select returns the assets a migration under policy copies; a nil policy selects all of them.
+func (a *AssetList) Select(policy *AssetPolicy) AssetList {
+	if policy == nil {
+		return a.FilterTypes()
+	}
+	selected := a.FilterTypes(policy.Types...)
+	return selected.FilterHeights(policy.Heights...)
+}
+
 type WistiaRespVideo struct {
 	Name      string                    `json:"name"`
 	Id        int                       `json:"id"`
@@ -90,22 +172,85 @@ type WistiaRespVideo struct {
 	Archived  bool                      `json:"archived"`
 	Section   string                    `json:"section"`
 	Created   string                    `json:"created"`
+	Updated   string                    `json:"updated"`
 	Thumbnail *WistiaRespVideoThumbnail `json:"thumbnail"`
 	Assets    *AssetList                `json:"assets"`
 	Project   *WistiaRespVideoProject   `json:"project"`
+	Captions  []*VideoCaption           `json:"captions,omitempty"`
+	// ColdAssets is only set on stored media records, never published.
+	ColdAssets []*ColdAsset `json:"coldAssets,omitempty"`
+}
+
+// ErrMediaNotReady is matched by the error MoveToS3 returns when Wistia is still encoding the media.
+var ErrMediaNotReady = errors.New("media not ready on Wistia")
+
+type MediaNotReadyError struct {
+	Status   string
+	Progress float32
+}
+
+func (e *MediaNotReadyError) Error() string {
+	return fmt.Sprintf("%v (status %s, progress %.2f)", ErrMediaNotReady, e.Status, e.Progress)
+}
+
+func (e *MediaNotReadyError) Is(target error) bool {
+	return target == ErrMediaNotReady
+}
+
+// ErrMediaFailed is returned by MoveToS3 for media Wistia failed to encode, which are never
+// going to become ready and so are not deferred.
+var ErrMediaFailed = errors.New("media failed to encode on Wistia")
+
+// IsReady reports whether Wistia finished encoding, so the rendition set is complete.
+func (this *WistiaRespVideo) IsReady() bool {
+	return this.Status != "queued" && this.Status != "processing" && this.Status != "failed" && this.Progress >= 1
+}
+
+// IsFailed reports whether Wistia gave up encoding the media.
+func (this *WistiaRespVideo) IsFailed() bool {
+	return this.Status == "failed"
 }
 
 type WistiaConf struct {
 	WistiaApiKey    string `json:"wistia_api_key"`
+	// ApiEndpoint is the Data API base URL, defaults to WISTIA_API_ENDPOINT.
+	ApiEndpoint     string `json:"api_endpoint"`
 	WorkerLimit     int    `json:"worker_limit"`
 	TemplateDirPath string `json:"template_dir_path"`
 	GATrackingId    string `json:"ga_tracking_id"`
+	// Templates are the pages rendered into media/{hash}/ of each migrated media, see PageTemplates.
+	Templates []string `json:"templates"`
+	// PublishPolicy decides whether index.json is written when some assets fail:
+	// "all" (default) only when every asset succeeded, "partial" listing only the
+	// assets that made it, "always" regardless of failures.
+	PublishPolicy string `json:"publish_policy"`
+	// MaxRetries bounds retries of transient Wistia failures (network errors, 429, 5xx).
+	MaxRetries int `json:"max_retries"`
+	// RequestsPerMinute caps API calls across all tasks, 600 when 0; negative disables the budget.
+	RequestsPerMinute int `json:"requests_per_minute"`
+	// WebhookSecret verifies X-Wistia-Signature on /webhooks/wistia; webhooks are refused without it.
+	WebhookSecret string `json:"webhook_secret"`
+	// WebhookAutoIndex also queues AI indexing for media created through a webhook.
+	WebhookAutoIndex bool `json:"webhook_auto_index"`
+	// DeferredRetryMinutes is the interval of the retry pass over deferred media; negative disables it.
+	DeferredRetryMinutes int `json:"deferred_retry_minutes"`
+	// AssetPolicy chooses which assets are migrated, /move can override it per request.
+	AssetPolicy *AssetPolicy `json:"asset_policy"`
+	// MaxInFlightMB caps the summed size of concurrent asset transfers, 1024 when 0; negative disables the cap.
+	MaxInFlightMB int `json:"max_in_flight_mb"`
+	// BandwidthKBps caps the combined throughput of all asset transfers; 0 disables the limit.
+	BandwidthKBps int `json:"bandwidth_kbps"`
+	// SpoolTransfers downloads assets to Config.TempDir first, so interrupted transfers resume.
+	SpoolTransfers bool `json:"spool_transfers"`
 }
 
 func (this *WistiaConf) MarginWithENV() *WistiaConf {
 	if this.WistiaApiKey == "" {
 		this.WistiaApiKey = os.Getenv("WISTIA_API_KEY")
 	}
+	if this.ApiEndpoint == "" {
+		this.ApiEndpoint = os.Getenv("WISTIA_API_ENDPOINT")
+	}
 	if this.WorkerLimit == 0 {
 		this.WorkerLimit, _ = strconv.Atoi(os.Getenv("WISTIA_WORKER_LIMIT"))
 	}
@@ -120,34 +265,125 @@ func (this *WistiaConf) MarginWithENV() *WistiaConf {
 	if len(this.GATrackingId) <= 0 {
 		this.GATrackingId = os.Getenv("GA_TRACKING_ID")
 	}
+	if len(this.Templates) <= 0 {
+		this.Templates = splitList(os.Getenv("WISTIA_TEMPLATES"))
+	}
+
+	if this.PublishPolicy == "" {
+		this.PublishPolicy = os.Getenv("WISTIA_PUBLISH_POLICY")
+	}
+	if this.PublishPolicy == "" {
+		this.PublishPolicy = PUBLISH_POLICY_ALL
+	}
+
+	if this.MaxRetries == 0 {
+		this.MaxRetries, _ = strconv.Atoi(os.Getenv("WISTIA_MAX_RETRIES"))
+	}
+	if this.MaxRetries == 0 {
+		this.MaxRetries = 5
+	}
+
+	if this.RequestsPerMinute == 0 {
+		this.RequestsPerMinute, _ = strconv.Atoi(os.Getenv("WISTIA_REQUESTS_PER_MINUTE"))
+	}
+	if this.RequestsPerMinute == 0 {
+		this.RequestsPerMinute = 600
+	}
+
+	if this.WebhookSecret == "" {
+		this.WebhookSecret = os.Getenv("WISTIA_WEBHOOK_SECRET")
+	}
+	if !this.WebhookAutoIndex {
+		this.WebhookAutoIndex = os.Getenv("WISTIA_WEBHOOK_AUTO_INDEX") == "true"
+	}
+
+	if this.DeferredRetryMinutes == 0 {
+		this.DeferredRetryMinutes, _ = strconv.Atoi(os.Getenv("WISTIA_DEFERRED_RETRY_MINUTES"))
+	}
+	if this.DeferredRetryMinutes == 0 {
+		this.DeferredRetryMinutes = 10
+	}
+
+	if this.MaxInFlightMB == 0 {
+		this.MaxInFlightMB, _ = strconv.Atoi(os.Getenv("WISTIA_MAX_IN_FLIGHT_MB"))
+	}
+	if this.MaxInFlightMB == 0 {
+		this.MaxInFlightMB = 1024
+	}
+	if this.BandwidthKBps == 0 {
+		this.BandwidthKBps, _ = strconv.Atoi(os.Getenv("WISTIA_BANDWIDTH_KBPS"))
+	}
+
+	if !this.SpoolTransfers {
+		this.SpoolTransfers = os.Getenv("WISTIA_SPOOL_TRANSFERS") == "true"
+	}
+
+	if this.AssetPolicy == nil {
+		this.AssetPolicy = &AssetPolicy{}
+	}
+	this.AssetPolicy.MarginWithENV()
 
 	return this
 }
 
+// PageTemplates returns Templates, or index.html and demo.html when none are configured.
+func (this *WistiaConf) PageTemplates() []string {
+	if len(this.Templates) > 0 {
+		return this.Templates
+	}
+	return []string{"index.html", "demo.html"}
+}
+
+// APIURL joins path onto the configured Data API base URL.
+func (this *WistiaConf) APIURL(path string) string {
+	endpoint := this.ApiEndpoint
+	if len(endpoint) <= 0 {
+		endpoint = WISTIA_API_ENDPOINT
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimRight(endpoint, "/"), strings.TrimLeft(path, "/"))
+}
+
 type WistiaHelper struct {
-	Conf  *WistiaConf
-	queue chan bool
+	Conf      *WistiaConf
+	client    *WistiaClient
+	queue     chan bool
+	transfers *TransferScheduler
+	stats     *TransferStats
+	spoolDir  string
+	uploads   MultipartStateStore
+	taskId    string
+	indexes   VideoIndexStore
 }
 
 func NewWistiaHelper(conf *WistiaConf) *WistiaHelper {
 	return &WistiaHelper{
 		Conf: conf,
+		client: GetWistiaClient(conf),
 		queue: make(chan bool, conf.WorkerLimit),
+		transfers: GetTransferScheduler(conf),
 	}
 }
 
+// TrackTransfers counts the bytes of every asset this helper transfers into stats.
+func (this *WistiaHelper) TrackTransfers(stats *TransferStats) *WistiaHelper {
+	this.stats = stats
+	return this
+}
+
+// ForTask lists the CDN invalidations made by this helper on /tasks/{taskId}.
+func (this *WistiaHelper) ForTask(taskId string) *WistiaHelper {
+	this.taskId = taskId
+	return this
+}
+
 func (this *WistiaHelper) GetVideoDetail(hashId string) (*WistiaRespVideo , error) {
-	req, err := http.NewRequest( "GET", fmt.Sprintf("%s/medias/%s.json", WISTIA_API_ENDPOINT, hashId), nil)
+	req, err := http.NewRequest( "GET", this.Conf.APIURL(fmt.Sprintf("medias/%s.json", hashId)), nil)
 	if err != nil {
 		Log.Error("failed to create Wistia API request", "error", err, "hash", hashId)
 		return nil, err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", this.Conf.WistiaApiKey))
 
-	client := &http.Client{
-		Timeout:   60 * time.Second,
-	}
-	resp, err := client.Do(req)
+	resp, err := this.client.Do(req)
 	if err != nil {
 		Log.Error("failed to execute Wistia API request", "error", err, "hash", hashId)
 		return nil, err
@@ -164,18 +400,19 @@ func (this *WistiaHelper) GetVideoDetail(hashId string) (*WistiaRespVideo , erro
 }
 
 func (this *WistiaHelper) ListAllVideos() ([]*WistiaRespVideo, error) {
-	const perPage = 50
+	return this.listVideos(nil, 50, nil)
+}
+
+// listVideos pages through medias.json with the given extra query parameters. When keep is set,
+// listing stops at the first video it rejects, which callers use with a sorted listing.
+func (this *WistiaHelper) listVideos(params url.Values, perPage int, keep func(video *WistiaRespVideo) bool) ([]*WistiaRespVideo, error) {
 	allVideos := make([]*WistiaRespVideo, 0)
 	page := 1
 
-	client := &http.Client{
-		Timeout: 60 * time.Second,
-	}
-
 	for {
 		this.queue <- true
 
-		baseURL := fmt.Sprintf("%s/medias.json", WISTIA_API_ENDPOINT)
+		baseURL := this.Conf.APIURL("medias.json")
 		u, err := url.Parse(baseURL)
 		if err != nil {
 			<-this.queue
@@ -184,6 +421,11 @@ func (this *WistiaHelper) ListAllVideos() ([]*WistiaRespVideo, error) {
 		}
 
 		query := u.Query()
+		for key, values := range params {
+			for _, value := range values {
+				query.Add(key, value)
+			}
+		}
 		query.Add("page", strconv.Itoa(page))
 		query.Add("per_page", strconv.Itoa(perPage))
 		u.RawQuery = query.Encode()
@@ -196,23 +438,14 @@ func (this *WistiaHelper) ListAllVideos() ([]*WistiaRespVideo, error) {
 			Log.Error("failed to create Wistia list API request", "error", err, "page", page)
 			return allVideos, err
 		}
-		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", this.Conf.WistiaApiKey))
 
-		resp, err := client.Do(req)
+		resp, err := this.client.Do(req)
 		if err != nil {
 			<-this.queue
 			Log.Error("failed to execute Wistia list API request", "error", err, "page", page)
 			return allVideos, err
 		}
 
-		if resp.StatusCode != 200 {
-			body, _ := io.ReadAll(resp.Body)
-			resp.Body.Close()
-			<-this.queue
-			Log.Error("Wistia list API returned non-200", "status", resp.StatusCode, "page", page, "body", string(body))
-			return allVideos, fmt.Errorf("Wistia API returned status %d: %s", resp.StatusCode, string(body))
-		}
-
 		var pageVideos []*WistiaRespVideo
 		decoder := json.NewDecoder(resp.Body)
 		if err := decoder.Decode(&pageVideos); err != nil {
@@ -226,7 +459,13 @@ func (this *WistiaHelper) ListAllVideos() ([]*WistiaRespVideo, error) {
 
 		Log.Info("fetched Wistia video list page", "page", page, "count", len(pageVideos), "total", len(allVideos)+len(pageVideos))
 
-		allVideos = append(allVideos, pageVideos...)
+		for _, video := range pageVideos {
+			if keep != nil && !keep(video) {
+				Log.Info("finished fetching Wistia videos, reached stop condition", "total", len(allVideos))
+				return allVideos, nil
+			}
+			allVideos = append(allVideos, video)
+		}
 
 		if len(pageVideos) < perPage {
 			break
@@ -238,8 +477,45 @@ func (this *WistiaHelper) ListAllVideos() ([]*WistiaRespVideo, error) {
 	return allVideos, nil
 }
 
+// ListVideosUpdatedSince lists media most recently updated first and stops at the first one
+// not updated after since.
+func (this *WistiaHelper) ListVideosUpdatedSince(since time.Time) ([]*WistiaRespVideo, error) {
+	params := url.Values{}
+	params.Set("sort_by", "updated")
+	params.Set("sort_direction", "0")
+
+	return this.listVideos(params, 100, func(video *WistiaRespVideo) bool {
+		updated, err := time.Parse(time.RFC3339, video.Updated)
+		if err != nil {
+			// keep what we can't order, the caller compares against the catalog anyway
+			return true
+		}
+		return updated.After(since)
+	})
+}
+
+// wistiaLookupBatch is how many hashed_ids[] ExistingVideos looks up per request.
+const wistiaLookupBatch = 100
+
+// ExistingVideos returns which of hashList still exist on Wistia, looked up by hashed_ids[] in
+// batches of wistiaLookupBatch.
+func (this *WistiaHelper) ExistingVideos(hashList []string) (map[string]bool, error) {
+	existing := make(map[string]bool, len(hashList))
+	for start := 0; start < len(hashList); start += wistiaLookupBatch {
+		end := min(start+wistiaLookupBatch, len(hashList))
+		videos, err := this.listVideos(url.Values{"hashed_ids[]": hashList[start:end]}, wistiaLookupBatch, nil)
+		if err != nil {
+			return existing, err
+		}
+		for _, video := range videos {
+			existing[video.HashId] = true
+		}
+	}
+	return existing, nil
+}
+
 func (this *WistiaHelper) ArchiveVideos(videoHashList []string) error {
-	baseURL := fmt.Sprintf("%s/medias/archive.json", WISTIA_API_ENDPOINT)
+	baseURL := this.Conf.APIURL("medias/archive.json")
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		Log.Error("failed to parse archive API URL", "error", err)
@@ -261,12 +537,8 @@ func (this *WistiaHelper) ArchiveVideos(videoHashList []string) error {
 		return err
 	}
 	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", this.Conf.WistiaApiKey))
 
-	client := &http.Client{
-		Timeout:   60 * time.Second,
-	}
-	resp, err := client.Do(req)
+	resp, err := this.client.Do(req)
 	if err != nil {
 		Log.Error("failed to execute archive API request", "error", err)
 		return err
@@ -281,11 +553,6 @@ func (this *WistiaHelper) ArchiveVideos(videoHashList []string) error {
 
 	Log.Debug("archive API response", "body", string(bin), "status", resp.StatusCode)
 
-	if resp.StatusCode != 200 {
-		return errors.New(string((bin)))
-	}
-
-
 	return nil
 }
 
@@ -299,18 +566,18 @@ func (this *WistiaHelper) BuildTemplateWithDelims(filename string, data *Templat
 
 	Log.Debug("parsing template file", "path", fileFullpath)
 
-	parser, err := template.ParseFiles(fileFullpath)
+	parser := template.New(filepath.Base(fileFullpath)).Funcs(templateFuncs)
+	if delimiter != nil {
+		parser = parser.Delims(delimiter.Start, delimiter.End)
+	}
+	parser, err := parser.ParseFiles(fileFullpath)
 	if err != nil {
 		Log.Error("failed to parse template file", "error", err, "path", fileFullpath)
 		return nil, err
 	}
 
-	if delimiter != nil {
-		parser = parser.Delims(delimiter.Start, delimiter.End)
-	}
-
 	var buf bytes.Buffer
-	err = parser.Execute(&buf, &data)
+	err = parser.Execute(&buf, data)
 	if err != nil {
 		Log.Error("failed to execute template", "error", err, "path", fileFullpath)
 		return nil, err
@@ -323,259 +590,591 @@ func (this *WistiaHelper) BuildTemplate(filename string, data *TemplateData) (io
 	return this.BuildTemplateWithDelims(filename, data, nil)
 }
 
-func (this *WistiaHelper) UploadWistiaS3JS(conf *S3Config) (string, string, error) {
+// UploadWistiaS3JS publishes wistia-s3.min.js and returns its CloudFront and S3 URLs, see
+// PublishWistiaS3JS.
+func (this *WistiaHelper) UploadWistiaS3JS(storageConf *StorageConfig) (string, string, error) {
+	reports, err := this.PublishWistiaS3JS(storageConf)
+	return targetURL(reports, PUBLICATION_TARGET_CLOUDFRONT), targetURL(reports, PUBLICATION_TARGET_S3), err
+}
+
+// PublishWistiaS3JS writes media/wistia-s3.min.js to every publication target, each copy
+// pointing at the media/ of its own target.
+func (this *WistiaHelper) PublishWistiaS3JS(storageConf *StorageConfig) ([]*TargetReport, error) {
 	jsPath := "wistia-s3.min.js"
 
-	storage, err := NewS3Storage(conf)
+	storage, err := GetStorage(storageConf)
 	if err != nil {
-		Log.Error("failed to create S3 storage for player JS upload", "error", err)
-		return "", "", err
+		Log.Error("failed to create storage for player JS upload", "error", err)
+		return nil, err
 	}
 
-	data := TemplateData{
-		MediaEndPoint: fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s/media", conf.Region, conf.Bucket, conf.PrefixPath),
-		TrackingID: this.Conf.GATrackingId,
-	}
 	remoteKey := fmt.Sprintf("media/%s", jsPath)
-	reader, err := this.BuildTemplate(jsPath, &data)
+	reports := publishToTargets(storage, storageConf, remoteKey, &UploadOptions{ContentType: "text/javascript", PublicRead: true, Kind: UPLOAD_KIND_PAGE},
+		func(target *PublicationTarget) (io.Reader, error) {
+			return this.BuildTemplate(jsPath, &TemplateData{
+				MediaEndPoint: target.URL(storageConf, target.Key("media")),
+				TrackingID:    this.Conf.GATrackingId,
+			})
+		})
+	Log.Info("published player JS", "file", jsPath, "targets", len(reports))
+
+	purgeTargets(storageConf, this.taskId, remoteKey)
+
+	return reports, targetsError(reports)
+}
+
+// UploadDemoPage publishes a page of video and returns its CloudFront and S3 URLs, see
+// PublishDemoPage.
+func (this *WistiaHelper) UploadDemoPage(tplName string, video *WistiaRespVideo, storageConf *StorageConfig, wg *sync.WaitGroup) (string, string, error) {
+	reports, err := this.PublishDemoPage(tplName, video, storageConf, wg)
+	return targetURL(reports, PUBLICATION_TARGET_CLOUDFRONT), targetURL(reports, PUBLICATION_TARGET_S3), err
+}
+
+// PublishDemoPage renders the tplName page of video, with its AI index when one is stored, and
+// writes it to media/{hash}/ of every publication target, each copy linking its own target.
+func (this *WistiaHelper) PublishDemoPage(tplName string, video *WistiaRespVideo, storageConf *StorageConfig, wg *sync.WaitGroup) ([]*TargetReport, error) {
+	storage, err := GetStorage(storageConf)
 	if err != nil {
-		Log.Error("failed to build player JS template for S3", "error", err, "key", remoteKey)
-		return "", "", err
+		Log.Error("failed to create storage for demo page", "error", err, "hash", video.HashId, "template", tplName)
+		return nil, err
 	}
-	_, s3Url, err := storage.PutStream(reader, remoteKey, &UploadOptions{ContentType: "text/javascript", PublicRead: true})
-	if err != nil {
-		Log.Error("failed to upload player JS to S3", "error", err, "key", remoteKey)
-		return "", "", err
+
+	if wg != nil {
+		defer wg.Done()
 	}
-	Log.Info("uploaded player JS to S3", "file", jsPath, "url", s3Url)
+	defer func() {
+		<-this.queue
+	}()
+	this.queue <- true
 
-	if conf.UseCloudFront() {
-		data.MediaEndPoint = fmt.Sprintf("https://%s/%s/cloudfront/media", conf.CloudFrontDomain, conf.PrefixPath)
-		remoteKey = fmt.Sprintf("cloudfront/media/%s", jsPath)
-		reader, err := this.BuildTemplate(jsPath, &data)
-		if err != nil {
-			Log.Error("failed to build player JS template for CloudFront", "error", err, "key", remoteKey)
-			return "", s3Url, err
-		}
-		_, cloudFrontUrl, err := storage.PutStream(reader, remoteKey, &UploadOptions{ContentType: "text/javascript", PublicRead: true})
-		if err != nil {
-			Log.Error("failed to upload player JS to CloudFront", "error", err, "key", remoteKey)
-			return "", "", err
-		}
-		cloudFrontUrl = fmt.Sprintf("https://%s/%s/cloudfront/media/%s", conf.CloudFrontDomain, conf.PrefixPath, jsPath)
+	index := this.findIndex(video.HashId)
+	remoteKey := fmt.Sprintf("media/%s/%s", video.HashId, tplName)
+	Log.Info("generating page from template", "template", tplName, "key", remoteKey, "hash", video.HashId)
+	reports := publishToTargets(storage, storageConf, remoteKey, &UploadOptions{ContentType: "text/html", PublicRead: true, Kind: UPLOAD_KIND_PAGE, Metadata: map[string]string{"wistia-hash": video.HashId}},
+		func(target *PublicationTarget) (io.Reader, error) {
+			return this.BuildTemplate(tplName, this.pageData(video, index, target, storageConf))
+		})
 
-		Log.Info("uploaded player JS to CloudFront", "file", jsPath, "url", cloudFrontUrl)
+	return reports, targetsError(reports)
+}
 
-		cfHelper := NewCloudFrontHelper(conf)
-		if cfHelper != nil {
-			flushPaths := []string{fmt.Sprintf("/%s/cloudfront/media/wistia-s3.min.js", conf.PrefixPath)}
-			if err := cfHelper.InvalidatePaths(flushPaths); err != nil {
-				Log.Warn("CloudFront invalidation failed for player JS", "error", err, "file", jsPath)
-			}
+// PublishPages renders every WistiaConf.PageTemplates page of video to every publication
+// target, see PublishDemoPage.
+func (this *WistiaHelper) PublishPages(video *WistiaRespVideo, storageConf *StorageConfig) ([]*TargetReport, error) {
+	templates := this.Conf.PageTemplates()
+	pages := make([][]*TargetReport, len(templates))
+	errs := make([]error, len(templates))
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(templates))
+	for i, tplName := range templates {
+		go func(tplName string, index int) {
+			defer wg.Done()
+			pages[index], errs[index] = this.PublishDemoPage(tplName, video, storageConf, nil)
+		}(tplName, i)
+	}
+	wg.Wait()
+
+	reports := make([]*TargetReport, 0)
+	for _, list := range pages {
+		reports = append(reports, list...)
+	}
+	return reports, errors.Join(errs...)
+}
+
+const PUBLISH_POLICY_ALL = "all"
+
+const PUBLISH_POLICY_PARTIAL = "partial"
+
+const PUBLISH_POLICY_ALWAYS = "always"
+
+type AssetReport struct {
+	Type     string `json:"type"`
+	Height   int    `json:"height"`
+	Language string `json:"language,omitempty"`
+	Key      string `json:"key"`
+	Bytes    int64  `json:"bytes"`
+	Status   bool   `json:"status"`
+	// Skipped marks an unchanged asset that was already in storage and not transferred again.
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type MoveToS3Report struct {
+	HashId     string `json:"hash"`
+	CloudFront string `json:"cloudfront"`
+	S3         string `json:"s3"`
+	Published  bool   `json:"published"`
+	// Deferred is set when the media was left alone because Wistia is still encoding it.
+	Deferred bool           `json:"deferred"`
+	Assets   []*AssetReport `json:"assets"`
+	// Captions failures are reported but never block publishing index.json.
+	Captions []*AssetReport `json:"captions"`
+	// Targets reports index.json on each publication target, Pages the WistiaConf.PageTemplates copies.
+	Targets []*TargetReport `json:"targets"`
+	Pages   []*TargetReport `json:"pages"`
+	// ColdAssets are the cold assets in storage, to be kept with the media record.
+	ColdAssets []*ColdAsset `json:"-"`
+}
+
+func (r *MoveToS3Report) FailedAssets() int {
+	failed := 0
+	for _, asset := range r.Assets {
+		if !asset.Status {
+			failed++
 		}
+	}
+	return failed
+}
 
-		return cloudFrontUrl, s3Url, nil
+// integrityReader counts and hashes everything read through it, so an asset can be
+// verified against Wistia's reported fileSize without a second download.
+type integrityReader struct {
+	reader io.Reader
+	md5    hash.Hash
+	sha256 hash.Hash
+	bytes  int64
+}
+
+func newIntegrityReader(r io.Reader) *integrityReader {
+	return &integrityReader{
+		reader: r,
+		md5:    md5.New(),
+		sha256: sha256.New(),
 	}
+}
 
-	return "", s3Url, nil
+func (this *integrityReader) Read(p []byte) (int, error) {
+	n, err := this.reader.Read(p)
+	if n > 0 {
+		this.md5.Write(p[:n])
+		this.sha256.Write(p[:n])
+		this.bytes += int64(n)
+	}
+	return n, err
 }
 
-func (this *WistiaHelper) UploadDemoPage(tplName string, video *WistiaRespVideo, conf *S3Config, wg *sync.WaitGroup) (string, string, error) {
-	data := TemplateData{
-		HashId:        video.HashId,
-		MediaEndPoint: fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s/media", conf.Region, conf.Bucket, conf.PrefixPath),
-		VideoName:     video.Name,
-		WistiaS3JSUrl: fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s/media/wistia-s3.min.js", conf.Region, conf.Bucket, conf.PrefixPath),
+func assetRemoteKey(hashId string, asset *WistiaRespVideoAsset) string {
+	extension := ".bin"
+	extList, err := mime.ExtensionsByType(asset.ContentType)
+	if err == nil && len(extList) > 0 {
+		extension = extList[0]
+	}
+	if asset.ContentType == "image/jpg" {
+		extension = ".jpg"
 	}
 
-	storage, err := NewS3Storage(conf)
-	if err != nil {
-		Log.Error("failed to create S3 storage for demo page", "error", err, "hash", video.HashId, "template", tplName)
-		return "", "", err
+	remoteKey := fmt.Sprintf("media/%s/%d%s", hashId, asset.Height, extension)
+	if asset.Type == "StillImageFile" {
+		remoteKey = fmt.Sprintf("media/%s/cover%s", hashId, extension)
+	}
+	if asset.Type == "OriginalFile" {
+		remoteKey = fmt.Sprintf("media/%s/original%s", hashId, extension)
 	}
+	return remoteKey
+}
 
-	if wg != nil {
-		defer wg.Done()
+// transferAsset streams one asset from Wistia into storage and verifies the stored size
+// against asset.FileSize. On success the asset's Url, S3Key and checksums are updated in place.
+func (this *WistiaHelper) transferAsset(storage IStorage, video *WistiaRespVideo, asset *WistiaRespVideoAsset) *AssetReport {
+	return this.transferAssetTo(storage, video, asset, assetRemoteKey(video.HashId, asset), true)
+}
+
+// assetUploadOptions tags an asset upload with its kind and the Wistia hash and asset type.
+func assetUploadOptions(hashId string, asset *WistiaRespVideoAsset, publicRead bool) *UploadOptions {
+	return &UploadOptions{
+		ContentType: asset.ContentType,
+		PublicRead:  publicRead,
+		Kind:        assetUploadKind(asset),
+		Metadata: map[string]string{
+			"wistia-hash":       hashId,
+			"wistia-asset-type": asset.Type,
+		},
 	}
-	defer func() {
-		<-this.queue
-	}()
-	this.queue <- true
+}
 
-	remoteKey := fmt.Sprintf("media/%s/%s", video.HashId, tplName)
-	Log.Info("generating page from template", "template", tplName, "key", remoteKey, "hash", video.HashId)
-	reader, err := this.BuildTemplate(tplName, &data)
+// transferAssetTo is transferAsset with an explicit destination key and ACL.
+func (this *WistiaHelper) transferAssetTo(storage IStorage, video *WistiaRespVideo, asset *WistiaRespVideoAsset, remoteKey string, publicRead bool) *AssetReport {
+	if len(this.spoolDir) > 0 {
+		return this.spoolAsset(storage, video, asset, remoteKey, publicRead)
+	}
+	report := &AssetReport{
+		Type:   asset.Type,
+		Height: asset.Height,
+		Key:    remoteKey,
+	}
+	fail := func(err error) *AssetReport {
+		report.Error = err.Error()
+		return report
+	}
+
+	var reader *integrityReader
+	var path, url string
+	var err error
+	for attempt := 0; ; attempt++ {
+		reader, path, url, err = this.streamAsset(storage, video, asset, remoteKey, publicRead)
+		if !errors.Is(err, ErrDownloadStalled) || attempt >= this.Conf.MaxRetries {
+			break
+		}
+		Log.Warn("video asset download stalled, starting over", "error", err, "attempt", attempt+1, "key", remoteKey, "hash", video.HashId)
+	}
+	if reader != nil {
+		report.Bytes = reader.bytes
+	}
 	if err != nil {
-		Log.Error("failed to build page template for S3", "error", err, "template", tplName, "hash", video.HashId)
-		return "", "", err
+		return fail(err)
+	}
+
+	if asset.FileSize > 0 && reader.bytes != int64(asset.FileSize) {
+		Log.Error("video asset size mismatch after streaming", "expected", asset.FileSize, "streamed", reader.bytes, "key", remoteKey, "hash", video.HashId)
+		return fail(fmt.Errorf("size mismatch: wistia reports %d bytes, streamed %d", asset.FileSize, reader.bytes))
 	}
-	_, s3Url, err := storage.PutStream(reader, remoteKey, &UploadOptions{ContentType: "text/html", PublicRead: true})
+
+	info, err := storage.Stat(remoteKey)
 	if err != nil {
-		Log.Error("failed to upload page to S3", "error", err, "key", remoteKey, "template", tplName)
-		return "", "", err
+		Log.Error("failed to stat uploaded video asset", "error", err, "key", remoteKey, "hash", video.HashId)
+		return fail(err)
+	}
+	if info.Size != reader.bytes {
+		Log.Error("uploaded video asset size mismatch", "expected", reader.bytes, "stored", info.Size, "key", remoteKey, "hash", video.HashId)
+		return fail(fmt.Errorf("size mismatch: streamed %d bytes, stored %d", reader.bytes, info.Size))
 	}
-	Log.Info("uploaded page to S3", "template", tplName, "url", s3Url, "hash", video.HashId)
 
-	if conf.UseCloudFront() {
-		if wg != nil {
-			defer wg.Done()
-		}
-		defer func() {
-			<-this.queue
-		}()
-		this.queue <- true
+	asset.S3Key = path
+	asset.MD5 = hex.EncodeToString(reader.md5.Sum(nil))
+	asset.SHA256 = hex.EncodeToString(reader.sha256.Sum(nil))
 
-		remoteKey = fmt.Sprintf("cloudfront/media/%s/%s", video.HashId, tplName)
-		data.MediaEndPoint = fmt.Sprintf("https://%s/%s/cloudfront/media", conf.CloudFrontDomain, conf.PrefixPath)
-		data.WistiaS3JSUrl = fmt.Sprintf("https://%s/%s/cloudfront/media/wistia-s3.min.js", conf.CloudFrontDomain, conf.PrefixPath)
+	Log.Info("uploaded video asset to S3", "url", url, "key", remoteKey, "type", asset.Type, "bytes", reader.bytes, "hash", video.HashId)
 
-		Log.Info("generating CloudFront page from template", "template", tplName, "key", remoteKey, "hash", video.HashId)
-		reader, err := this.BuildTemplate(tplName, &data)
-		if err != nil {
-			Log.Error("failed to build page template for CloudFront", "error", err, "template", tplName, "hash", video.HashId)
-			return "", s3Url, err
-		}
-		_, _, err = storage.PutStream(reader, remoteKey, &UploadOptions{ContentType: "text/html", PublicRead: true})
-		if err != nil {
-			Log.Error("failed to upload page to CloudFront", "error", err, "key", remoteKey, "template", tplName)
-			return "", s3Url, err
-		}
-		cfUrl := fmt.Sprintf("https://%s/%s/cloudfront/media/%s/%s", conf.CloudFrontDomain, conf.PrefixPath, video.HashId, tplName)
-		Log.Info("uploaded page to CloudFront", "template", tplName, "url", cfUrl, "hash", video.HashId)
+	asset.Url = url
+	report.Status = true
+
+	return report
+}
+
+// streamAsset downloads asset straight into storage at remoteKey. A download that stalled is
+// returned as ErrDownloadStalled, so the caller can start over.
+func (this *WistiaHelper) streamAsset(storage IStorage, video *WistiaRespVideo, asset *WistiaRespVideoAsset, remoteKey string, publicRead bool) (*integrityReader, string, string, error) {
+	Log.Info("downloading video asset", "url", asset.Url, "type", asset.Type, "height", asset.Height, "hash", video.HashId)
 
-		return cfUrl, s3Url, nil
+	resp, err := this.client.Download(asset.Url)
+	if err != nil {
+		Log.Error("failed to download video asset", "error", err, "url", asset.Url, "type", asset.Type, "hash", video.HashId)
+		return nil, "", "", err
 	}
+	defer resp.Body.Close()
 
-	return "", s3Url, nil
+	this.stats.begin()
+	defer this.stats.end()
+	reader := newIntegrityReader(this.transfers.Reader(resp.Body, this.stats))
+	path, url, err := storage.PutStream(reader, remoteKey, assetUploadOptions(video.HashId, asset, publicRead))
+	if err != nil && downloadStalled(resp) && !errors.Is(err, ErrDownloadStalled) {
+		err = fmt.Errorf("%w: %v", ErrDownloadStalled, err)
+	}
+	if err != nil {
+		Log.Error("failed to upload video asset to S3", "error", err, "url", asset.Url, "key", remoteKey, "type", asset.Type, "hash", video.HashId)
+	}
+	return reader, path, url, err
+}
+
+// reuseAsset reports whether asset is already in storage unchanged: the previous media record,
+// taken while the media was as updated as now, lists it at remoteKey with the size Wistia
+// reports, and so does the stored object. On a match
+// the asset is updated in place as transferAsset would have done.
+func (this *WistiaHelper) reuseAsset(storage IStorage, storageConf *StorageConfig, asset *WistiaRespVideoAsset,
+	remoteKey string, previous map[string]*WistiaRespVideoAsset) *AssetReport {
+	if asset.FileSize <= 0 {
+		return nil
+	}
+	last, found := previous[remoteKey]
+	if !found || last.FileSize != asset.FileSize {
+		return nil
+	}
+	info, err := storage.Stat(remoteKey)
+	if err != nil || info.Size != int64(asset.FileSize) {
+		return nil
+	}
+
+	asset.S3Key = info.Key
+	asset.Url = storageConf.ObjectURL(info.Key)
+	asset.MD5 = last.MD5
+	asset.SHA256 = last.SHA256
+	return &AssetReport{
+		Type:    asset.Type,
+		Height:  asset.Height,
+		Key:     remoteKey,
+		Bytes:   info.Size,
+		Status:  true,
+		Skipped: true,
+	}
 }
 
-func (this *WistiaHelper) MoveToS3(hashId string, conf *S3Config) (string, string, error) {
+// MoveToS3 copies the assets of a Wistia media selected by policy into storage and publishes
+// index.json, listing only the public assets that were copied. A nil policy uses
+// WistiaConf.AssetPolicy. With previous, the stored media record of an earlier migration, assets
+// whose size is unchanged on Wistia and in storage are not transferred again unless the media was
+// updated on Wistia since; index.json and the
+// pages are rebuilt regardless. Whether index.json and the pages are published when some assets
+// failed is governed by WistiaConf.PublishPolicy; the returned report lists every selected asset
+// either way, and page failures are returned with the index.json ones.
+func (this *WistiaHelper) MoveToS3(hashId string, storageConf *StorageConfig, policy *AssetPolicy, previous *WistiaRespVideo) (*MoveToS3Report, error) {
+	defer lockMedia(hashId)()
+	conf := storageConf.S3
 	video, err := this.GetVideoDetail(hashId)
 	if err != nil {
 		Log.Error("failed to get video details for migration", "error", err, "hash", hashId)
-		return "", "", err
+		return nil, err
+	}
+	if video.IsFailed() {
+		Log.Error("media failed to encode on Wistia, not migrating", "hash", hashId)
+		return nil, fmt.Errorf("%w (hash %s)", ErrMediaFailed, hashId)
+	}
+	if !video.IsReady() {
+		Log.Warn("deferring migration, media not ready on Wistia", "hash", hashId, "status", video.Status, "progress", video.Progress)
+		return &MoveToS3Report{HashId: hashId, Deferred: true}, &MediaNotReadyError{Status: video.Status, Progress: video.Progress}
 	}
 	wg := sync.WaitGroup{}
 
-	storage, err := NewS3Storage(conf)
+	storage, err := GetStorage(storageConf)
 	if err != nil {
-		Log.Error("failed to create S3 storage for migration", "error", err, "hash", hashId)
-		return "", "", err
+		Log.Error("failed to create storage for migration", "error", err, "hash", hashId)
+		return nil, err
 	}
 
-	for _, asset := range *video.Assets {
-		wg.Add(1)
-
-		go func(asset *WistiaRespVideoAsset, wg *sync.WaitGroup) {
-			defer wg.Done()
-			defer func() {
-				<-this.queue
-			}()
-			this.queue <- true
-
-			Log.Info("downloading video asset", "url", asset.Url, "type", asset.Type, "height", asset.Height, "hash", video.HashId)
+	// a private bucket is only reachable through signed URLs, so refuse to migrate without a key pair
+	var signer *CloudFrontSigner
+	if storageConf.Private() {
+		signer, err = NewCloudFrontSigner(conf)
+		if err != nil {
+			Log.Error("private bucket without usable CloudFront signing", "error", err, "hash", hashId)
+			return nil, err
+		}
+	}
 
-			req, err := http.NewRequest( "GET", asset.Url, nil)
-			client := &http.Client{
-				Timeout:   60 * time.Second,
-			}
-			resp, err := client.Do(req)
-			if err != nil {
-				Log.Error("failed to download video asset", "error", err, "url", asset.Url, "type", asset.Type, "hash", video.HashId)
-				return
+	if policy == nil {
+		policy = this.Conf.AssetPolicy
+	}
+	if video.Assets == nil {
+		video.Assets = &AssetList{}
+	}
+	selected := video.Assets.Select(policy)
+	public := make(AssetList, 0, len(selected))
+	for _, asset := range selected {
+		if !policy.IsCold(asset) {
+			public = append(public, asset)
+		}
+	}
+	if len(selected) < len(*video.Assets) {
+		Log.Info("asset policy skips some assets", "hash", hashId, "selected", len(selected), "total", len(*video.Assets))
+	}
+	// pages and index.json only ever see the public selection
+	video.Assets = &public
+
+	// a media updated on Wistia since may have re-encoded assets of the same size, so only the
+	// record of an unchanged media lets assets be reused
+	previousAssets := make(map[string]*WistiaRespVideoAsset)
+	if previous != nil && len(video.Updated) > 0 && previous.Updated == video.Updated {
+		if previous.Assets != nil {
+			for _, asset := range *previous.Assets {
+				previousAssets[policy.RemoteKey(hashId, asset)] = asset
 			}
-			defer resp.Body.Close()
+		}
+		for _, cold := range previous.ColdAssets {
+			previousAssets[cold.Key] = &WistiaRespVideoAsset{Type: cold.Type, Height: cold.Height, FileSize: cold.FileSize, MD5: cold.MD5, SHA256: cold.SHA256}
+		}
+	} else if previous != nil {
+		Log.Info("media updated on Wistia since the last migration, transferring every asset", "hash", hashId, "previous", previous.Updated, "updated", video.Updated)
+	}
 
-			extension := ".bin"
-			extList, err := mime.ExtensionsByType(asset.ContentType)
-			if err == nil && len(extList) > 0 {
-				extension = extList[0]
-			}
-			if asset.ContentType == "image/jpg" {
-				extension = ".jpg"
-			}
+	report := &MoveToS3Report{
+		HashId: hashId,
+		Assets: make([]*AssetReport, len(selected)),
+	}
 
-			remoteKey := fmt.Sprintf("media/%s/%d%s", video.HashId, asset.Height, extension)
-			if asset.Type == "StillImageFile" {
-				remoteKey = fmt.Sprintf("media/%s/cover%s", video.HashId, extension)
-			}
-			if asset.Type == "OriginalFile" {
-				remoteKey = fmt.Sprintf("media/%s/original%s", video.HashId, extension)
-			}
+	for i, asset := range selected {
+		wg.Add(1)
 
-			path, url, err := storage.PutStream(resp.Body, remoteKey, &UploadOptions{ContentType: asset.ContentType, PublicRead: true})
-			if err != nil {
-				Log.Error("failed to upload video asset to S3", "error", err, "url", asset.Url, "key", remoteKey, "type", asset.Type, "hash", video.HashId)
+		go func(asset *WistiaRespVideoAsset, index int, wg *sync.WaitGroup) {
+			defer wg.Done()
+
+			remoteKey := policy.RemoteKey(hashId, asset)
+			if reused := this.reuseAsset(storage, storageConf, asset, remoteKey, previousAssets); reused != nil {
+				Log.Info("asset unchanged, skipping transfer", "key", remoteKey, "type", asset.Type, "bytes", reused.Bytes, "hash", hashId)
+				report.Assets[index] = reused
 				return
 			}
 
-			asset.S3Key = path
+			// admitted by size, so large originals do not hold back small assets
+			release := this.transfers.Acquire(int64(asset.FileSize))
+			defer release()
+			report.Assets[index] = this.transferAssetTo(storage, video, asset, remoteKey, !policy.IsCold(asset))
+		}(asset, i, &wg)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			<-this.queue
+		}()
+		this.queue <- true
 
-			Log.Info("uploaded video asset to S3", "url", url, "key", remoteKey, "type", asset.Type, "hash", video.HashId)
+		report.Captions = this.transferCaptions(storage, storageConf, video)
+	}()
 
-			asset.Url = url
+	wg.Wait()
 
-		}(asset, &wg)
+	for i, asset := range selected {
+		if policy.IsCold(asset) && report.Assets[i].Status {
+			report.ColdAssets = append(report.ColdAssets, &ColdAsset{
+				Type:     asset.Type,
+				Height:   asset.Height,
+				FileSize: asset.FileSize,
+				Key:      report.Assets[i].Key,
+				MD5:      asset.MD5,
+				SHA256:   asset.SHA256,
+			})
+		}
 	}
 
-	counter := 2
-	if conf.UseCloudFront() {
-		counter = 4
+	failed := report.FailedAssets()
+	publish := true
+	if failed > 0 {
+		switch this.Conf.PublishPolicy {
+		case PUBLISH_POLICY_ALWAYS:
+			Log.Warn("publishing index.json despite failed assets", "hash", hashId, "failed", failed, "policy", this.Conf.PublishPolicy)
+		case PUBLISH_POLICY_PARTIAL:
+			Log.Warn("publishing index.json without failed assets", "hash", hashId, "failed", failed, "policy", this.Conf.PublishPolicy)
+			copied := make(AssetList, 0, len(public))
+			for i, asset := range selected {
+				if report.Assets[i].Status && !policy.IsCold(asset) {
+					copied = append(copied, asset)
+				}
+			}
+			video.Assets = &copied
+		default:
+			Log.Error("skipping index.json publish, some assets failed", "hash", hashId, "failed", failed, "policy", this.Conf.PublishPolicy)
+			publish = false
+		}
 	}
-	wg.Add(counter)
-	go this.UploadDemoPage("index.html", video, conf, &wg)
-	go this.UploadDemoPage("demo.html", video, conf, &wg)
 
-	wg.Wait()
+	if !publish {
+		return report, nil
+	}
+	// pages list the assets, so they are rendered once the transfers settled and from the same
+	// list as index.json
+	var pagesErr error
+	report.Pages, pagesErr = this.PublishPages(video, storageConf)
+	if pagesErr != nil {
+		Log.Error("failed to publish pages", "error", pagesErr, "hash", video.HashId)
+	}
 
-	// S3 endpoint
-	Log.Debug("uploading S3 index.json", "hash", video.HashId)
+	Log.Debug("publishing index.json", "hash", video.HashId)
 	remoteKey := fmt.Sprintf("media/%s/index.json", video.HashId)
-	bin, err := json.Marshal(video)
-	if err != nil {
-		Log.Error("failed to marshal video metadata for S3 index", "error", err, "hash", video.HashId)
-		return "", "", err
+	report.Targets = publishToTargets(storage, storageConf, remoteKey, &UploadOptions{ContentType: "application/json", PublicRead: true, Kind: UPLOAD_KIND_INDEX, Metadata: map[string]string{"wistia-hash": video.HashId}},
+		func(target *PublicationTarget) (io.Reader, error) {
+			linked, err := targetVideo(video, target, storageConf, signer)
+			if err != nil {
+				return nil, err
+			}
+			bin, err := json.Marshal(linked)
+			if err != nil {
+				return nil, err
+			}
+			return bytes.NewReader(bin), nil
+		})
+	for _, target := range report.Targets {
+		report.Published = report.Published || len(target.Error) <= 0
 	}
-	_, s3Url, err := storage.PutContent(string(bin), remoteKey, &UploadOptions{ContentType: "application/json", PublicRead: true})
-	if err != nil {
-		Log.Error("failed to upload S3 index.json", "error", err, "key", remoteKey, "hash", video.HashId)
-		return "", "", err
+	report.S3 = targetURL(report.Targets, PUBLICATION_TARGET_S3)
+	report.CloudFront = targetURL(report.Targets, PUBLICATION_TARGET_CLOUDFRONT)
+
+	purgeTargets(storageConf, this.taskId, fmt.Sprintf("media/%s/*", hashId))
+
+	if err := targetsError(report.Targets); err != nil {
+		Log.Error("failed to publish index.json", "error", err, "hash", video.HashId)
+		return report, errors.Join(err, pagesErr)
 	}
-	Log.Debug("uploaded S3 index.json", "key", remoteKey, "url", s3Url, "hash", video.HashId)
+	return report, pagesErr
+}
 
-	cloudFrontUrl := ""
-	if conf.UseCloudFront() {
-		Log.Debug("uploading CloudFront index.json", "hash", video.HashId)
-		for _, asset := range *video.Assets {
-			asset.Url = fmt.Sprintf("https://%s/%s", conf.CloudFrontDomain, strings.TrimLeft(asset.S3Key, "/"))
+// targetVideo returns a copy of video for the index.json of target: assets and captions are
+// linked through the target and, for a signed target, signed.
+func targetVideo(video *WistiaRespVideo, target *PublicationTarget, storageConf *StorageConfig, signer *CloudFrontSigner) (*WistiaRespVideo, error) {
+	linked := linkTargetVideo(video, target, storageConf)
+	if target.Signed {
+		if signer == nil {
+			return nil, fmt.Errorf("target %s is signed but CloudFront signing is not configured", target.Name)
 		}
-		bin, err := json.Marshal(video)
-		if err != nil {
-			Log.Error("failed to marshal video metadata for CloudFront index", "error", err, "hash", video.HashId)
-			return "", s3Url, err
+		link := func(key string) string {
+			return target.URL(storageConf, key)
 		}
-		remoteKey = fmt.Sprintf("cloudfront/media/%s/index.json", video.HashId)
-		path, _, err := storage.PutContent(string(bin), remoteKey, &UploadOptions{ContentType: "application/json", PublicRead: true})
-		if err != nil {
-			Log.Error("failed to upload CloudFront index.json", "error", err, "key", remoteKey, "hash", video.HashId)
-			return "", s3Url, err
+		if err := signer.signVideoVia(linked, link, time.Now().Add(storageConf.S3.SignedURLExpiry())); err != nil {
+			return nil, err
 		}
-		cloudFrontUrl = fmt.Sprintf("https://%s/%s", conf.CloudFrontDomain, strings.TrimLeft(path, "/"))
-		Log.Debug("uploaded CloudFront index.json", "key", remoteKey, "url", cloudFrontUrl, "hash", video.HashId)
-
-		cfHelper := NewCloudFrontHelper(conf)
-		if cfHelper != nil {
-			flushPaths := []string{fmt.Sprintf("/%s/cloudfront/media/%s/*", conf.PrefixPath, hashId)}
-			if err := cfHelper.InvalidatePaths(flushPaths); err != nil {
-				Log.Warn("CloudFront invalidation failed for video", "error", err, "hash", hashId)
+	}
+	return linked, nil
+}
+
+// linkTargetVideo returns a copy of video with its assets and captions linked through target.
+// Records read back from index.json have no S3Key, their assets are linked by their media/ key.
+func linkTargetVideo(video *WistiaRespVideo, target *PublicationTarget, storageConf *StorageConfig) *WistiaRespVideo {
+	linked := *video
+	if video.Assets != nil {
+		assets := make(AssetList, 0, len(*video.Assets))
+		for _, asset := range *video.Assets {
+			copied := *asset
+			if len(target.BaseURL) > 0 {
+				if len(copied.S3Key) > 0 {
+					copied.Url = target.ObjectURL(storageConf, copied.S3Key)
+				} else {
+					copied.Url = target.URL(storageConf, assetRemoteKey(video.HashId, &copied))
+				}
 			}
+			assets = append(assets, &copied)
 		}
+		linked.Assets = &assets
 	}
+	if video.Captions != nil {
+		linked.Captions = make([]*VideoCaption, 0, len(video.Captions))
+		for _, caption := range video.Captions {
+			copied := *caption
+			if url, ok := caption.Urls[target.Name]; ok {
+				copied.Url = url
+			} else {
+				copied.Url = target.URL(storageConf, target.Key(captionRemoteKey(video.HashId, caption.Language)))
+			}
+			linked.Captions = append(linked.Captions, &copied)
+		}
+	}
+	return &linked
+}
 
-	return cloudFrontUrl, s3Url, nil
+// GenerateVideoInfoURL returns the CloudFront and S3 URLs of index.json, see VideoInfoURLs.
+func (this *WistiaHelper) GenerateVideoInfoURL(hashId string, storageConf *StorageConfig) (string, string) {
+	urls := this.VideoInfoURLs(hashId, storageConf)
+	return urls[PUBLICATION_TARGET_CLOUDFRONT], urls[PUBLICATION_TARGET_S3]
 }
 
-func (this *WistiaHelper) GenerateVideoInfoURL(hashId string, conf *S3Config) (string, string) {
-	return fmt.Sprintf("https://%s/%s/cloudfront/media/%s/index.json", conf.CloudFrontDomain, conf.PrefixPath, hashId),
-		fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s/media/%s/index.json", conf.Region, conf.Bucket, conf.PrefixPath, hashId)
+// VideoInfoURLs returns the index.json URL of hashId on each publication target, signed on
+// signed targets.
+func (this *WistiaHelper) VideoInfoURLs(hashId string, storageConf *StorageConfig) map[string]string {
+	key := fmt.Sprintf("media/%s/index.json", hashId)
+	urls := make(map[string]string)
+	var signer *CloudFrontSigner
+	for _, target := range storageConf.PublicationTargets() {
+		url := target.URL(storageConf, target.Key(key))
+		if target.Signed {
+			if signer == nil {
+				signer, _ = NewCloudFrontSigner(storageConf.S3)
+			}
+			if signer != nil {
+				if signed, err := signer.signedURL(url, time.Now().Add(storageConf.S3.SignedURLExpiry())); err == nil {
+					url = signed
+				}
+			}
+		}
+		urls[target.Name] = url
+	}
+	return urls
 }
@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MigrationCheck is the outcome of verifying one media's storage copy before archiving it.
+type MigrationCheck struct {
+	HashId   string   `json:"hash"`
+	Name     string   `json:"name"`
+	Verified bool     `json:"verified"`
+	Problems []string `json:"problems,omitempty"`
+	// Skipped lists the assets left out by the asset policy, accepted with allowSkipped.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// VerifyMigration checks that every asset Wistia currently lists for hashId is in storage with the
+// size Wistia reports, and that index.json is published. With allowSkipped, assets the asset policy
+// leaves out are reported as skipped instead of failing the check; the original is always required.
+func (this *WistiaHelper) VerifyMigration(hashId string, storage IStorage, allowSkipped bool) *MigrationCheck {
+	check := &MigrationCheck{
+		HashId:   hashId,
+		Problems: make([]string, 0),
+	}
+
+	video, err := this.GetVideoDetail(hashId)
+	if err != nil {
+		check.Problems = append(check.Problems, fmt.Sprintf("failed to get media from Wistia: %v", err))
+		return check
+	}
+	check.Name = video.Name
+
+	if video.Archived {
+		check.Problems = append(check.Problems, "already archived on Wistia")
+	}
+
+	if video.Assets == nil || len(*video.Assets) <= 0 {
+		check.Problems = append(check.Problems, "Wistia lists no assets")
+	} else {
+		selected := make(map[*WistiaRespVideoAsset]bool)
+		for _, asset := range video.Assets.Select(this.Conf.AssetPolicy) {
+			selected[asset] = true
+		}
+		hasOriginal := false
+		for _, asset := range *video.Assets {
+			if asset.Type == "OriginalFile" {
+				hasOriginal = true
+			}
+			key, info, err := this.storedAsset(hashId, asset, storage)
+			if errors.Is(err, ErrObjectNotFound) {
+				if allowSkipped && !selected[asset] && asset.Type != "OriginalFile" {
+					check.Skipped = append(check.Skipped, key)
+					continue
+				}
+				check.Problems = append(check.Problems, fmt.Sprintf("%s missing", key))
+				continue
+			}
+			if err != nil {
+				check.Problems = append(check.Problems, fmt.Sprintf("%s: %v", key, err))
+				continue
+			}
+			if asset.FileSize > 0 && info.Size != int64(asset.FileSize) {
+				check.Problems = append(check.Problems, fmt.Sprintf("%s size %d, Wistia reports %d", key, info.Size, asset.FileSize))
+			}
+		}
+		if !hasOriginal {
+			check.Problems = append(check.Problems, "Wistia lists no OriginalFile")
+		}
+	}
+
+	indexKey := fmt.Sprintf("media/%s/index.json", hashId)
+	exists, err := storage.Exists(indexKey)
+	if err != nil {
+		check.Problems = append(check.Problems, fmt.Sprintf("%s: %v", indexKey, err))
+	} else if !exists {
+		check.Problems = append(check.Problems, fmt.Sprintf("%s not published", indexKey))
+	}
+
+	check.Verified = len(check.Problems) <= 0
+	return check
+}
+
+// storedAsset stats asset where the asset policy puts it, then at its public or cold
+// counterpart, since the copy may predate a policy change.
+func (this *WistiaHelper) storedAsset(hashId string, asset *WistiaRespVideoAsset, storage IStorage) (string, *ObjectInfo, error) {
+	key := this.Conf.AssetPolicy.RemoteKey(hashId, asset)
+	info, err := storage.Stat(key)
+	if !errors.Is(err, ErrObjectNotFound) {
+		return key, info, err
+	}
+	other := assetRemoteKey(hashId, asset)
+	if cold := this.Conf.AssetPolicy; other == key && cold != nil && len(strings.Trim(cold.ColdPrefix, "/")) > 0 {
+		other = fmt.Sprintf("%s/%s", strings.Trim(cold.ColdPrefix, "/"), key)
+	}
+	if other == key {
+		return key, nil, err
+	}
+	if info, err := storage.Stat(other); !errors.Is(err, ErrObjectNotFound) {
+		return other, info, err
+	}
+	return key, nil, err
+}
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// WistiaRespCaption is one entry of the Wistia captions index, Text holds SRT.
+type WistiaRespCaption struct {
+	Language    string `json:"language"`
+	EnglishName string `json:"english_name"`
+	NativeName  string `json:"native_name"`
+	Text        string `json:"text"`
+}
+
+// VideoCaption is a migrated caption track as listed in index.json.
+type VideoCaption struct {
+	Language    string `json:"language"`
+	EnglishName string `json:"english_name"`
+	NativeName  string `json:"native_name"`
+	Url         string `json:"url"`
+	// Urls is the caption's URL on each publication target.
+	Urls map[string]string `json:"-"`
+}
+
+func (this *WistiaHelper) GetCaptions(hashId string) ([]*WistiaRespCaption, error) {
+	req, err := http.NewRequest("GET", this.Conf.APIURL(fmt.Sprintf("medias/%s/captions.json", hashId)), nil)
+	if err != nil {
+		Log.Error("failed to create Wistia captions request", "error", err, "hash", hashId)
+		return nil, err
+	}
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		Log.Error("failed to execute Wistia captions request", "error", err, "hash", hashId)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	captions := make([]*WistiaRespCaption, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&captions); err != nil {
+		Log.Error("failed to decode Wistia captions response", "error", err, "hash", hashId)
+		return nil, err
+	}
+	return captions, nil
+}
+
+var srtTimingComma = regexp.MustCompile(`(\d{2}:\d{2}:\d{2}),(\d{3})`)
+
+// srtToVTT converts Wistia's SRT caption text to WebVTT; text that already is VTT is kept.
+func srtToVTT(text string) string {
+	text = strings.ReplaceAll(strings.TrimPrefix(text, "\ufeff"), "\r\n", "\n")
+	if strings.HasPrefix(text, "WEBVTT") {
+		return text
+	}
+
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "-->") {
+			lines[i] = srtTimingComma.ReplaceAllString(line, "$1.$2")
+		}
+	}
+	return "WEBVTT\n\n" + strings.Join(lines, "\n") + "\n"
+}
+
+var captionLanguageUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+func captionRemoteKey(hashId string, language string) string {
+	return fmt.Sprintf("media/%s/captions/%s.vtt", hashId, captionLanguageUnsafe.ReplaceAllString(language, "_"))
+}
+
+// transferCaptions writes every caption language of video to every publication target and sets
+// video.Captions to the ones that were stored. A failure to list captions is reported as a
+// single entry.
+func (this *WistiaHelper) transferCaptions(storage IStorage, storageConf *StorageConfig, video *WistiaRespVideo) []*AssetReport {
+	captions, err := this.GetCaptions(video.HashId)
+	if err != nil {
+		return []*AssetReport{{Type: "Caption", Error: err.Error()}}
+	}
+
+	reports := make([]*AssetReport, 0, len(captions))
+	migrated := make([]*VideoCaption, 0, len(captions))
+	for _, caption := range captions {
+		report := &AssetReport{
+			Type:     "Caption",
+			Language: caption.Language,
+			Key:      captionRemoteKey(video.HashId, caption.Language),
+		}
+		reports = append(reports, report)
+
+		content := srtToVTT(caption.Text)
+		opt := &UploadOptions{
+			ContentType: "text/vtt",
+			PublicRead:  true,
+			Kind:        UPLOAD_KIND_CAPTION,
+			Metadata: map[string]string{
+				"wistia-hash":     video.HashId,
+				"wistia-language": caption.Language,
+			},
+		}
+		targets := publishContent(storage, storageConf, report.Key, content, opt)
+		if err := targetsError(targets); err != nil {
+			Log.Error("failed to upload caption", "error", err, "key", report.Key, "language", caption.Language, "hash", video.HashId)
+			report.Error = err.Error()
+			continue
+		}
+		Log.Info("uploaded caption", "key", report.Key, "language", caption.Language, "hash", video.HashId)
+
+		migratedCaption := &VideoCaption{
+			Language:    caption.Language,
+			EnglishName: caption.EnglishName,
+			NativeName:  caption.NativeName,
+			Url:         targetURL(targets, PUBLICATION_TARGET_S3),
+			Urls:        make(map[string]string),
+		}
+		for _, target := range targets {
+			migratedCaption.Urls[target.Target] = target.Url
+		}
+
+		report.Bytes = int64(len(content))
+		report.Status = true
+		migrated = append(migrated, migratedCaption)
+	}
+
+	video.Captions = migrated
+	return reports
+}
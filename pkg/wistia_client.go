@@ -0,0 +1,280 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// downloadIdleTimeout fails an asset download when no byte arrives for this long.
+const downloadIdleTimeout = 60 * time.Second
+
+// ErrDownloadStalled is returned by asset download bodies that stopped receiving bytes; the
+// download can be retried.
+var ErrDownloadStalled = errors.New("asset download stalled")
+
+// WistiaAPIError is returned when Wistia answers with a non-2xx status after retries.
+type WistiaAPIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *WistiaAPIError) Error() string {
+	return fmt.Sprintf("Wistia API returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// requestBudget spaces requests evenly so no more than RequestsPerMinute are sent.
+type requestBudget struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRequestBudget(perMinute int) *requestBudget {
+	budget := &requestBudget{}
+	if perMinute > 0 {
+		budget.interval = time.Minute / time.Duration(perMinute)
+	}
+	return budget
+}
+
+func (this *requestBudget) wait() {
+	this.mu.Lock()
+	now := time.Now()
+	if this.next.Before(now) {
+		this.next = now
+	}
+	delay := this.next.Sub(now)
+	this.next = this.next.Add(this.interval)
+	this.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// pause holds back every following request, used when Wistia answers 429.
+func (this *requestBudget) pause(d time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if until := time.Now().Add(d); until.After(this.next) {
+		this.next = until
+	}
+}
+
+// WistiaClient wraps HTTP access to Wistia with status checking, exponential backoff,
+// Retry-After handling and a per-minute request budget shared by all helpers of a config.
+type WistiaClient struct {
+	Conf     *WistiaConf
+	api      *http.Client
+	download *http.Client
+	budget   *requestBudget
+	// backoff base and cap, overridable in tests
+	minDelay time.Duration
+	maxDelay time.Duration
+	// idleTimeout bounds the wait for the next bytes of a download body
+	idleTimeout time.Duration
+}
+
+var (
+	wistiaClients   = make(map[*WistiaConf]*WistiaClient)
+	wistiaClientsMu sync.Mutex
+)
+
+// GetWistiaClient returns the client shared by every WistiaHelper built from conf,
+// so the request budget is enforced across concurrent tasks.
+func GetWistiaClient(conf *WistiaConf) *WistiaClient {
+	wistiaClientsMu.Lock()
+	defer wistiaClientsMu.Unlock()
+
+	if client, ok := wistiaClients[conf]; ok {
+		return client
+	}
+	client := NewWistiaClient(conf)
+	wistiaClients[conf] = client
+	return client
+}
+
+func NewWistiaClient(conf *WistiaConf) *WistiaClient {
+	return &WistiaClient{
+		Conf: conf,
+		api: &http.Client{
+			Timeout: 60 * time.Second,
+		},
+		// asset downloads can take far longer than an API call, only bound the wait for headers
+		download: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 60 * time.Second,
+				MaxIdleConnsPerHost:   conf.WorkerLimit,
+			},
+		},
+		budget:      newRequestBudget(conf.RequestsPerMinute),
+		minDelay:    time.Second,
+		maxDelay:    time.Minute,
+		idleTimeout: downloadIdleTimeout,
+	}
+}
+
+// Do sends an authorised Wistia API request. The returned response always has a 2xx
+// status; anything else is retried when transient and otherwise returned as *WistiaAPIError.
+func (this *WistiaClient) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", this.Conf.WistiaApiKey))
+	return this.do(this.api, req, true)
+}
+
+// Download fetches an asset file with the same retry policy as API calls but outside
+// the request budget, since asset files are served by Wistia's CDN.
+func (this *WistiaClient) Download(url string) (*http.Response, error) {
+	return this.DownloadFrom(url, 0)
+}
+
+// DownloadFrom is Download resuming at offset with a Range request. Callers must check for
+// 206 Partial Content, a server ignoring the range answers 200 with the whole file. Reading
+// the body fails with ErrDownloadStalled once no byte arrived for the client's idle timeout.
+func (this *WistiaClient) DownloadFrom(url string, offset int64) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := this.do(this.download, req, false)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = newIdleTimeoutBody(resp.Body, this.idleTimeout, cancel)
+	return resp, nil
+}
+
+// idleTimeoutBody cancels its request when a Read waits longer than timeout, so a stalled CDN
+// stream fails instead of blocking forever. Only time spent in Read counts, a slow consumer does
+// not trip it.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutBody {
+	this := &idleTimeoutBody{ReadCloser: body, timeout: timeout, cancel: cancel}
+	this.timer = time.AfterFunc(timeout, func() {
+		this.stalled.Store(true)
+		cancel()
+	})
+	this.timer.Stop()
+	return this
+}
+
+func (this *idleTimeoutBody) Read(p []byte) (int, error) {
+	this.timer.Reset(this.timeout)
+	n, err := this.ReadCloser.Read(p)
+	this.timer.Stop()
+	if err != nil && this.stalled.Load() {
+		err = fmt.Errorf("%w: no data for %s", ErrDownloadStalled, this.timeout)
+	}
+	return n, err
+}
+
+func (this *idleTimeoutBody) Close() error {
+	this.timer.Stop()
+	defer this.cancel()
+	return this.ReadCloser.Close()
+}
+
+// downloadStalled reports whether the body of a DownloadFrom response stalled. Storage
+// backends do not always wrap read errors, so this is checked instead of the returned error.
+func downloadStalled(resp *http.Response) bool {
+	body, ok := resp.Body.(*idleTimeoutBody)
+	return ok && body.stalled.Load()
+}
+
+func (this *WistiaClient) do(client *http.Client, req *http.Request, budgeted bool) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		if budgeted {
+			this.budget.wait()
+		}
+
+		var retryAfter time.Duration
+		resp, err := client.Do(req.Clone(req.Context()))
+		if err != nil {
+			lastErr = err
+		} else if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		} else {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			lastErr = &WistiaAPIError{StatusCode: resp.StatusCode, Body: string(body)}
+			if !isRetryableStatus(resp.StatusCode) {
+				return nil, lastErr
+			}
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			if resp.StatusCode == http.StatusTooManyRequests && budgeted {
+				this.budget.pause(retryAfter)
+			}
+		}
+
+		if attempt >= this.Conf.MaxRetries {
+			return nil, lastErr
+		}
+
+		delay := this.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		Log.Warn("retrying Wistia request", "method", req.Method, "url", req.URL.Redacted(), "attempt", attempt+1, "delay", delay, "error", lastErr)
+		time.Sleep(delay)
+	}
+}
+
+func (this *WistiaClient) backoff(attempt int) time.Duration {
+	delay := this.minDelay << uint(attempt)
+	if delay <= 0 || delay > this.maxDelay {
+		delay = this.maxDelay
+	}
+	// add up to 50% jitter so parallel workers don't retry in lockstep
+	if half := int64(delay / 2); half > 0 {
+		delay += time.Duration(rand.Int63n(half))
+	}
+	return delay
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusRequestTimeout || status >= 500
+}
+
+// parseRetryAfter accepts both forms allowed by RFC 9110: delay-seconds and an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if len(value) <= 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getTestWistiaClient(conf *WistiaConf) *WistiaClient {
+	client := NewWistiaClient(conf)
+	client.minDelay = time.Millisecond
+	client.maxDelay = 10 * time.Millisecond
+	return client
+}
+
+func TestWistiaClient_RetryAfter(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("missing bearer token, got %q", r.Header.Get("Authorization"))
+		}
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client := getTestWistiaClient(&WistiaConf{WistiaApiKey: "secret", MaxRetries: 2})
+	req, _ := http.NewRequest("GET", server.URL+"/medias/abc123.json", nil)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Retry-After not honoured, retried after %s", elapsed)
+	}
+
+	t.Log("PASS")
+}
+
+func TestWistiaClient_StatusChecking(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := getTestWistiaClient(&WistiaConf{MaxRetries: 3})
+
+	_, err := client.Download(server.URL + "/missing")
+	var apiErr *WistiaAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 WistiaAPIError, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("404 must not be retried, got %d calls", calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	_, err = client.Download(server.URL + "/flaky")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502 WistiaAPIError, got %v", err)
+	}
+	if calls != 4 {
+		t.Errorf("expected 1 attempt + 3 retries, got %d calls", calls)
+	}
+
+	t.Log("PASS")
+}
+
+func TestWistiaClient_RequestBudget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	// 600/min spaces requests 100ms apart
+	client := getTestWistiaClient(&WistiaConf{RequestsPerMinute: 600})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", server.URL+"/medias.json", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected requests to be spaced by the budget, took %s", elapsed)
+	}
+
+	if GetWistiaClient(client.Conf) != GetWistiaClient(client.Conf) {
+		t.Errorf("helpers sharing a config must share a client")
+	}
+
+	// a negative budget disables it
+	unlimited := (&WistiaConf{RequestsPerMinute: -1}).MarginWithENV()
+	if unlimited.RequestsPerMinute >= 0 || newRequestBudget(unlimited.RequestsPerMinute).interval != 0 {
+		t.Errorf("a negative budget must disable it, got %d", unlimited.RequestsPerMinute)
+	}
+
+	t.Log("PASS")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("3"); d != 3*time.Second {
+		t.Errorf("expected 3s, got %s", d)
+	}
+	if d := parseRetryAfter(""); d != 0 {
+		t.Errorf("expected 0, got %s", d)
+	}
+	future := time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(future); d <= 20*time.Second || d > 30*time.Second {
+		t.Errorf("unexpected delay %s for HTTP date", d)
+	}
+}
@@ -0,0 +1,340 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// FakeWistia serves the subset of the Wistia Data API used by WistiaHelper from fixture files:
+//
+//	<FixtureDir>/medias/<hash>.json  media detail as returned by /medias/<hash>.json
+//	<FixtureDir>/projects/<hash>.json project detail whose "medias" lists media hashes in order
+//	<FixtureDir>/captions/<hash>.json captions index as returned by /medias/<hash>/captions.json
+//	<FixtureDir>/assets/...          asset files; relative asset and thumbnail urls in the
+//	                                 media fixtures are resolved against this directory
+//
+// Missing fileSize values are filled from the fixture file so size verification applies.
+type FakeWistia struct {
+	FixtureDir string
+	mu         sync.Mutex
+	archived   map[string]bool
+	statuses   map[string]string
+}
+
+func NewFakeWistia(fixtureDir string) *FakeWistia {
+	return &FakeWistia{
+		FixtureDir: fixtureDir,
+		archived:   make(map[string]bool),
+		statuses:   make(map[string]string),
+	}
+}
+
+// SetProcessing makes the fake report hashId as still encoding until it is set back to false.
+func (this *FakeWistia) SetProcessing(hashId string, processing bool) {
+	status := ""
+	if processing {
+		status = "processing"
+	}
+	this.SetStatus(hashId, status)
+}
+
+// SetStatus overrides the status the fake reports for hashId, "" restores the fixture's.
+func (this *FakeWistia) SetStatus(hashId string, status string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if len(status) <= 0 {
+		delete(this.statuses, hashId)
+		return
+	}
+	this.statuses[hashId] = status
+}
+
+func (this *FakeWistia) Handler() http.Handler {
+	r := mux.NewRouter()
+	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/",
+		http.FileServer(http.Dir(filepath.Join(this.FixtureDir, "assets")))))
+	api := r.NewRoute().Subrouter()
+	api.Use(this.requireToken)
+	api.HandleFunc("/medias.json", this.listMedias).Methods("GET")
+	api.HandleFunc("/medias/archive.json", this.archiveMedias).Methods("PUT")
+	api.HandleFunc("/medias/{hash:[0-9A-Za-z]+}.json", this.showMedia).Methods("GET")
+	api.HandleFunc("/medias/{hash:[0-9A-Za-z]+}/captions.json", this.listCaptions).Methods("GET")
+	api.HandleFunc("/projects/{hash:[0-9A-Za-z]+}.json", this.showProject).Methods("GET")
+	return r
+}
+
+func (this *FakeWistia) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			this.writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing bearer token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (this *FakeWistia) writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func (this *FakeWistia) loadMedia(hashId string, baseURL string) (map[string]interface{}, error) {
+	bin, err := os.ReadFile(filepath.Join(this.FixtureDir, "medias", hashId+".json"))
+	if err != nil {
+		return nil, err
+	}
+	media := make(map[string]interface{})
+	if err := json.Unmarshal(bin, &media); err != nil {
+		return nil, err
+	}
+
+	if thumbnail, ok := media["thumbnail"].(map[string]interface{}); ok {
+		if u, ok := thumbnail["url"].(string); ok {
+			thumbnail["url"], _ = this.resolveAsset(u, baseURL)
+		}
+	}
+	if assets, ok := media["assets"].([]interface{}); ok {
+		for _, row := range assets {
+			asset, ok := row.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			u, _ := asset["url"].(string)
+			resolved, size := this.resolveAsset(u, baseURL)
+			asset["url"] = resolved
+			if _, ok := asset["fileSize"]; !ok && size >= 0 {
+				asset["fileSize"] = size
+			}
+		}
+	}
+
+	this.mu.Lock()
+	if this.archived[hashId] {
+		media["archived"] = true
+	}
+	if status, ok := this.statuses[hashId]; ok {
+		media["status"] = status
+		if status == "processing" {
+			media["progress"] = 0.5
+		}
+	}
+	this.mu.Unlock()
+
+	return media, nil
+}
+
+// resolveAsset turns a fixture-relative url into one served by this fake and returns the
+// fixture file size, or -1 when the url is absolute or the file is missing.
+func (this *FakeWistia) resolveAsset(u string, baseURL string) (string, int64) {
+	if len(u) <= 0 || strings.Contains(u, "://") {
+		return u, -1
+	}
+	info, err := os.Stat(filepath.Join(this.FixtureDir, "assets", filepath.FromSlash(u)))
+	if err != nil {
+		return fmt.Sprintf("%s/assets/%s", baseURL, u), -1
+	}
+	return fmt.Sprintf("%s/assets/%s", baseURL, u), info.Size()
+}
+
+func (this *FakeWistia) hashList() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(this.FixtureDir, "medias", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, len(files))
+	for _, file := range files {
+		list = append(list, strings.TrimSuffix(filepath.Base(file), ".json"))
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+func requestBaseURL(r *http.Request) string {
+	return fmt.Sprintf("http://%s", r.Host)
+}
+
+func (this *FakeWistia) showMedia(w http.ResponseWriter, r *http.Request) {
+	hashId := mux.Vars(r)["hash"]
+	media, err := this.loadMedia(hashId, requestBaseURL(r))
+	if os.IsNotExist(err) {
+		this.writeJSON(w, http.StatusNotFound, map[string]string{"error": "Media not found"})
+		return
+	}
+	if err != nil {
+		this.writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	this.writeJSON(w, http.StatusOK, media)
+}
+
+// listMedias supports page/per_page, the hashed_ids[] filter and sort_by (name, created,
+// updated) with sort_direction 0 for descending, like the real list endpoint.
+func (this *FakeWistia) listMedias(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page <= 0 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(query.Get("per_page"))
+	if perPage <= 0 {
+		perPage = 100
+	}
+
+	hashList, err := this.hashList()
+	if err != nil {
+		this.writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if filter := query["hashed_ids[]"]; len(filter) > 0 {
+		wanted := make(map[string]bool)
+		for _, hashId := range filter {
+			wanted[hashId] = true
+		}
+		filtered := make([]string, 0, len(filter))
+		for _, hashId := range hashList {
+			if wanted[hashId] {
+				filtered = append(filtered, hashId)
+			}
+		}
+		hashList = filtered
+	}
+
+	medias := make([]map[string]interface{}, 0, len(hashList))
+	for _, hashId := range hashList {
+		media, err := this.loadMedia(hashId, requestBaseURL(r))
+		if err != nil {
+			this.writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		medias = append(medias, media)
+	}
+
+	if sortBy := query.Get("sort_by"); len(sortBy) > 0 {
+		descending := query.Get("sort_direction") == "0"
+		sort.SliceStable(medias, func(i, j int) bool {
+			a, _ := medias[i][sortBy].(string)
+			b, _ := medias[j][sortBy].(string)
+			if descending {
+				return a > b
+			}
+			return a < b
+		})
+	}
+
+	result := make([]map[string]interface{}, 0)
+	for i := (page - 1) * perPage; i < len(medias) && i < page*perPage; i++ {
+		result = append(result, medias[i])
+	}
+	this.writeJSON(w, http.StatusOK, result)
+}
+
+func (this *FakeWistia) showProject(w http.ResponseWriter, r *http.Request) {
+	hashId := mux.Vars(r)["hash"]
+	bin, err := os.ReadFile(filepath.Join(this.FixtureDir, "projects", hashId+".json"))
+	if os.IsNotExist(err) {
+		this.writeJSON(w, http.StatusNotFound, map[string]string{"error": "Project not found"})
+		return
+	}
+	project := make(map[string]interface{})
+	if err == nil {
+		err = json.Unmarshal(bin, &project)
+	}
+	if err != nil {
+		this.writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	hashList, _ := project["medias"].([]interface{})
+	medias := make([]map[string]interface{}, 0, len(hashList))
+	for _, row := range hashList {
+		mediaHash, _ := row.(string)
+		media, err := this.loadMedia(mediaHash, requestBaseURL(r))
+		if err != nil {
+			this.writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		medias = append(medias, media)
+	}
+	project["medias"] = medias
+	project["mediaCount"] = len(medias)
+
+	this.writeJSON(w, http.StatusOK, project)
+}
+
+func (this *FakeWistia) listCaptions(w http.ResponseWriter, r *http.Request) {
+	hashId := mux.Vars(r)["hash"]
+	if _, err := os.Stat(filepath.Join(this.FixtureDir, "medias", hashId+".json")); err != nil {
+		this.writeJSON(w, http.StatusNotFound, map[string]string{"error": "Media not found"})
+		return
+	}
+
+	captions := make([]interface{}, 0)
+	bin, err := os.ReadFile(filepath.Join(this.FixtureDir, "captions", hashId+".json"))
+	if err == nil {
+		err = json.Unmarshal(bin, &captions)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		this.writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	this.writeJSON(w, http.StatusOK, captions)
+}
+
+func (this *FakeWistia) archiveMedias(w http.ResponseWriter, r *http.Request) {
+	hashList := r.URL.Query()["hashed_ids[]"]
+
+	this.mu.Lock()
+	for _, hashId := range hashList {
+		this.archived[hashId] = true
+	}
+	this.mu.Unlock()
+
+	this.writeJSON(w, http.StatusOK, map[string]interface{}{"archived": hashList})
+}
+
+// IsArchived reports whether ArchiveVideos was called for hashId on this fake.
+func (this *FakeWistia) IsArchived(hashId string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.archived[hashId]
+}
+
+// EnableSandbox starts a FakeWistia on listen and points conf at it, so the service can
+// run the whole migration path without a Wistia account. When no storage is configured
+// objects are written to local storage under TempDir.
+func EnableSandbox(conf *Config, listen string, fixtureDir string) error {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		Log.Error("failed to listen for sandbox Wistia API", "listen", listen, "error", err)
+		return err
+	}
+
+	fake := NewFakeWistia(fixtureDir)
+	go func() {
+		if err := http.Serve(listener, fake.Handler()); err != nil {
+			Log.Error("sandbox Wistia API stopped", "error", err)
+		}
+	}()
+
+	conf.WistiaConf.ApiEndpoint = fmt.Sprintf("http://%s", listener.Addr().String())
+	if len(conf.WistiaConf.WistiaApiKey) <= 0 {
+		conf.WistiaConf.WistiaApiKey = "sandbox"
+	}
+	if !conf.Storage.UseS3() && !conf.Storage.UseLocal() {
+		conf.Storage.Local.Root = filepath.Join(conf.TempDir, "wistia-s3-sandbox")
+	}
+
+	Log.Info("sandbox mode enabled", "wistia_api", conf.WistiaConf.ApiEndpoint, "fixtures", fixtureDir)
+	return nil
+}
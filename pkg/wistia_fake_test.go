@@ -0,0 +1,901 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"wistia-s3/tests"
+
+	"github.com/gorilla/mux"
+)
+
+func getFakeWistiaHelper(t *testing.T) (*WistiaHelper, *FakeWistia) {
+	fake := NewFakeWistia(tests.GetLocalPath("fixtures/wistia"))
+	server := httptest.NewServer(fake.Handler())
+	t.Cleanup(server.Close)
+
+	helper := NewWistiaHelper(&WistiaConf{
+		WistiaApiKey:    "sandbox",
+		ApiEndpoint:     server.URL,
+		WorkerLimit:     2,
+		TemplateDirPath: tests.GetLocalPath("../web/dist"),
+		PublishPolicy:   PUBLISH_POLICY_ALL,
+	})
+	return helper, fake
+}
+
+// getSandboxService builds an HTTPService wired to the fake Wistia, a temp BoltDB and local storage.
+func getSandboxService(t *testing.T) (*HTTPService, *FakeWistia) {
+	helper, fake := getFakeWistiaHelper(t)
+	disk := getLocalStorage(t).(*LocalStorage)
+
+	conf := &Config{
+		Storage:    &StorageConfig{Local: disk.Conf},
+		WistiaConf: helper.Conf,
+		DBConf:     &DBConfig{FilePath: filepath.Join(t.TempDir(), "wistia-s3.db")},
+		TempDir:    t.TempDir(),
+	}
+	return NewHTTP(conf), fake
+}
+
+func TestFakeWistia_ListAndArchive(t *testing.T) {
+	helper, fake := getFakeWistiaHelper(t)
+
+	videos, err := helper.ListAllVideos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 2 || videos[0].HashId != "abc123" || videos[1].HashId != "def456" {
+		t.Fatalf("unexpected video list %s", tests.ToJSON(videos))
+	}
+
+	if _, err := helper.GetVideoDetail("missing"); err == nil {
+		t.Errorf("expected an error for an unknown media")
+	}
+
+	if err := helper.ArchiveVideos([]string{"def456"}); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.IsArchived("def456") || fake.IsArchived("abc123") {
+		t.Errorf("only def456 should be archived")
+	}
+
+	t.Log("PASS")
+}
+
+func TestFakeWistia_MoveToS3(t *testing.T) {
+	helper, _ := getFakeWistiaHelper(t)
+	disk := getLocalStorage(t).(*LocalStorage)
+	storageConf := &StorageConfig{Local: disk.Conf}
+
+	report, err := helper.MoveToS3("abc123", storageConf, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Published || report.FailedAssets() != 0 || len(report.Assets) != 4 {
+		t.Fatalf("unexpected report %s", tests.ToJSON(report))
+	}
+
+	if len(report.Captions) != 2 || !report.Captions[0].Status || !report.Captions[1].Status {
+		t.Fatalf("expected 2 migrated captions, got %s", tests.ToJSON(report.Captions))
+	}
+
+	for _, key := range []string{"media/abc123/index.json", "media/abc123/index.html", "media/abc123/demo.html",
+		"media/abc123/captions/eng.vtt", "media/abc123/captions/zh-TW.vtt"} {
+		if exists, _ := disk.Exists(key); !exists {
+			t.Errorf("expected %s to be published", key)
+		}
+	}
+
+	bin, err := os.ReadFile(filepath.Join(disk.Conf.Root, "wistia-backup/media/abc123/index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := new(WistiaRespVideo)
+	if err := json.Unmarshal(bin, published); err != nil {
+		t.Fatal(err)
+	}
+	if len(published.Captions) != 2 || published.Captions[0].Url != "http://127.0.0.1:3031/files/wistia-backup/media/abc123/captions/eng.vtt" {
+		t.Errorf("captions not listed in index.json: %s", tests.ToJSON(published.Captions))
+	}
+
+	video, err := helper.GetVideoDetail("abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := video.Assets.GetOriginal()
+	if original == nil || original.FileSize != 4096 {
+		t.Errorf("expected fixture size to be reported for the original, got %+v", original)
+	}
+
+	t.Log("PASS")
+}
+
+func TestFakeWistia_MoveToS3AssetPolicy(t *testing.T) {
+	helper, _ := getFakeWistiaHelper(t)
+	disk := getLocalStorage(t).(*LocalStorage)
+	storageConf := &StorageConfig{Local: disk.Conf}
+
+	policy := &AssetPolicy{
+		Types:      []string{"OriginalFile", "VideoFile"},
+		Heights:    []int{720},
+		ColdTypes:  []string{"OriginalFile"},
+		ColdPrefix: "cold",
+	}
+	report, err := helper.MoveToS3("abc123", storageConf, policy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Published || report.FailedAssets() != 0 || len(report.Assets) != 2 {
+		t.Fatalf("unexpected report %s", tests.ToJSON(report))
+	}
+	if !strings.HasPrefix(report.Assets[0].Key, "cold/media/abc123/original.") {
+		t.Errorf("original should go to the cold prefix, got %s", report.Assets[0].Key)
+	}
+	if exists, _ := disk.Exists(report.Assets[0].Key); !exists {
+		t.Errorf("expected %s to be copied", report.Assets[0].Key)
+	}
+	if exists, _ := disk.Exists("media/abc123/cover.jpg"); exists {
+		t.Errorf("cover is not selected by the policy")
+	}
+
+	bin, err := os.ReadFile(filepath.Join(disk.Conf.Root, "wistia-backup/media/abc123/index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := new(WistiaRespVideo)
+	if err := json.Unmarshal(bin, published); err != nil {
+		t.Fatal(err)
+	}
+	if published.Assets == nil || len(*published.Assets) != 1 || (*published.Assets)[0].Height != 720 {
+		t.Errorf("index.json should only list the copied public rendition: %s", tests.ToJSON(published.Assets))
+	}
+	if len(report.ColdAssets) != 1 || report.ColdAssets[0].Key != report.Assets[0].Key || len(report.ColdAssets[0].SHA256) <= 0 {
+		t.Fatalf("the cold original must be recorded with its checksums: %s", tests.ToJSON(report.ColdAssets))
+	}
+
+	// the stored record keeps the cold original, so a refresh does not copy it again
+	published.ColdAssets = report.ColdAssets
+	again, err := helper.MoveToS3("abc123", storageConf, policy, published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Assets[0].Skipped || again.ColdAssets[0].SHA256 != report.ColdAssets[0].SHA256 {
+		t.Errorf("recorded cold original should be reused: %s", tests.ToJSON(again))
+	}
+
+	t.Log("PASS")
+}
+
+func TestFakeWistia_MoveToS3FailedAsset(t *testing.T) {
+	helper, _ := getFakeWistiaHelper(t)
+	disk := getLocalStorage(t).(*LocalStorage)
+	storageConf := &StorageConfig{Local: disk.Conf}
+	// a directory where the cover goes makes its upload fail
+	if err := os.MkdirAll(filepath.Join(disk.Conf.Root, "wistia-backup/media/abc123/cover.jpg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := helper.MoveToS3("abc123", storageConf, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Published || report.FailedAssets() != 1 || len(report.Pages) != 0 {
+		t.Fatalf("unexpected report %s", tests.ToJSON(report))
+	}
+	for _, key := range []string{"media/abc123/index.json", "media/abc123/index.html"} {
+		if exists, _ := disk.Exists(key); exists {
+			t.Errorf("%s must not be published with the default policy", key)
+		}
+	}
+
+	templates := t.TempDir()
+	os.WriteFile(filepath.Join(templates, "assets.html"), []byte(`{{range .Video.Assets}}{{.Type}} {{end}}`), 0644)
+	helper.Conf.TemplateDirPath = templates
+	helper.Conf.Templates = []string{"assets.html"}
+	helper.Conf.PublishPolicy = PUBLISH_POLICY_PARTIAL
+	report, err = helper.MoveToS3("abc123", storageConf, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Published || len(report.Pages) != 1 {
+		t.Fatalf("unexpected partial report %s", tests.ToJSON(report))
+	}
+	bin, err := os.ReadFile(filepath.Join(disk.Conf.Root, "wistia-backup/media/abc123/assets.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(bin), "StillImageFile") || !strings.Contains(string(bin), "OriginalFile") {
+		t.Errorf("pages must list the copied assets only, got %q", bin)
+	}
+
+	helper.Conf.Templates = []string{"missing.html"}
+	report, err = helper.MoveToS3("abc123", storageConf, nil, nil)
+	if err == nil || len(report.Pages) != 1 || len(report.Pages[0].Error) <= 0 {
+		t.Errorf("page failures must be reported and returned, got %v %s", err, tests.ToJSON(report.Pages))
+	}
+
+	t.Log("PASS")
+}
+
+func TestFakeWistia_MoveToS3Unchanged(t *testing.T) {
+	helper, _ := getFakeWistiaHelper(t)
+	disk := getLocalStorage(t).(*LocalStorage)
+	storageConf := &StorageConfig{Local: disk.Conf}
+	indexPath := filepath.Join(disk.Conf.Root, "wistia-backup/media/abc123/index.json")
+
+	if _, err := helper.MoveToS3("abc123", storageConf, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	bin, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := new(WistiaRespVideo)
+	if err := json.Unmarshal(bin, previous); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stored 720p rendition no longer matches what Wistia reports
+	var changedKey string
+	for _, asset := range *previous.Assets {
+		if asset.Height == 720 && asset.Type == "HdMp4VideoFile" {
+			changedKey = assetRemoteKey("abc123", asset)
+		}
+	}
+	if _, _, err := disk.PutContent("truncated", changedKey, &UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(indexPath)
+
+	report, err := helper.MoveToS3("abc123", storageConf, nil, previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Published || report.FailedAssets() != 0 {
+		t.Fatalf("unexpected report %s", tests.ToJSON(report))
+	}
+	for _, asset := range report.Assets {
+		if asset.Skipped == (asset.Key == changedKey) {
+			t.Errorf("only %s should be transferred again: %s", changedKey, tests.ToJSON(asset))
+		}
+	}
+
+	bin, err = os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := new(WistiaRespVideo)
+	if err := json.Unmarshal(bin, published); err != nil {
+		t.Fatal(err)
+	}
+	for i, asset := range *published.Assets {
+		last := (*previous.Assets)[i]
+		if asset.Url != last.Url || asset.SHA256 != last.SHA256 {
+			t.Errorf("rebuilt index.json differs for %s: %s", asset.Type, tests.ToJSON(asset))
+		}
+	}
+
+	// a media updated on Wistia since may have re-encoded assets of the same size
+	published.Updated = "2020-01-01T00:00:00+00:00"
+	report, err = helper.MoveToS3("abc123", storageConf, nil, published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, asset := range report.Assets {
+		if asset.Skipped {
+			t.Errorf("assets of an updated media must be transferred again: %s", tests.ToJSON(asset))
+		}
+	}
+
+	t.Log("PASS")
+}
+
+func TestSrtToVTT(t *testing.T) {
+	vtt := srtToVTT("1\r\n00:00:01,000 --> 00:00:02,500\r\nHello, world\r\n")
+	expected := "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.500\nHello, world\n"
+	if vtt != expected {
+		t.Errorf("srtToVTT = %q, want %q", vtt, expected)
+	}
+
+	if srtToVTT("WEBVTT\n\n00:01.000 --> 00:02.000\nHi\n") != "WEBVTT\n\n00:01.000 --> 00:02.000\nHi\n" {
+		t.Errorf("VTT input must be kept as is")
+	}
+}
+
+func TestFakeWistia_ProjectManifest(t *testing.T) {
+	helper, _ := getFakeWistiaHelper(t)
+	disk := getLocalStorage(t).(*LocalStorage)
+	storageConf := &StorageConfig{Local: disk.Conf}
+
+	project, err := helper.GetProject("proj01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(project.Medias) != 2 || project.Medias[0].HashId != "def456" || project.Medias[1].HashId != "abc123" {
+		t.Fatalf("unexpected project medias %s", tests.ToJSON(project.Medias))
+	}
+
+	published := map[string]bool{"def456": true, "abc123": true, "unrelated": true}
+	_, s3Url, err := helper.PublishProjectManifest(project, published, storageConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s3Url != "http://127.0.0.1:3031/files/wistia-backup/projects/proj01/index.json" {
+		t.Errorf("unexpected manifest url %s", s3Url)
+	}
+
+	bin, err := os.ReadFile(filepath.Join(disk.Conf.Root, "wistia-backup/projects/proj01/index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := new(ProjectManifest)
+	if err := json.Unmarshal(bin, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Medias) != 2 || manifest.Medias[0].HashId != "def456" || manifest.Medias[1].HashId != "abc123" {
+		t.Fatalf("manifest must keep project order: %s", tests.ToJSON(manifest))
+	}
+	if manifest.Medias[1].Index != "http://127.0.0.1:3031/files/wistia-backup/media/abc123/index.json" {
+		t.Errorf("unexpected media index url %s", manifest.Medias[1].Index)
+	}
+
+	delete(published, "abc123")
+	if _, _, err := helper.PublishProjectManifest(project, published, storageConf); err != nil {
+		t.Fatal(err)
+	}
+	bin, _ = os.ReadFile(filepath.Join(disk.Conf.Root, "wistia-backup/projects/proj01/index.json"))
+	json.Unmarshal(bin, manifest)
+	if len(manifest.Medias) != 1 {
+		t.Errorf("unpublished medias must be left out of the manifest, got %d", len(manifest.Medias))
+	}
+
+	t.Log("PASS")
+}
+
+func TestFakeWistia_IncrementalSync(t *testing.T) {
+	service, _ := getSandboxService(t)
+	dbHelper := NewDBHelper(service.config.DBConf)
+
+	result, err := service.syncWistiaCatalog(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Mode != WISTIA_SYNC_MODE_FULL || result.Added != 2 || result.Total != 2 {
+		t.Fatalf("first sync should fall back to full and add everything: %s", tests.ToJSON(result))
+	}
+
+	// a media deleted on Wistia, one edited since the last sync
+	dbHelper.SaveWistiaCatalogVideo("gone99", &WistiaRespVideo{HashId: "gone99", Name: "Deleted"})
+	stale, _ := dbHelper.FindWistiaCatalogVideo("abc123")
+	stale.Name = "Old name"
+	stale.Updated = "2024-01-10T09:30:00+00:00"
+	dbHelper.SaveWistiaCatalogVideo("abc123", stale)
+	recent := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	dbHelper.SaveWistiaSyncMeta(&WistiaSyncMeta{LastSyncAt: "2024-01-11T00:00:00Z", LastFullSyncAt: recent})
+
+	result, err = service.syncWistiaCatalog(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Mode != WISTIA_SYNC_MODE_INCREMENTAL || result.Fetched != 2 || result.Updated != 1 ||
+		result.Unchanged != 1 || result.Removed != 1 || result.Added != 0 || result.Total != 2 {
+		t.Fatalf("unexpected incremental result: %s", tests.ToJSON(result))
+	}
+	if video, _ := dbHelper.FindWistiaCatalogVideo("abc123"); video.Name != "Sandbox Intro" {
+		t.Errorf("updated media must be refreshed, got %q", video.Name)
+	}
+	if _, err := dbHelper.FindWistiaCatalogVideo("gone99"); err == nil {
+		t.Errorf("deleted media must be removed by the incremental sync")
+	}
+	if _, err := dbHelper.FindWistiaCatalogVideo("def456"); err != nil {
+		t.Errorf("media not updated since the last sync must be kept: %v", err)
+	}
+
+	// nothing changed on Wistia since the sync above
+	result, err = service.syncWistiaCatalog(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Mode != WISTIA_SYNC_MODE_INCREMENTAL || result.Fetched != 0 || result.Removed != 0 || result.Total != 2 {
+		t.Fatalf("unexpected no-op incremental result: %s", tests.ToJSON(result))
+	}
+
+	// the last full sync is too old, so the incremental run lists everything again
+	dbHelper.SaveWistiaCatalogVideo("gone98", &WistiaRespVideo{HashId: "gone98", Name: "Deleted"})
+	meta, _ := dbHelper.GetWistiaSyncMeta()
+	meta.LastFullSyncAt = time.Now().Add(-2 * wistiaFullSyncInterval).Format(time.RFC3339)
+	dbHelper.SaveWistiaSyncMeta(meta)
+	result, err = service.syncWistiaCatalog(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Mode != WISTIA_SYNC_MODE_FULL || result.Removed != 1 || result.Unchanged != 2 || result.Total != 2 {
+		t.Fatalf("unexpected reconciliation result: %s", tests.ToJSON(result))
+	}
+	if _, err := dbHelper.FindWistiaCatalogVideo("gone98"); err == nil {
+		t.Errorf("deleted media must be removed by the full sync")
+	}
+
+	meta, err = dbHelper.GetWistiaSyncMeta()
+	if err != nil || meta.TotalCount != 2 || len(meta.LastFullSyncAt) <= 0 {
+		t.Errorf("unexpected sync meta %+v %v", meta, err)
+	}
+
+	t.Log("PASS")
+}
+
+func TestFakeWistia_Webhook(t *testing.T) {
+	service, _ := getSandboxService(t)
+	service.config.WistiaConf.WebhookSecret = "s3cret"
+	dbHelper := NewDBHelper(service.config.DBConf)
+	dbHelper.SaveWistiaCatalogVideo("gone99", &WistiaRespVideo{HashId: "gone99"})
+	webhookEventsMu.Lock()
+	webhookEvents = make(map[string]time.Time)
+	webhookEventsMu.Unlock()
+
+	body := []byte(`{"hook":{"uuid":"h1"},"events":[
+		{"uuid":"e1","type":"media.created","payload":{"media":{"id":"abc123","name":"Sandbox Intro"}}},
+		{"uuid":"e2","type":"media.deleted","payload":{"media":{"id":"gone99","name":"Gone"}}}]}`)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+
+	req := httptest.NewRequest("POST", "/webhooks/wistia", bytes.NewReader(body))
+	req.Header.Set("X-Wistia-Signature", "deadbeef")
+	rec := httptest.NewRecorder()
+	service.WistiaWebhook(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a bad signature, got %d", rec.Code)
+	}
+
+	// deliver posts body and waits for the task handling its events
+	deliver := func() []*WebhookEventResult {
+		req := httptest.NewRequest("POST", "/webhooks/wistia", bytes.NewReader(body))
+		req.Header.Set("X-Wistia-Signature", hex.EncodeToString(mac.Sum(nil)))
+		rec := httptest.NewRecorder()
+		service.WistiaWebhook(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		resp := struct {
+			Data *Task `json:"data"`
+		}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			tasksMu.Lock()
+			task := tasks[resp.Data.ID]
+			tasksMu.Unlock()
+			if task.Status == TASK_STATUS_FINISHED {
+				return task.Result.([]*WebhookEventResult)
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("webhook events were not handled")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	results := deliver()
+	if len(results) != 2 || len(results[0].MoveTaskId) <= 0 || len(results[1].MoveTaskId) > 0 || results[0].Duplicate {
+		t.Fatalf("unexpected webhook result %s", tests.ToJSON(results))
+	}
+
+	if _, err := dbHelper.FindWistiaCatalogVideo("abc123"); err != nil {
+		t.Errorf("created media must be added to the catalog: %v", err)
+	}
+	if _, err := dbHelper.FindWistiaCatalogVideo("gone99"); err == nil {
+		t.Errorf("deleted media must be removed from the catalog")
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		tasksMu.Lock()
+		task := tasks[results[0].MoveTaskId]
+		tasksMu.Unlock()
+		if task.Status == TASK_STATUS_FINISHED {
+			results := task.Result.([]*MoveToS3Result)
+			if !results[0].Status {
+				t.Errorf("queued migration failed: %s", tests.ToJSON(results))
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queued migration did not finish")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Wistia redelivers the same events
+	results = deliver()
+	if len(results) != 2 || !results[0].Duplicate || !results[1].Duplicate || len(results[0].MoveTaskId) > 0 {
+		t.Errorf("redelivered events must be skipped: %s", tests.ToJSON(results))
+	}
+
+	t.Log("PASS")
+}
+
+func TestFakeWistia_ArchiveVerified(t *testing.T) {
+	service, fake := getSandboxService(t)
+	helper := NewWistiaHelper(service.config.WistiaConf)
+	for _, hashId := range []string{"abc123", "def456"} {
+		if _, err := helper.MoveToS3(hashId, service.config.Storage, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// truncate one asset of def456 so its copy no longer verifies
+	storage, _ := GetStorage(service.config.Storage)
+	if _, _, err := storage.PutContent("short", "media/def456/cover.jpg", &UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	result := service.archiveVerifiedVideos([]string{"abc123", "def456", "missing"}, true, false, "dry")
+	if !result.Checks[0].Verified || result.Checks[1].Verified || result.Checks[2].Verified {
+		t.Fatalf("unexpected checks %s", tests.ToJSON(result.Checks))
+	}
+	if len(result.Archived) != 0 || fake.IsArchived("abc123") {
+		t.Fatalf("dry run must not archive anything")
+	}
+
+	result = service.archiveVerifiedVideos([]string{"abc123", "def456"}, false, false, "run1")
+	if len(result.Archived) != 1 || result.Archived[0] != "abc123" || result.AuditId != "run1" {
+		t.Fatalf("unexpected archive result %s", tests.ToJSON(result))
+	}
+	if !fake.IsArchived("abc123") || fake.IsArchived("def456") {
+		t.Errorf("only the verified media should be archived on Wistia")
+	}
+
+	audits, err := NewDBHelper(service.config.DBConf).GetAllArchiveAudits()
+	if err != nil || len(audits) != 1 || audits[0].Archived[0] != "abc123" {
+		t.Errorf("unexpected audits %s %v", tests.ToJSON(audits), err)
+	}
+
+	t.Log("PASS")
+}
+
+func TestFakeWistia_VerifySkippedAssets(t *testing.T) {
+	service, _ := getSandboxService(t)
+	helper := NewWistiaHelper(service.config.WistiaConf)
+	storage, _ := GetStorage(service.config.Storage)
+
+	helper.Conf.AssetPolicy = &AssetPolicy{Types: []string{"OriginalFile", "StillImageFile"}}
+	if _, err := helper.MoveToS3("abc123", service.config.Storage, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if check := helper.VerifyMigration("abc123", storage, false); check.Verified {
+		t.Errorf("a copy missing a Wistia asset must not verify: %s", tests.ToJSON(check))
+	}
+	check := helper.VerifyMigration("abc123", storage, true)
+	if !check.Verified || len(check.Skipped) != 2 {
+		t.Errorf("expected the skipped renditions to be accepted: %s", tests.ToJSON(check))
+	}
+
+	service, _ = getSandboxService(t)
+	helper = NewWistiaHelper(service.config.WistiaConf)
+	storage, _ = GetStorage(service.config.Storage)
+	helper.Conf.AssetPolicy = &AssetPolicy{Types: []string{"IphoneVideoFile", "StillImageFile"}}
+	if _, err := helper.MoveToS3("abc123", service.config.Storage, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if check := helper.VerifyMigration("abc123", storage, true); check.Verified {
+		t.Errorf("a copy without the original must not verify: %s", tests.ToJSON(check))
+	}
+
+	t.Log("PASS")
+}
+
+func TestFakeWistia_DeferredRetry(t *testing.T) {
+	service, fake := getSandboxService(t)
+	dbHelper := NewDBHelper(service.config.DBConf)
+
+	fake.SetProcessing("abc123", true)
+	results := service.moveVideos([]string{"abc123", "def456"}, "", nil)
+	if !results[0].Deferred || results[0].Status || !results[1].Status || results[1].Deferred {
+		t.Fatalf("abc123 should be deferred, def456 migrated: %s", tests.ToJSON(results))
+	}
+	media, err := dbHelper.FindDeferredMedia("abc123")
+	if err != nil || media.Status != "processing" || media.Attempts != 1 {
+		t.Fatalf("unexpected deferred record %+v %v", media, err)
+	}
+
+	// still encoding, stays deferred
+	result, err := service.retryDeferredVideos("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 1 || result.StillDeferred != 1 || result.Migrated != 0 {
+		t.Fatalf("unexpected retry result: %s", tests.ToJSON(result))
+	}
+
+	fake.SetProcessing("abc123", false)
+	result, err = service.retryDeferredVideos("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 1 || result.Migrated != 1 || result.StillDeferred != 0 {
+		t.Fatalf("unexpected retry result: %s", tests.ToJSON(result))
+	}
+	if list, _ := dbHelper.GetAllDeferredMedia(); len(list) != 0 {
+		t.Errorf("migrated media should leave the deferred list: %s", tests.ToJSON(list))
+	}
+
+	// a deferred media that then fails to encode is reported and no longer retried
+	fake.SetProcessing("def456", true)
+	service.moveVideos([]string{"def456"}, "", &MoveToS3Options{OverRider: true})
+	fake.SetStatus("def456", "failed")
+	result, err = service.retryDeferredVideos("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failed != 1 || result.Media[0].Deferred || !strings.Contains(result.Media[0].Error, ErrMediaFailed.Error()) {
+		t.Fatalf("a failed media must fail, not stay deferred: %s", tests.ToJSON(result))
+	}
+	if list, _ := dbHelper.GetAllDeferredMedia(); len(list) != 0 {
+		t.Errorf("failed media should leave the deferred list: %s", tests.ToJSON(list))
+	}
+
+	if task := service.startDeferredRetryTask(true); task != nil {
+		t.Errorf("a scheduled pass must not start without deferred media, got %+v", task)
+	}
+	dbHelper.SaveDeferredMedia(&DeferredMedia{HashId: "abc123"})
+	tasksMu.Lock()
+	running := &Task{ID: "deferred-running", Status: TASK_STATUS_RUNNING}
+	tasks[running.ID] = running
+	deferredRetryTaskId = running.ID
+	tasksMu.Unlock()
+	if task := service.startDeferredRetryTask(true); task != running {
+		t.Errorf("a pass must not start while the previous one runs, got %+v", task)
+	}
+	tasksMu.Lock()
+	delete(tasks, running.ID)
+	tasksMu.Unlock()
+
+	t.Log("PASS")
+}
+
+func TestFakeWistia_SpoolResume(t *testing.T) {
+	service, _ := getSandboxService(t)
+	disk, _ := GetStorage(service.config.Storage)
+	helper := NewWistiaHelper(service.config.WistiaConf)
+
+	video, err := helper.GetVideoDetail("abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := video.Assets.GetOriginal()
+	fixture, err := os.ReadFile(tests.GetLocalPath("fixtures/wistia/assets/abc123/original.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a previous run got the first 1000 bytes of the original
+	helper.SpoolTo(service.config.TempDir, nil)
+	spoolPath := helper.spoolPath(assetRemoteKey("abc123", original), assetVersion(video, original))
+	os.MkdirAll(filepath.Dir(spoolPath), 0755)
+	if err := os.WriteFile(spoolPath, fixture[:1000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	// and a spool file of an encoding Wistia replaced since must not be resumed
+	staleSpool := helper.spoolPath(assetRemoteKey("abc123", original), "0123456789ab")
+	if err := os.WriteFile(staleSpool, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pending := service.interruptedTransfers(); len(pending) != 1 || pending[0] != "abc123" {
+		t.Fatalf("expected abc123 to be pending, got %v", pending)
+	}
+
+	stats := NewTransferStats()
+	report, err := helper.TrackTransfers(stats).MoveToS3("abc123", service.config.Storage, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Published || report.FailedAssets() != 0 {
+		t.Fatalf("unexpected report %s", tests.ToJSON(report))
+	}
+	// 4096 + 1024 + 2048 + 512 bytes of assets, minus what was already spooled
+	if progress := stats.Snapshot(); progress.Bytes != 7680-1000 {
+		t.Errorf("expected the original to resume at 1000 bytes, downloaded %d", progress.Bytes)
+	}
+
+	local := disk.(*LocalStorage)
+	stored, err := os.ReadFile(local.filePath(local.keyPath(assetRemoteKey("abc123", original))))
+	if err != nil || !bytes.Equal(stored, fixture) {
+		t.Errorf("resumed original differs from the fixture: %v", err)
+	}
+	if _, err := os.Stat(spoolPath); !os.IsNotExist(err) {
+		t.Errorf("spool file should be removed after upload")
+	}
+	if _, err := os.Stat(staleSpool); !os.IsNotExist(err) {
+		t.Errorf("stale spool file should be removed")
+	}
+	if pending := service.interruptedTransfers(); len(pending) != 0 {
+		t.Errorf("nothing should be pending, got %v", pending)
+	}
+
+	t.Log("PASS")
+}
+
+func TestLockMedia(t *testing.T) {
+	unlock := lockMedia("abc123")
+	acquired := make(chan bool)
+	go func() {
+		defer lockMedia("abc123")()
+		acquired <- true
+	}()
+	defer lockMedia("def456")()
+
+	select {
+	case <-acquired:
+		t.Fatal("a second migration of the same media must wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-acquired
+
+	time.Sleep(10 * time.Millisecond)
+	mediaLocksMu.Lock()
+	_, held := mediaLocks["abc123"]
+	mediaLocksMu.Unlock()
+	if held {
+		t.Errorf("released locks must be dropped")
+	}
+}
+
+func TestFakeWistia_RenderPages(t *testing.T) {
+	service, _ := getSandboxService(t)
+	service.config.WistiaConf.Templates = []string{"demo.html"}
+	dbHelper := NewDBHelper(service.config.DBConf)
+	if err := dbHelper.SaveVideoInfo("abc123", strings.NewReader(`{"hashed_id":"abc123","name":"Sandbox video"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/render/missing", nil), map[string]string{"hash": "missing"})
+	rec := httptest.NewRecorder()
+	service.RenderPages(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a media that was never migrated, got %d", rec.Code)
+	}
+
+	result, err := service.renderVideos(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Error) > 0 || len(result.Media) != 1 || !result.Media[0].Status {
+		t.Fatalf("unexpected render result %s", tests.ToJSON(result))
+	}
+
+	root := filepath.Join(service.config.Storage.Local.Root, "wistia-backup")
+	for _, key := range []string{"media/wistia-s3.min.js", "media/abc123/demo.html"} {
+		if _, err := os.Stat(filepath.Join(root, key)); err != nil {
+			t.Errorf("missing %s: %v", key, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "media/abc123/index.html")); err == nil {
+		t.Errorf("templates left out of WistiaConf.Templates must not be rendered")
+	}
+	if _, err := os.Stat(filepath.Join(root, "media/abc123/index.json")); err == nil {
+		t.Errorf("rendering must not publish index.json")
+	}
+}
+
+// migrateColdRecord migrates abc123 with its original under cold/ and waits for the media record.
+func migrateColdRecord(t *testing.T, service *HTTPService) *WistiaRespVideo {
+	// SaveVideoInfo reads index.json back over HTTP
+	server := httptest.NewServer(http.FileServer(http.Dir(service.config.Storage.Local.Root)))
+	t.Cleanup(server.Close)
+	service.config.Storage.Local.BaseURL = server.URL
+	service.config.WistiaConf.AssetPolicy = &AssetPolicy{ColdTypes: []string{"OriginalFile"}, ColdPrefix: "cold"}
+
+	results := service.moveVideos([]string{"abc123"}, "", nil)
+	if !results[0].Status {
+		t.Fatalf("migration failed: %s", tests.ToJSON(results))
+	}
+	dbHelper := NewDBHelper(service.config.DBConf)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if video, err := dbHelper.FindVideoInfo("abc123"); err == nil {
+			return video
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("media record not saved")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestFakeWistia_ColdAssetRecord(t *testing.T) {
+	service, _ := getSandboxService(t)
+	dbHelper := NewDBHelper(service.config.DBConf)
+
+	video := migrateColdRecord(t, service)
+	if len(video.ColdAssets) != 1 || !strings.HasPrefix(video.ColdAssets[0].Key, "cold/media/abc123/original.") || len(video.ColdAssets[0].MD5) <= 0 {
+		t.Fatalf("the record must list the cold original: %s", tests.ToJSON(video.ColdAssets))
+	}
+
+	// refreshing the record from index.json keeps the cold assets
+	indexURL := service.config.Storage.ObjectURL("wistia-backup/media/abc123/index.json")
+	if err := service.fetchVideoInfo(dbHelper, indexURL, "abc123"); err != nil {
+		t.Fatal(err)
+	}
+	if video, _ := dbHelper.FindVideoInfo("abc123"); len(video.ColdAssets) != 1 {
+		t.Errorf("refresh dropped the cold assets: %s", tests.ToJSON(video))
+	}
+
+	t.Log("PASS")
+}
+
+func TestFakeWistia_DeleteColdAssets(t *testing.T) {
+	service, _ := getSandboxService(t)
+	video := migrateColdRecord(t, service)
+	storage, _ := GetStorage(service.config.Storage)
+
+	// a cold copy made under another prefix is only known from the record
+	moved := strings.Replace(video.ColdAssets[0].Key, "cold/", "archive/", 1)
+	if _, _, err := storage.Copy(video.ColdAssets[0].Key, moved, &UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	video.ColdAssets = append(video.ColdAssets, &ColdAsset{Type: "OriginalFile", Key: moved})
+	bin, _ := json.Marshal(video)
+	NewDBHelper(service.config.DBConf).SaveVideoInfo("abc123", bytes.NewReader(bin))
+
+	req := mux.SetURLVars(httptest.NewRequest("DELETE", "/media/abc123", nil), map[string]string{"hash": "abc123"})
+	rec := httptest.NewRecorder()
+	service.DeleteVideo(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := struct {
+		Data *DeleteMediaResult `json:"data"`
+	}{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Data == nil || resp.Data.ColdDeleted != 2 {
+		t.Fatalf("unexpected delete result %s", rec.Body.String())
+	}
+	for _, key := range []string{video.ColdAssets[0].Key, moved} {
+		if exists, _ := storage.Exists(key); exists {
+			t.Errorf("%s must be deleted", key)
+		}
+	}
+
+	t.Log("PASS")
+}
+
+func TestHTTPService_EachMedia(t *testing.T) {
+	service := &HTTPService{config: &Config{WistiaConf: &WistiaConf{WorkerLimit: 2}}}
+	hashList := []string{"a", "b", "c", "d", "e"}
+	seen := make([]string, len(hashList))
+
+	var running, peak int32
+	service.eachMedia(hashList, func(hashId string, index int) {
+		now := atomic.AddInt32(&running, 1)
+		for {
+			old := atomic.LoadInt32(&peak)
+			if now <= old || atomic.CompareAndSwapInt32(&peak, old, now) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		seen[index] = hashId
+		atomic.AddInt32(&running, -1)
+	})
+
+	if peak > 2 {
+		t.Errorf("expected at most 2 media at once, got %d", peak)
+	}
+	if strings.Join(seen, "") != "abcde" {
+		t.Errorf("every media must be handled at its index, got %v", seen)
+	}
+}
@@ -0,0 +1,131 @@
+package pkg
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// AssetPolicy selects which Wistia assets a migration copies and where they land, e.g.
+// the original to a cold prefix and only the 720p and 360p renditions to the public media/ tree.
+type AssetPolicy struct {
+	// Types lists the asset types to copy; "VideoFile" matches every rendition type. Empty copies all.
+	Types []string `json:"types"`
+	// Heights limits video renditions to these heights. Empty keeps every rendition.
+	Heights []int `json:"heights"`
+	// ColdTypes are copied under ColdPrefix without a public ACL and are left out of index.json.
+	ColdTypes  []string `json:"cold_types"`
+	ColdPrefix string   `json:"cold_prefix"`
+}
+
+func (this *AssetPolicy) MarginWithENV() *AssetPolicy {
+	if len(this.Types) <= 0 {
+		this.Types = splitList(os.Getenv("WISTIA_ASSET_TYPES"))
+	}
+	if len(this.Heights) <= 0 {
+		this.Heights, _ = parseHeights(os.Getenv("WISTIA_ASSET_HEIGHTS"))
+	}
+	if len(this.ColdTypes) <= 0 {
+		this.ColdTypes = splitList(os.Getenv("WISTIA_COLD_ASSET_TYPES"))
+	}
+	if this.ColdPrefix == "" {
+		this.ColdPrefix = os.Getenv("WISTIA_COLD_PREFIX")
+	}
+	if this.ColdPrefix == "" || escapesPrefix(this.ColdPrefix) {
+		if this.ColdPrefix != "" {
+			Log.Error("cold prefix leaves the storage prefix, using the default", "prefix", this.ColdPrefix)
+		}
+		this.ColdPrefix = "cold"
+	}
+
+	return this
+}
+
+// IsCold reports whether asset goes to the cold prefix.
+func (this *AssetPolicy) IsCold(asset *WistiaRespVideoAsset) bool {
+	if this == nil {
+		return false
+	}
+	for _, want := range this.ColdTypes {
+		if assetTypeMatches(asset.Type, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteKey is assetRemoteKey, moved under ColdPrefix for cold assets.
+func (this *AssetPolicy) RemoteKey(hashId string, asset *WistiaRespVideoAsset) string {
+	remoteKey := assetRemoteKey(hashId, asset)
+	if this.IsCold(asset) {
+		return fmt.Sprintf("%s/%s", strings.Trim(this.ColdPrefix, "/"), remoteKey)
+	}
+	return remoteKey
+}
+
+// Override returns a copy of the policy with the fields given in query replaced:
+// types, heights and coldTypes as comma separated lists, coldPrefix as is.
+func (this *AssetPolicy) Override(query url.Values) (*AssetPolicy, error) {
+	policy := &AssetPolicy{}
+	if this != nil {
+		*policy = *this
+	}
+	if query.Has("types") {
+		policy.Types = splitList(query.Get("types"))
+	}
+	if query.Has("heights") {
+		heights, err := parseHeights(query.Get("heights"))
+		if err != nil {
+			return nil, err
+		}
+		policy.Heights = heights
+	}
+	if query.Has("coldTypes") {
+		policy.ColdTypes = splitList(query.Get("coldTypes"))
+	}
+	if query.Has("coldPrefix") {
+		prefix := query.Get("coldPrefix")
+		if path.IsAbs(prefix) {
+			return nil, fmt.Errorf("cold prefix %q must be relative", prefix)
+		}
+		policy.ColdPrefix = prefix
+	}
+	if len(policy.ColdTypes) > 0 && len(strings.Trim(policy.ColdPrefix, "/")) <= 0 {
+		return nil, fmt.Errorf("cold prefix cannot be empty")
+	}
+	if escapesPrefix(policy.ColdPrefix) {
+		return nil, fmt.Errorf("cold prefix %q must stay under the storage prefix", policy.ColdPrefix)
+	}
+	return policy, nil
+}
+
+// escapesPrefix reports whether key climbs out of the directory it is joined to.
+func escapesPrefix(key string) bool {
+	cleaned := path.Clean(strings.TrimLeft(key, "/"))
+	return cleaned == ".." || strings.HasPrefix(cleaned, "../")
+}
+
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func parseHeights(value string) ([]int, error) {
+	heights := make([]int, 0)
+	for _, item := range splitList(value) {
+		height, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(item), "p"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid asset height %q", item)
+		}
+		heights = append(heights, height)
+	}
+	return heights, nil
+}
@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"net/url"
+	"testing"
+	"wistia-s3/tests"
+)
+
+func getPolicyTestAssets() *AssetList {
+	return &AssetList{
+		{Type: "OriginalFile", Height: 1080},
+		{Type: "IphoneVideoFile", Height: 224},
+		{Type: "Mp4VideoFile", Height: 360},
+		{Type: "HdMp4VideoFile", Height: 720},
+		{Type: "StillImageFile", Height: 360},
+	}
+}
+
+func TestAssetPolicy_Select(t *testing.T) {
+	assets := getPolicyTestAssets()
+
+	if selected := assets.Select(nil); len(selected) != 5 {
+		t.Errorf("nil policy should select every asset, got %s", tests.ToJSON(selected))
+	}
+
+	policy := &AssetPolicy{
+		Types:      []string{"OriginalFile", "VideoFile"},
+		Heights:    []int{720, 360},
+		ColdTypes:  []string{"OriginalFile"},
+		ColdPrefix: "cold/",
+	}
+	selected := assets.Select(policy)
+	if len(selected) != 3 || selected[0].Type != "OriginalFile" || selected[1].Height != 360 || selected[2].Height != 720 {
+		t.Fatalf("unexpected selection %s", tests.ToJSON(selected))
+	}
+
+	if !policy.IsCold(selected[0]) || policy.IsCold(selected[1]) {
+		t.Errorf("only the original should be cold")
+	}
+	if key := policy.RemoteKey("abc123", &WistiaRespVideoAsset{Type: "OriginalFile", ContentType: "image/jpg"}); key != "cold/media/abc123/original.jpg" {
+		t.Errorf("unexpected cold key %s", key)
+	}
+
+	t.Log("PASS")
+}
+
+func TestAssetPolicy_Override(t *testing.T) {
+	base := &AssetPolicy{Types: []string{"VideoFile"}, ColdPrefix: "cold"}
+
+	policy, err := base.Override(url.Values{"heights": {"720p,360"}, "coldTypes": {"OriginalFile"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Types) != 1 || len(policy.Heights) != 2 || policy.Heights[0] != 720 || policy.ColdTypes[0] != "OriginalFile" {
+		t.Errorf("unexpected policy %+v", policy)
+	}
+	if len(base.Heights) != 0 {
+		t.Errorf("override must not change the configured policy")
+	}
+
+	if _, err := base.Override(url.Values{"heights": {"hd"}}); err == nil {
+		t.Errorf("expected an error for an invalid height")
+	}
+	if _, err := base.Override(url.Values{"coldTypes": {"OriginalFile"}, "coldPrefix": {"/"}}); err == nil {
+		t.Errorf("expected an error for an empty cold prefix")
+	}
+	for _, prefix := range []string{"../../escaped", "cold/../../escaped", "/tmp/cold"} {
+		if _, err := base.Override(url.Values{"coldTypes": {"OriginalFile"}, "coldPrefix": {prefix}}); err == nil {
+			t.Errorf("expected an error for cold prefix %s", prefix)
+		}
+	}
+
+	t.Log("PASS")
+}
@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+type WistiaRespProject struct {
+	Id          int                `json:"id"`
+	Name        string             `json:"name"`
+	HashId      string             `json:"hashed_id"`
+	Description string             `json:"description"`
+	MediaCount  int                `json:"mediaCount"`
+	Created     string             `json:"created"`
+	Updated     string             `json:"updated"`
+	Medias      []*WistiaRespVideo `json:"medias"`
+}
+
+type ProjectManifestVideo struct {
+	HashId   string  `json:"hashed_id"`
+	Name     string  `json:"name"`
+	Duration float32 `json:"duration"`
+	Index    string  `json:"index"`
+}
+
+// ProjectManifest is published as projects/{hash}/index.json, Medias keep the Wistia project order.
+type ProjectManifest struct {
+	HashId      string                  `json:"hashed_id"`
+	Name        string                  `json:"name"`
+	Description string                  `json:"description"`
+	GeneratedAt string                  `json:"generated_at"`
+	Medias      []*ProjectManifestVideo `json:"medias"`
+}
+
+func (this *WistiaHelper) GetProject(projectHash string) (*WistiaRespProject, error) {
+	req, err := http.NewRequest("GET", this.Conf.APIURL(fmt.Sprintf("projects/%s.json", projectHash)), nil)
+	if err != nil {
+		Log.Error("failed to create Wistia project request", "error", err, "project", projectHash)
+		return nil, err
+	}
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		Log.Error("failed to execute Wistia project request", "error", err, "project", projectHash)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	project := new(WistiaRespProject)
+	if err := json.NewDecoder(resp.Body).Decode(project); err != nil {
+		Log.Error("failed to decode Wistia project response", "error", err, "project", projectHash)
+		return nil, err
+	}
+	return project, nil
+}
+
+// PublishProjectManifest publishes the project manifest and returns its CloudFront and S3 URLs,
+// see PublishProjectManifestTargets.
+func (this *WistiaHelper) PublishProjectManifest(project *WistiaRespProject, published map[string]bool, storageConf *StorageConfig) (string, string, error) {
+	reports, err := this.PublishProjectManifestTargets(project, published, storageConf)
+	return targetURL(reports, PUBLICATION_TARGET_CLOUDFRONT), targetURL(reports, PUBLICATION_TARGET_S3), err
+}
+
+// PublishProjectManifestTargets writes projects/{hash}/index.json to every publication target,
+// listing the project's medias whose index.json is published, as reported by published. Each
+// copy links the index.json of its own target.
+func (this *WistiaHelper) PublishProjectManifestTargets(project *WistiaRespProject, published map[string]bool, storageConf *StorageConfig) ([]*TargetReport, error) {
+	storage, err := GetStorage(storageConf)
+	if err != nil {
+		Log.Error("failed to create storage for project manifest", "error", err, "project", project.HashId)
+		return nil, err
+	}
+
+	indexes := make(map[string]map[string]string)
+	for _, media := range project.Medias {
+		if published[media.HashId] {
+			indexes[media.HashId] = this.VideoInfoURLs(media.HashId, storageConf)
+		}
+	}
+
+	remoteKey := fmt.Sprintf("projects/%s/index.json", project.HashId)
+	reports := publishToTargets(storage, storageConf, remoteKey, &UploadOptions{ContentType: "application/json", PublicRead: true, Kind: UPLOAD_KIND_INDEX},
+		func(target *PublicationTarget) (io.Reader, error) {
+			manifest := &ProjectManifest{
+				HashId:      project.HashId,
+				Name:        project.Name,
+				Description: project.Description,
+				GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+				Medias:      make([]*ProjectManifestVideo, 0, len(indexes)),
+			}
+			for _, media := range project.Medias {
+				if urls, ok := indexes[media.HashId]; ok {
+					manifest.Medias = append(manifest.Medias, &ProjectManifestVideo{
+						HashId:   media.HashId,
+						Name:     media.Name,
+						Duration: media.Duration,
+						Index:    urls[target.Name],
+					})
+				}
+			}
+			bin, err := json.Marshal(manifest)
+			if err != nil {
+				return nil, err
+			}
+			return bytes.NewReader(bin), nil
+		})
+	Log.Info("published project manifest", "key", remoteKey, "url", targetURL(reports, PUBLICATION_TARGET_S3), "project", project.HashId, "medias", len(indexes))
+
+	purgeTargets(storageConf, this.taskId, remoteKey)
+
+	return reports, targetsError(reports)
+}
@@ -0,0 +1,229 @@
+package pkg
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// spoolDirName is the directory under Config.TempDir holding partially downloaded assets,
+// laid out like storage: wistia-s3-spool/media/{hash}/720.mp4@{version}.part.
+const spoolDirName = "wistia-s3-spool"
+
+var (
+	mediaLocks   = make(map[string]*mediaLock)
+	mediaLocksMu sync.Mutex
+)
+
+type mediaLock struct {
+	mu    sync.Mutex
+	users int
+}
+
+// lockMedia serializes migrations of hashId, which share its spool files and multipart uploads,
+// and returns the function releasing the lock.
+func lockMedia(hashId string) func() {
+	mediaLocksMu.Lock()
+	lock, ok := mediaLocks[hashId]
+	if !ok {
+		lock = &mediaLock{}
+		mediaLocks[hashId] = lock
+	}
+	lock.users++
+	mediaLocksMu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		mediaLocksMu.Lock()
+		if lock.users--; lock.users <= 0 {
+			delete(mediaLocks, hashId)
+		}
+		mediaLocksMu.Unlock()
+	}
+}
+
+// SpoolTo makes this helper download assets to disk under dir before uploading them, resuming
+// interrupted downloads with Range requests. With a state store, storages implementing
+// ResumableStorage also resume interrupted uploads.
+func (this *WistiaHelper) SpoolTo(dir string, uploads MultipartStateStore) *WistiaHelper {
+	this.spoolDir = dir
+	this.uploads = uploads
+	return this
+}
+
+func (this *WistiaHelper) spoolPath(remoteKey string, version string) string {
+	return filepath.Join(this.spoolDir, spoolDirName, filepath.FromSlash(remoteKey)) + "@" + version + ".part"
+}
+
+// assetVersion identifies the content Wistia serves for asset, so a spool file or multipart
+// upload of an earlier encoding is never resumed into a new one.
+func assetVersion(video *WistiaRespVideo, asset *WistiaRespVideoAsset) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d", video.Updated, asset.FileSize)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// removeStaleSpool removes the spool files of remoteKey other than spoolPath.
+func (this *WistiaHelper) removeStaleSpool(remoteKey string, spoolPath string) {
+	base := filepath.Join(this.spoolDir, spoolDirName, filepath.FromSlash(remoteKey))
+	matches, _ := filepath.Glob(base + "@*.part")
+	for _, match := range matches {
+		if match == spoolPath {
+			continue
+		}
+		Log.Info("removing spool file of an outdated asset", "path", match)
+		os.Remove(match)
+	}
+}
+
+// spoolAsset is transferAssetTo going through a spool file: the download survives network
+// errors and restarts, and the file is only removed once storage holds a verified copy.
+func (this *WistiaHelper) spoolAsset(storage IStorage, video *WistiaRespVideo, asset *WistiaRespVideoAsset, remoteKey string, publicRead bool) *AssetReport {
+	report := &AssetReport{
+		Type:   asset.Type,
+		Height: asset.Height,
+		Key:    remoteKey,
+	}
+	fail := func(err error) *AssetReport {
+		report.Error = err.Error()
+		return report
+	}
+
+	version := assetVersion(video, asset)
+	spoolPath := this.spoolPath(remoteKey, version)
+	if err := os.MkdirAll(filepath.Dir(spoolPath), 0755); err != nil {
+		Log.Error("failed to create spool directory", "error", err, "path", spoolPath, "hash", video.HashId)
+		return fail(err)
+	}
+	this.removeStaleSpool(remoteKey, spoolPath)
+
+	size, err := this.spoolDownload(asset, spoolPath, video.HashId)
+	report.Bytes = size
+	if err != nil {
+		Log.Error("failed to download video asset to spool", "error", err, "url", asset.Url, "path", spoolPath, "hash", video.HashId)
+		return fail(err)
+	}
+	if asset.FileSize > 0 && size != int64(asset.FileSize) {
+		// a spool file that cannot be resumed into the right size is useless
+		os.Remove(spoolPath)
+		Log.Error("spooled video asset size mismatch", "expected", asset.FileSize, "spooled", size, "path", spoolPath, "hash", video.HashId)
+		return fail(fmt.Errorf("size mismatch: wistia reports %d bytes, spooled %d", asset.FileSize, size))
+	}
+
+	file, err := os.Open(spoolPath)
+	if err != nil {
+		return fail(err)
+	}
+	defer file.Close()
+
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), file); err != nil {
+		return fail(err)
+	}
+
+	opt := assetUploadOptions(video.HashId, asset, publicRead)
+	var path, url string
+	if resumable, ok := storage.(ResumableStorage); ok && this.uploads != nil {
+		path, url, err = resumable.PutResumable(this.transfers.ReaderAt(file), size, remoteKey, version, opt, this.uploads)
+	} else {
+		path, url, err = storage.PutStream(this.transfers.Reader(io.NewSectionReader(file, 0, size), nil), remoteKey, opt)
+	}
+	if err != nil {
+		Log.Error("failed to upload spooled video asset", "error", err, "path", spoolPath, "key", remoteKey, "hash", video.HashId)
+		return fail(err)
+	}
+
+	info, err := storage.Stat(remoteKey)
+	if err != nil {
+		Log.Error("failed to stat uploaded video asset", "error", err, "key", remoteKey, "hash", video.HashId)
+		return fail(err)
+	}
+	if info.Size != size {
+		Log.Error("uploaded video asset size mismatch", "expected", size, "stored", info.Size, "key", remoteKey, "hash", video.HashId)
+		return fail(fmt.Errorf("size mismatch: spooled %d bytes, stored %d", size, info.Size))
+	}
+
+	file.Close()
+	if err := os.Remove(spoolPath); err != nil {
+		Log.Warn("failed to remove spool file", "error", err, "path", spoolPath)
+	}
+
+	asset.S3Key = path
+	asset.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+	asset.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+
+	Log.Info("uploaded spooled video asset", "url", url, "key", remoteKey, "type", asset.Type, "bytes", size, "hash", video.HashId)
+
+	asset.Url = url
+	report.Status = true
+
+	return report
+}
+
+// spoolDownload fills spoolPath with the asset, continuing from whatever an earlier attempt or
+// run left behind, and returns the spooled size.
+func (this *WistiaHelper) spoolDownload(asset *WistiaRespVideoAsset, spoolPath string, hashId string) (int64, error) {
+	attempts := this.Conf.MaxRetries + 1
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		var offset int64
+		if info, err := os.Stat(spoolPath); err == nil {
+			offset = info.Size()
+		}
+		// without a known size a leftover file cannot be told complete, so start over
+		if asset.FileSize <= 0 {
+			offset = 0
+		}
+		if asset.FileSize > 0 && offset >= int64(asset.FileSize) {
+			return offset, nil
+		}
+		if offset > 0 {
+			Log.Info("resuming video asset download", "offset", offset, "size", asset.FileSize, "path", spoolPath, "hash", hashId)
+		}
+
+		resp, err := this.client.DownloadFrom(asset.Url, offset)
+		if err != nil {
+			return offset, err
+		}
+
+		flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if offset <= 0 || resp.StatusCode != http.StatusPartialContent {
+			if offset > 0 {
+				Log.Warn("server ignored range request, downloading from the start", "path", spoolPath, "hash", hashId)
+			}
+			flags |= os.O_TRUNC
+			offset = 0
+		}
+		file, err := os.OpenFile(spoolPath, flags, 0644)
+		if err != nil {
+			resp.Body.Close()
+			return offset, err
+		}
+
+		this.stats.begin()
+		written, err := io.Copy(file, this.transfers.Reader(resp.Body, this.stats))
+		this.stats.end()
+		resp.Body.Close()
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			return offset + written, nil
+		}
+
+		lastErr = err
+		Log.Warn("video asset download interrupted", "error", err, "attempt", attempt+1, "spooled", offset+written, "path", spoolPath, "hash", hashId)
+	}
+
+	return 0, lastErr
+}
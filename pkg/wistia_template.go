@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"text/template"
+)
+
+// VideoIndexStore looks up the AI index rendered into pages, DBHelper implements it.
+type VideoIndexStore interface {
+	FindVideoIndex(hashId string) (*DashScopeIndexResult, error)
+}
+
+// WithIndexes renders pages with the AI index found in store.
+func (this *WistiaHelper) WithIndexes(store VideoIndexStore) *WistiaHelper {
+	this.indexes = store
+	return this
+}
+
+func (this *WistiaHelper) findIndex(hashId string) *DashScopeIndexResult {
+	if this.indexes == nil {
+		return nil
+	}
+	index, err := this.indexes.FindVideoIndex(hashId)
+	if err != nil {
+		return nil
+	}
+	return index
+}
+
+// pageData is the TemplateData of the pages of video on target.
+func (this *WistiaHelper) pageData(video *WistiaRespVideo, index *DashScopeIndexResult, target *PublicationTarget, storageConf *StorageConfig) *TemplateData {
+	media := fmt.Sprintf("media/%s", video.HashId)
+	data := &TemplateData{
+		HashId:        video.HashId,
+		MediaEndPoint: target.URL(storageConf, target.Key("media")),
+		VideoName:     video.Name,
+		WistiaS3JSUrl: target.URL(storageConf, target.Key("media/wistia-s3.min.js")),
+		TrackingID:    this.Conf.GATrackingId,
+		Video:         linkTargetVideo(video, target, storageConf),
+		Index:         index,
+		IndexUrl:      target.URL(storageConf, target.Key(media+"/index.json")),
+	}
+	if cover := data.Asset("StillImageFile", 0); cover != nil {
+		data.Cover = cover.Url
+	}
+	if index != nil {
+		data.IndexAIUrl = target.URL(storageConf, target.Key(media+"/index-ai.json"))
+		data.SubtitlesUrl = target.URL(storageConf, target.Key(media+"/subtitles.vtt"))
+	}
+	return data
+}
+
+// Asset returns the first asset of assetType, of the given height unless height is 0, e.g.
+// {{with .Asset "Mp4VideoFile" 720}}{{.Url}}{{end}}.
+func (this *TemplateData) Asset(assetType string, height int) *WistiaRespVideoAsset {
+	if this.Video == nil || this.Video.Assets == nil {
+		return nil
+	}
+	for _, asset := range *this.Video.Assets {
+		if asset.Type == assetType && (height == 0 || asset.Height == height) {
+			return asset
+		}
+	}
+	return nil
+}
+
+// templateFuncs are available to every page template. Pages render with text/template, which does
+// not escape anything: Wistia and AI supplied text is written through the html builtin.
+var templateFuncs = template.FuncMap{
+	"duration": formatDuration,
+	"json":     templateJSON,
+	"urljoin":  urlJoin,
+}
+
+// formatDuration formats seconds as m:ss, or h:mm:ss from an hour on.
+func formatDuration(seconds interface{}) string {
+	var value float64
+	switch v := seconds.(type) {
+	case float32:
+		value = float64(v)
+	case float64:
+		value = v
+	case int:
+		value = float64(v)
+	case int64:
+		value = float64(v)
+	}
+	total := int64(math.Round(math.Max(value, 0)))
+	hours, minutes, secs := total/3600, total%3600/60, total%60
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", hours, minutes, secs)
+	}
+	return fmt.Sprintf("%d:%02d", minutes, secs)
+}
+
+// templateJSON encodes value as JSON. encoding/json escapes <, > and &, so the output is safe
+// inside <script>; elsewhere it still goes through html like any other text.
+func templateJSON(value interface{}) (string, error) {
+	bin, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(bin), nil
+}
+
+// urlJoin joins base and parts with single slashes, e.g. urljoin .MediaEndPoint .HashId "index.json".
+func urlJoin(base string, parts ...string) string {
+	joined := strings.TrimRight(base, "/")
+	for _, part := range parts {
+		if part = strings.Trim(part, "/"); len(part) > 0 {
+			joined += "/" + part
+		}
+	}
+	return joined
+}
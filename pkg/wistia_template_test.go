@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type fakeIndexStore map[string]*DashScopeIndexResult
+
+func (this fakeIndexStore) FindVideoIndex(hashId string) (*DashScopeIndexResult, error) {
+	if index, ok := this[hashId]; ok {
+		return index, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	durations := map[interface{}]string{float32(62.4): "1:02", 3725.0: "1:02:05", 0: "0:00", -3: "0:00"}
+	for seconds, want := range durations {
+		if got := formatDuration(seconds); got != want {
+			t.Errorf("duration(%v) = %s, want %s", seconds, got, want)
+		}
+	}
+	if got := urlJoin("https://cdn.example.com/media/", "/abc/", "index.json"); got != "https://cdn.example.com/media/abc/index.json" {
+		t.Errorf("unexpected urljoin %s", got)
+	}
+	if got, _ := templateJSON(map[string]string{"a": "<b>"}); got != `{"a":"\u003cb\u003e"}` {
+		t.Errorf("unexpected json %s", got)
+	}
+}
+
+func TestWistiaHelper_PublishDemoPage(t *testing.T) {
+	tplDir := t.TempDir()
+	page := `{{html .Video.Name}} {{duration .Video.Duration}} {{.Cover}}
+{{with .Asset "Mp4VideoFile" 720}}{{.Url}}{{end}}
+{{urljoin .MediaEndPoint .HashId "index.json"}} {{.IndexUrl}}
+{{with .Index}}{{html .Summary}} <script>var chapters = {{json .Chapters}};</script> {{$.SubtitlesUrl}}{{end}}
+<p data-chapters="{{html (json .Index.Chapters)}}"></p>`
+	if err := os.WriteFile(filepath.Join(tplDir, "landing.html"), []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	disk := getLocalStorage(t).(*LocalStorage)
+	storageConf := &StorageConfig{
+		Local:   disk.Conf,
+		Targets: []*PublicationTarget{{Name: "custom", Prefix: "custom", BaseURL: "https://media.example.com"}},
+	}
+	helper := NewWistiaHelper(&WistiaConf{TemplateDirPath: tplDir, WorkerLimit: 1}).WithIndexes(fakeIndexStore{
+		"abc": {Summary: "A <b>summary</b>", Chapters: []DashScopeChapterEntry{{Title: "Intro"}}},
+	})
+	video := &WistiaRespVideo{
+		HashId:   "abc",
+		Name:     "Demo <script>",
+		Duration: 125,
+		Assets: &AssetList{
+			{Type: "StillImageFile", ContentType: "image/jpg", Url: "http://127.0.0.1:3031/files/wistia-backup/media/abc/cover.jpg"},
+			{Type: "Mp4VideoFile", Height: 720, ContentType: "video/mp4", Url: "http://127.0.0.1:3031/files/wistia-backup/media/abc/720.mp4"},
+		},
+	}
+
+	reports, err := helper.PublishDemoPage("landing.html", video, storageConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("expected a page per target, got %d", len(reports))
+	}
+
+	bin, err := os.ReadFile(filepath.Join(disk.Conf.Root, "wistia-backup/custom/media/abc/landing.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Demo &lt;script&gt; 2:05 https://media.example.com/wistia-backup/media/abc/cover.jpg",
+		"https://media.example.com/wistia-backup/media/abc/720.",
+		"https://media.example.com/wistia-backup/custom/media/abc/index.json https://media.example.com/wistia-backup/custom/media/abc/index.json",
+		`A &lt;b&gt;summary&lt;/b&gt; <script>var chapters = [{"start":0,"end":0,"title":"Intro"}];</script>`,
+		`<p data-chapters="[{&#34;start&#34;:0,&#34;end&#34;:0,&#34;title&#34;:&#34;Intro&#34;}]"></p>`,
+		"https://media.example.com/wistia-backup/custom/media/abc/subtitles.vtt",
+	} {
+		if !strings.Contains(string(bin), want) {
+			t.Errorf("page misses %q:\n%s", want, bin)
+		}
+	}
+}
@@ -2,10 +2,17 @@ package pkg
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"mime"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 	"wistia-s3/tests"
 )
 
@@ -48,17 +55,22 @@ func TestWistiaHelper_MoveToS3(t *testing.T) {
 	conf := new(WistiaConf)
 	conf.MarginWithENV()
 	helper := NewWistiaHelper(conf)
-	s3Conf := loadS3Config()
+	storageConf := &StorageConfig{S3: loadS3Config()}
 
-	cloudFrontJson, s3Json, err := helper.MoveToS3("u7k1cgyjy0", s3Conf)
+	report, err := helper.MoveToS3("u7k1cgyjy0", storageConf, nil, nil)
 	if err != nil {
 		t.Error(err)
 		t.Fail()
 		return
 	}
+	for _, asset := range report.Assets {
+		if !asset.Status {
+			t.Errorf("asset %s (%d) failed: %s", asset.Type, asset.Height, asset.Error)
+		}
+	}
 
-	t.Logf("cloudfront: %s\n", cloudFrontJson)
-	t.Logf("s3: %s\n", s3Json)
+	t.Logf("cloudfront: %s\n", report.CloudFront)
+	t.Logf("s3: %s\n", report.S3)
 
 	t.Log("PASS")
 }
@@ -137,9 +149,9 @@ func TestWistiaHelper_UploadWistiaS3JS(t *testing.T) {
 	conf := new(WistiaConf)
 	conf.MarginWithENV()
 	helper := NewWistiaHelper(conf)
-	s3Conf := loadS3Config()
+	storageConf := &StorageConfig{S3: loadS3Config()}
 
-	cfUrl, s3Url, err := helper.UploadWistiaS3JS(s3Conf)
+	cfUrl, s3Url, err := helper.UploadWistiaS3JS(storageConf)
 	if err != nil {
 		t.Error(err)
 		t.Fail()
@@ -154,7 +166,7 @@ func TestWistiaHelper_UploadDemoPage(t *testing.T) {
 	conf := new(WistiaConf)
 	conf.MarginWithENV()
 	helper := NewWistiaHelper(conf)
-	s3Conf := loadS3Config()
+	storageConf := &StorageConfig{S3: loadS3Config()}
 
 	videoData := new(WistiaRespVideo)
 
@@ -251,7 +263,7 @@ func TestWistiaHelper_UploadDemoPage(t *testing.T) {
 		return
 	}
 
-	cfUrl, s3Url, err := helper.UploadDemoPage("index.html", videoData, s3Conf, nil)
+	cfUrl, s3Url, err := helper.UploadDemoPage("index.html", videoData, storageConf, nil)
 	if err != nil {
 		t.Error(err)
 		t.Fail()
@@ -260,7 +272,7 @@ func TestWistiaHelper_UploadDemoPage(t *testing.T) {
 	t.Logf("cloudfront: %s\n", cfUrl)
 	t.Logf("s3: %s\n", s3Url)
 
-	cfUrl, s3Url, err = helper.UploadDemoPage("demo.html", videoData, s3Conf, nil)
+	cfUrl, s3Url, err = helper.UploadDemoPage("demo.html", videoData, storageConf, nil)
 	if err != nil {
 		t.Error(err)
 		t.Fail()
@@ -276,7 +288,7 @@ func TestWistiaHelper_reUploadAllDemoPage(t *testing.T) {
 	conf := new(WistiaConf)
 	conf.MarginWithENV()
 	helper := NewWistiaHelper(conf)
-	s3Conf := loadS3Config()
+	storageConf := &StorageConfig{S3: loadS3Config()}
 
 	type videoList struct {
 		Data []*WistiaRespVideo `json:"data"`
@@ -298,7 +310,7 @@ func TestWistiaHelper_reUploadAllDemoPage(t *testing.T) {
 	}
 
 	for _, videoData := range list.Data {
-		cfUrl, s3Url, err := helper.UploadDemoPage("index.html", videoData, s3Conf, nil)
+		cfUrl, s3Url, err := helper.UploadDemoPage("index.html", videoData, storageConf, nil)
 		if err != nil {
 			t.Error(err)
 			continue
@@ -306,7 +318,7 @@ func TestWistiaHelper_reUploadAllDemoPage(t *testing.T) {
 		t.Logf("cloudfront: %s\n", cfUrl)
 		t.Logf("s3: %s\n", s3Url)
 
-		cfUrl, s3Url, err = helper.UploadDemoPage("demo.html", videoData, s3Conf, nil)
+		cfUrl, s3Url, err = helper.UploadDemoPage("demo.html", videoData, storageConf, nil)
 		if err != nil {
 			t.Error(err)
 			continue
@@ -322,11 +334,11 @@ func TestWistiaHelper_GenerateVideoInfoURL(t *testing.T) {
 	conf := new(WistiaConf)
 	conf.MarginWithENV()
 
-	s3Conf := loadS3Config()
+	storageConf := &StorageConfig{S3: loadS3Config()}
 
 	helper := NewWistiaHelper(conf)
 
-	cloudfrontJson, s3Json := helper.GenerateVideoInfoURL("7bg0z4stnx", s3Conf)
+	cloudfrontJson, s3Json := helper.GenerateVideoInfoURL("7bg0z4stnx", storageConf)
 	t.Log(cloudfrontJson)
 	t.Log(s3Json)
 }
@@ -369,3 +381,94 @@ func TestWistiaHelper_ArchiveVideos(t *testing.T) {
 	}
 	t.Log("PASS")
 }
+
+func TestWistiaHelper_transferAsset_Verify(t *testing.T) {
+	payload := []byte("0123456789abcdef")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	}))
+	defer server.Close()
+
+	helper := NewWistiaHelper(&WistiaConf{WorkerLimit: 1})
+	disk := getLocalStorage(t)
+	video := &WistiaRespVideo{HashId: "abc123"}
+
+	asset := &WistiaRespVideoAsset{
+		Type:        "Mp4VideoFile",
+		Url:         server.URL + "/224.mp4",
+		FileSize:    len(payload),
+		ContentType: "video/mp4",
+		Height:      224,
+	}
+	report := helper.transferAsset(disk, video, asset)
+	if !report.Status {
+		t.Fatal(report.Error)
+	}
+	// the extension comes from the system mime table, so only the stem is stable
+	if !strings.HasPrefix(report.Key, "media/abc123/224.") || report.Bytes != int64(len(payload)) {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if asset.SHA256 != "9f9f5111f7b27a781f1f1ddde5ebc2dd2b796bfc7365c9c28b548e564176929f" {
+		t.Errorf("unexpected sha256 %s", asset.SHA256)
+	}
+	if asset.MD5 == "" || asset.S3Key != "wistia-backup/"+report.Key {
+		t.Errorf("asset not updated after transfer: %+v", asset)
+	}
+
+	truncated := &WistiaRespVideoAsset{
+		Type:        "HdMp4VideoFile",
+		Url:         server.URL + "/720.mp4",
+		FileSize:    len(payload) * 2,
+		ContentType: "video/mp4",
+		Height:      720,
+	}
+	report = helper.transferAsset(disk, video, truncated)
+	if report.Status || report.Error == "" {
+		t.Errorf("expected size mismatch error, got %+v", report)
+	} else {
+		t.Log(report.Error)
+	}
+	if truncated.S3Key != "" || truncated.SHA256 != "" {
+		t.Errorf("failed asset must not be marked as migrated: %+v", truncated)
+	}
+
+	t.Log("PASS")
+}
+
+func TestWistiaHelper_transferAsset_Stalled(t *testing.T) {
+	payload := []byte("0123456789abcdef")
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		if atomic.AddInt32(&requests, 1) > 1 {
+			w.Write(payload)
+			return
+		}
+		// the first response stops halfway until the client gives up
+		w.Write(payload[:4])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	helper := NewWistiaHelper(&WistiaConf{WorkerLimit: 1})
+	helper.client.idleTimeout = 50 * time.Millisecond
+
+	resp, err := helper.client.Download(server.URL + "/224.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, ErrDownloadStalled) {
+		t.Fatalf("expected a stalled download, got %v", err)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	helper.Conf.MaxRetries = 1
+	asset := &WistiaRespVideoAsset{Type: "Mp4VideoFile", Url: server.URL + "/224.mp4", FileSize: len(payload), ContentType: "video/mp4", Height: 224}
+	report := helper.transferAsset(getLocalStorage(t), &WistiaRespVideo{HashId: "abc123"}, asset)
+	if !report.Status || report.Bytes != int64(len(payload)) || atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("a stalled download must be started over, got %+v after %d request(s)", report, requests)
+	}
+}